@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// RawMessage is an encoded bencode value. It is written as is by Marshal and
+// Unmarshal stores the exact bytes of the value in it, which lets a value be
+// decoded later or hashed as it was sent.
+type RawMessage []byte
+
+var (
+	rawMessageType = reflect.TypeOf(RawMessage{})
+	bigIntType     = reflect.TypeOf(big.Int{})
+)
+
+// Marshal returns the bencode encoding of v.
+//
+// Strings and byte slices are encoded as byte strings, integers of any width
+// including big.Int as integers and bools as the integers 0 and 1. Slices and arrays become
+// lists, and maps with string keys as well as structs become dictionaries
+// with sorted keys. Pointers and interfaces are encoded as the value they
+// point to.
+//
+// Struct fields are encoded under the name given in their bencode tag, or
+// their field name without one. A tag of "-" skips the field, and the
+// omitempty option skips it when it has its zero value:
+//
+//	Interval int    `bencode:"interval"`
+//	Reason   string `bencode:"failure reason,omitempty"`
+func Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := marshalValue(&buf, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func marshalValue(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		return fmt.Errorf("cannot marshal nil value")
+	}
+
+	if v.Type() == rawMessageType {
+		if v.Len() == 0 {
+			return fmt.Errorf("cannot marshal empty RawMessage")
+		}
+		buf.Write(v.Bytes())
+		return nil
+	}
+	if v.Type() == bigIntType {
+		i := v.Interface().(big.Int)
+		buf.WriteString("i" + i.String() + "e")
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		writeBencodeString(buf, v.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf.WriteString("i" + strconv.FormatInt(v.Int(), 10) + "e")
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		buf.WriteString("i" + strconv.FormatUint(v.Uint(), 10) + "e")
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteString("i1e")
+		} else {
+			buf.WriteString("i0e")
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if v.Kind() == reflect.Slice {
+				writeBencodeString(buf, string(v.Bytes()))
+			} else {
+				b := make([]byte, v.Len())
+				reflect.Copy(reflect.ValueOf(b), v)
+				writeBencodeString(buf, string(b))
+			}
+			return nil
+		}
+		buf.WriteByte('l')
+		for i := 0; i < v.Len(); i++ {
+			if err := marshalValue(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("cannot marshal map with %s keys", v.Type().Key())
+		}
+		keys := v.MapKeys()
+		slices.SortFunc(keys, func(a, b reflect.Value) int {
+			return strings.Compare(a.String(), b.String())
+		})
+		buf.WriteByte('d')
+		for _, key := range keys {
+			writeBencodeString(buf, key.String())
+			if err := marshalValue(buf, v.MapIndex(key)); err != nil {
+				return fmt.Errorf("%s: %s", key.String(), err.Error())
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Struct:
+		fields := structFields(v.Type())
+		buf.WriteByte('d')
+		for _, f := range fields {
+			fv := v.Field(f.index)
+			if f.omitEmpty && fv.IsZero() {
+				continue
+			}
+			writeBencodeString(buf, f.name)
+			if err := marshalValue(buf, fv); err != nil {
+				return fmt.Errorf("%s: %s", f.name, err.Error())
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return fmt.Errorf("cannot marshal nil %s", v.Type())
+		}
+		return marshalValue(buf, v.Elem())
+	default:
+		return fmt.Errorf("cannot marshal %s", v.Type())
+	}
+	return nil
+}
+
+func writeBencodeString(buf *bytes.Buffer, s string) {
+	buf.WriteString(strconv.Itoa(len(s)))
+	buf.WriteByte(':')
+	buf.WriteString(s)
+}
+
+type structField struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+// structFields returns the encoded fields of a struct type, sorted by the
+// dictionary key they are stored under.
+func structFields(t reflect.Type) []structField {
+	fields := []structField{}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, structField{name: name, index: i, omitEmpty: options == "omitempty"})
+	}
+	slices.SortFunc(fields, func(a, b structField) int {
+		return strings.Compare(a.name, b.name)
+	})
+	return fields
+}
+
+// Unmarshal decodes the bencoded data into the value v points to, following
+// the rules of Marshal in reverse. Integers 0 and 1 decode into bools, byte
+// strings into strings and byte slices, and dictionary keys without a
+// matching struct field are ignored. Decoding into an interface stores the
+// value as decodeBencode returns it.
+func Unmarshal(data []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("cannot unmarshal into non-pointer %T", v)
+	}
+	end, err := unmarshalValue(data, 0, rv.Elem())
+	if err != nil {
+		return err
+	}
+	if end != len(data) {
+		return newSyntaxError(int64(end), "unexpected data after value")
+	}
+	return nil
+}
+
+// unmarshalValue decodes the value at pos into v and returns the position
+// right after it.
+func unmarshalValue(data []byte, pos int, v reflect.Value) (int, error) {
+	if pos >= len(data) {
+		return pos, newSyntaxError(int64(pos), "unexpected end of data")
+	}
+
+	if v.Type() == rawMessageType {
+		end, err := skipValue(data, pos)
+		if err != nil {
+			return end, err
+		}
+		v.SetBytes(slices.Clone(data[pos:end]))
+		return end, nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return unmarshalValue(data, pos, v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return pos, fmt.Errorf("cannot unmarshal into %s", v.Type())
+		}
+		decoded, end, err := decodeValue(data, pos, 0, false)
+		if err != nil {
+			return end, err
+		}
+		v.Set(reflect.ValueOf(decoded))
+		return end, nil
+	}
+
+	switch c := data[pos]; {
+	case c >= '0' && c <= '9':
+		s, end, err := decodeString(data, pos)
+		if err != nil {
+			return end, err
+		}
+		return end, setString(v, s)
+	case c == 'i':
+		digits, end, err := integerDigits(data, pos)
+		if err != nil {
+			return end, err
+		}
+		if err := setInteger(v, digits); err != nil {
+			return pos, err
+		}
+		return end, nil
+	case c == 'l':
+		return unmarshalList(data, pos, v)
+	case c == 'd':
+		return unmarshalDictionary(data, pos, v)
+	default:
+		return pos, newSyntaxError(int64(pos), "unexpected character %q", c)
+	}
+}
+
+func setString(v reflect.Value, s string) error {
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes([]byte(s))
+	case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+		if len(s) != v.Len() {
+			return fmt.Errorf("cannot unmarshal string of length %d into %s", len(s), v.Type())
+		}
+		reflect.Copy(v, reflect.ValueOf([]byte(s)))
+	default:
+		return fmt.Errorf("cannot unmarshal string into %s", v.Type())
+	}
+	return nil
+}
+
+// setInteger stores the integer written as digits in v, parsing it for the
+// width of v so that the full range of int64, uint64 and big.Int is usable.
+func setInteger(v reflect.Value, digits string) error {
+	if v.Type() == bigIntType {
+		i, ok := new(big.Int).SetString(digits, 10)
+		if !ok {
+			return fmt.Errorf("invalid integer %q", digits)
+		}
+		v.Set(reflect.ValueOf(i).Elem())
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(digits, 10, 64)
+		if err != nil && !errors.Is(err, strconv.ErrRange) {
+			return fmt.Errorf("invalid integer %q", digits)
+		}
+		if err != nil || v.OverflowInt(i) {
+			return fmt.Errorf("integer %s overflows %s", digits, v.Type())
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		i, err := strconv.ParseUint(digits, 10, 64)
+		if err != nil && !errors.Is(err, strconv.ErrRange) && !strings.HasPrefix(digits, "-") {
+			return fmt.Errorf("invalid integer %q", digits)
+		}
+		if err != nil || v.OverflowUint(i) {
+			return fmt.Errorf("integer %s overflows %s", digits, v.Type())
+		}
+		v.SetUint(i)
+	case reflect.Bool:
+		if digits != "0" && digits != "1" {
+			return fmt.Errorf("cannot unmarshal integer %s into bool", digits)
+		}
+		v.SetBool(digits == "1")
+	default:
+		return fmt.Errorf("cannot unmarshal integer into %s", v.Type())
+	}
+	return nil
+}
+
+func unmarshalList(data []byte, pos int, v reflect.Value) (int, error) {
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return pos, fmt.Errorf("cannot unmarshal list into %s", v.Type())
+	}
+
+	if v.Kind() == reflect.Slice {
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+	}
+	curIndex := pos + 1 // skip initial 'l'
+	for i := 0; ; i++ {
+		if curIndex >= len(data) {
+			return curIndex, newSyntaxError(int64(curIndex), "reached end of the data before finding the end of the list")
+		}
+		if data[curIndex] == 'e' {
+			break
+		}
+
+		var elem reflect.Value
+		if v.Kind() == reflect.Slice {
+			v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+			elem = v.Index(i)
+		} else if i < v.Len() {
+			elem = v.Index(i)
+		} else {
+			return curIndex, fmt.Errorf("list has more than %d elements for %s", v.Len(), v.Type())
+		}
+
+		end, err := unmarshalValue(data, curIndex, elem)
+		if err != nil {
+			return end, pathError(fmt.Sprintf("list element %d", i), err)
+		}
+		curIndex = end
+	}
+	return curIndex + 1, nil
+}
+
+func unmarshalDictionary(data []byte, pos int, v reflect.Value) (int, error) {
+	var fieldsByName map[string]structField
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return pos, fmt.Errorf("cannot unmarshal dictionary into %s", v.Type())
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	case reflect.Struct:
+		fieldsByName = map[string]structField{}
+		for _, f := range structFields(v.Type()) {
+			fieldsByName[f.name] = f
+		}
+	default:
+		return pos, fmt.Errorf("cannot unmarshal dictionary into %s", v.Type())
+	}
+
+	curIndex := pos + 1 // skip initial 'd'
+	for {
+		if curIndex >= len(data) {
+			return curIndex, newSyntaxError(int64(curIndex), "reached end of the data before finding the end of the dictionary")
+		}
+		if data[curIndex] == 'e' {
+			break
+		}
+		if data[curIndex] < '0' || data[curIndex] > '9' {
+			return curIndex, newSyntaxError(int64(curIndex), "key in dictionary has to be a string")
+		}
+
+		key, end, err := decodeString(data, curIndex)
+		if err != nil {
+			return end, err
+		}
+		curIndex = end
+
+		switch v.Kind() {
+		case reflect.Map:
+			elem := reflect.New(v.Type().Elem()).Elem()
+			end, err = unmarshalValue(data, curIndex, elem)
+			if err == nil {
+				v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+			}
+		default:
+			if f, ok := fieldsByName[key]; ok {
+				end, err = unmarshalValue(data, curIndex, v.Field(f.index))
+			} else {
+				end, err = skipValue(data, curIndex)
+			}
+		}
+		if err != nil {
+			return end, pathError(key, err)
+		}
+		curIndex = end
+	}
+	return curIndex + 1, nil
+}
+
+// skipValue returns the position right after the value at pos.
+func skipValue(data []byte, pos int) (int, error) {
+	_, end, err := decodeValue(data, pos, 0, true)
+	return end, err
+}
+
+// pathError prefixes a type error with where in the value it happened.
+// Syntax errors already carry their offset and are returned as they are.
+func pathError(path string, err error) error {
+	if _, ok := err.(*SyntaxError); ok {
+		return err
+	}
+	return fmt.Errorf("%s: %s", path, err.Error())
+}
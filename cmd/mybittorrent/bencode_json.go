@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// binaryEncoding is how byte strings that are not valid UTF-8 are written in
+// JSON, which can only hold text.
+type binaryEncoding string
+
+const (
+	binaryHex    binaryEncoding = "hex"
+	binaryBase64 binaryEncoding = "base64"
+	// a dictionary written as is, used when it could be mistaken for one of
+	// the forms above or has keys that are not valid UTF-8
+	jsonDictKey = "$dict"
+)
+
+// byteString is a bencode string that is not valid UTF-8, such as piece
+// hashes or compact peers, on its way to JSON. It only exists in the tree
+// toJSONTree builds: decoded bencode keeps such strings as Go strings, which
+// hold any bytes, so everything else reading the decoded tree is unaffected.
+// Its JSON form is {"$hex": "..."} or {"$base64": "..."}.
+type byteString struct {
+	data     string
+	encoding binaryEncoding
+}
+
+func (b byteString) MarshalJSON() ([]byte, error) {
+	if b.encoding == binaryBase64 {
+		return json.Marshal(map[string]string{"$base64": base64.StdEncoding.EncodeToString([]byte(b.data))})
+	}
+	return json.Marshal(map[string]string{"$hex": hex.EncodeToString([]byte(b.data))})
+}
+
+// bencodeToJSON encodes a decoded bencode value as JSON without losing any
+// bytes, so that jsonToBencode can turn it back into the exact same bencode.
+func bencodeToJSON(v any, encoding binaryEncoding) ([]byte, error) {
+	return json.Marshal(toJSONTree(v, encoding))
+}
+
+func toJSONTree(v any, encoding binaryEncoding) any {
+	switch v := v.(type) {
+	case string:
+		if !utf8.ValidString(v) {
+			return byteString{data: v, encoding: encoding}
+		}
+		return v
+	case []any:
+		list := []any{}
+		for _, item := range v {
+			list = append(list, toJSONTree(item, encoding))
+		}
+		return list
+	case map[string]any:
+		binaryKeys := false
+		dict := map[string]any{}
+		for key, value := range v {
+			binaryKeys = binaryKeys || !utf8.ValidString(key)
+			dict[key] = toJSONTree(value, encoding)
+		}
+		if binaryKeys {
+			// JSON object keys are text, so keep the pairs in a list
+			keys := []string{}
+			for key := range v {
+				keys = append(keys, key)
+			}
+			slices.Sort(keys)
+			pairs := []any{}
+			for _, key := range keys {
+				pairs = append(pairs, []any{toJSONTree(key, encoding), dict[key]})
+			}
+			return map[string]any{jsonDictKey: pairs}
+		}
+		if len(dict) == 1 {
+			for key := range dict {
+				if strings.HasPrefix(key, "$") {
+					return map[string]any{jsonDictKey: dict}
+				}
+			}
+		}
+		return dict
+	default:
+		return v
+	}
+}
+
+// jsonToBencode encodes JSON as written by bencodeToJSON as bencode.
+func jsonToBencode(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var v any
+	if err := decoder.Decode(&v); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %s", err.Error())
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("invalid JSON: unexpected data after value")
+	}
+
+	value, err := fromJSONTree(v)
+	if err != nil {
+		return nil, err
+	}
+	return encodeBencode(value)
+}
+
+func fromJSONTree(v any) (any, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		if i, err := strconv.ParseInt(v.String(), 10, 64); err == nil {
+			if int64(int(i)) == i {
+				return int(i), nil
+			}
+			return i, nil
+		}
+		// bencode integers have no limit, JSON numbers neither
+		i, ok := new(big.Int).SetString(v.String(), 10)
+		if !ok {
+			return nil, fmt.Errorf("bencode only has integers, not %s", v.String())
+		}
+		return i, nil
+	case []any:
+		list := []any{}
+		for _, item := range v {
+			value, err := fromJSONTree(item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		return list, nil
+	case map[string]any:
+		if len(v) == 1 {
+			for key, value := range v {
+				switch key {
+				case "$hex", "$base64":
+					return fromJSONByteString(key, value)
+				case jsonDictKey:
+					return fromJSONDict(value)
+				}
+			}
+		}
+		return fromJSONDict(v)
+	default:
+		return nil, fmt.Errorf("bencode cannot hold %v", v)
+	}
+}
+
+func fromJSONByteString(key string, value any) (any, error) {
+	s, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s value is not a string", key)
+	}
+	var decoded []byte
+	var err error
+	if key == "$hex" {
+		decoded, err = hex.DecodeString(s)
+	} else {
+		decoded, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s value: %s", key, err.Error())
+	}
+	return string(decoded), nil
+}
+
+// fromJSONDict reads a dictionary, either a JSON object or the list of
+// key-value pairs used for binary keys.
+func fromJSONDict(v any) (any, error) {
+	dict := map[string]any{}
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			decoded, err := fromJSONTree(value)
+			if err != nil {
+				return nil, err
+			}
+			dict[key] = decoded
+		}
+	case []any:
+		for _, rawPair := range v {
+			pair, ok := rawPair.([]any)
+			if !ok || len(pair) != 2 {
+				return nil, fmt.Errorf("%s pairs have to be lists of a key and a value", jsonDictKey)
+			}
+			key, err := fromJSONTree(pair[0])
+			if err != nil {
+				return nil, err
+			}
+			keyString, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("dictionary key has to be a string")
+			}
+			value, err := fromJSONTree(pair[1])
+			if err != nil {
+				return nil, err
+			}
+			dict[keyString] = value
+		}
+	default:
+		return nil, fmt.Errorf("%s value has to be an object or a list of pairs", jsonDictKey)
+	}
+	return dict, nil
+}
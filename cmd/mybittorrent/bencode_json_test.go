@@ -0,0 +1,120 @@
+package main
+
+import "testing"
+
+func TestBencodeJSONRoundTrip(t *testing.T) {
+	tests := []struct {
+		name         string
+		input        string
+		encoding     binaryEncoding
+		expectedJSON string
+	}{
+		{
+			name:         "text",
+			input:        "d3:foo3:bar5:helloi52ee",
+			encoding:     binaryHex,
+			expectedJSON: `{"foo":"bar","hello":52}`,
+		},
+		{
+			name:         "binary string as hex",
+			input:        "d6:pieces4:\xff\x00\x10\x80e",
+			encoding:     binaryHex,
+			expectedJSON: `{"pieces":{"$hex":"ff001080"}}`,
+		},
+		{
+			name:         "binary string as base64",
+			input:        "l2:\xff\x01e",
+			encoding:     binaryBase64,
+			expectedJSON: `[{"$base64":"/wE="}]`,
+		},
+		{
+			name:         "dictionary that looks like a byte string",
+			input:        "d4:$hex4:cafee",
+			encoding:     binaryHex,
+			expectedJSON: `{"$dict":{"$hex":"cafe"}}`,
+		},
+		{
+			name:         "binary dictionary keys",
+			input:        "d1:a0:2:\xfe\xffi1ee",
+			encoding:     binaryHex,
+			expectedJSON: `{"$dict":[["a",""],[{"$hex":"feff"},1]]}`,
+		},
+		{
+			name:         "integers that do not fit into JSON floats",
+			input:        "li9007199254740993ei-9007199254740993ee",
+			encoding:     binaryHex,
+			expectedJSON: `[9007199254740993,-9007199254740993]`,
+		},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			decoded, _, err := decodeBencode([]byte(ts.input))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			actualJSON, err := bencodeToJSON(decoded, ts.encoding)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if string(actualJSON) != ts.expectedJSON {
+				t.Fatalf("unexpected JSON: %s instead of %s", actualJSON, ts.expectedJSON)
+			}
+
+			encoded, err := jsonToBencode(actualJSON)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if string(encoded) != ts.input {
+				t.Fatalf("unexpected bencode: %q instead of %q", encoded, ts.input)
+			}
+		})
+	}
+}
+
+// The decoded tree has no byte-string type of its own: a Go string holds any
+// bytes, so binary values already survive decoding and encoding unchanged,
+// and only the JSON form needs byteString.
+func TestDecodedTreeKeepsBinaryStrings(t *testing.T) {
+	input := "d5:peers6:\x7f\x00\x00\x01\x1a\xe16:pieces4:\xff\x00\x10\x80e"
+	decoded, _, err := decodeBencode([]byte(input))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if pieces := decoded.(map[string]any)["pieces"]; pieces != "\xff\x00\x10\x80" {
+		t.Fatalf("unexpected pieces: %q", pieces)
+	}
+
+	encoded, err := encodeBencode(decoded)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if string(encoded) != input {
+		t.Fatalf("unexpected bencode: %q instead of %q", encoded, input)
+	}
+}
+
+func TestJSONToBencodeErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{name: "float", input: `1.5`},
+		{name: "bool", input: `[true]`},
+		{name: "null", input: `{"a":null}`},
+		{name: "invalid hex", input: `{"$hex":"zz"}`},
+		{name: "invalid base64", input: `{"$base64":"!"}`},
+		{name: "invalid pairs", input: `{"$dict":[["a"]]}`},
+		{name: "integer key", input: `{"$dict":[[1,2]]}`},
+		{name: "trailing data", input: `1 2`},
+		{name: "invalid JSON", input: `{`},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			if _, err := jsonToBencode([]byte(ts.input)); err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+}
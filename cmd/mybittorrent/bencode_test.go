@@ -0,0 +1,223 @@
+package main
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+)
+
+type testBencodeFile struct {
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+type testBencodeInfo struct {
+	Name        string            `bencode:"name"`
+	PieceLength uint32            `bencode:"piece length"`
+	Pieces      []byte            `bencode:"pieces"`
+	Private     bool              `bencode:"private,omitempty"`
+	Files       []testBencodeFile `bencode:"files,omitempty"`
+	Source      *string           `bencode:"source,omitempty"`
+	Ignored     string            `bencode:"-"`
+}
+
+type testBencodeTorrent struct {
+	Announce string            `bencode:"announce"`
+	Comment  string            `bencode:"comment,omitempty"`
+	Info     RawMessage        `bencode:"info"`
+	Extra    map[string]int8   `bencode:"extra,omitempty"`
+	Nodes    [][2]any          `bencode:"nodes,omitempty"`
+	Headers  map[string]string `bencode:",omitempty"`
+}
+
+func TestMarshal(t *testing.T) {
+	source := "src"
+	tests := []struct {
+		name     string
+		value    any
+		expected string
+	}{
+		{
+			name:     "scalars",
+			value:    []any{"spam", -3, int8(4), uint64(5), true, false, []byte{0xff, 0}},
+			expected: "l4:spami-3ei4ei5ei1ei0e2:\xff\x00e",
+		},
+		{
+			name:     "map with sorted keys",
+			value:    map[string]int16{"b": 2, "a": 1},
+			expected: "d1:ai1e1:bi2ee",
+		},
+		{
+			name: "struct with tags",
+			value: testBencodeInfo{
+				Name:        "dir",
+				PieceLength: 16,
+				Pieces:      []byte("hash"),
+				Private:     true,
+				Files:       []testBencodeFile{{Length: 3, Path: []string{"a", "b"}}},
+				Source:      &source,
+				Ignored:     "ignored",
+			},
+			expected: "d5:filesld6:lengthi3e4:pathl1:a1:beee4:name3:dir12:piece lengthi16e6:pieces4:hash7:privatei1e6:source3:srce",
+		},
+		{
+			name:     "omitempty",
+			value:    &testBencodeInfo{Name: "a", Pieces: []byte{}},
+			expected: "d4:name1:a12:piece lengthi0e6:pieces0:e",
+		},
+		{
+			name:     "raw message",
+			value:    testBencodeTorrent{Announce: "url", Info: RawMessage("d1:zi1e1:ai2ee")},
+			expected: "d8:announce3:url4:infod1:zi1e1:ai2eee",
+		},
+		{
+			name:     "untagged field",
+			value:    testBencodeTorrent{Announce: "url", Info: RawMessage("i1e"), Headers: map[string]string{"k": "v"}},
+			expected: "d7:Headersd1:k1:ve8:announce3:url4:infoi1ee",
+		},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			actual, err := Marshal(ts.value)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if string(actual) != ts.expected {
+				t.Fatalf("unexpected encoding: %q instead of %q", actual, ts.expected)
+			}
+		})
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		value any
+	}{
+		{name: "nil", value: nil},
+		{name: "nil pointer", value: (*testBencodeInfo)(nil)},
+		{name: "float", value: 1.5},
+		{name: "int keys", value: map[int]string{1: "a"}},
+		{name: "empty raw message", value: testBencodeTorrent{}},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			if _, err := Marshal(ts.value); err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	var torrent testBencodeTorrent
+	input := "d8:announce3:url7:unknownl1:xe4:infod4:name3:dir12:piece lengthi16e6:pieces4:hash7:privatei1e" +
+		"5:filesld6:lengthi3e4:pathl1:a1:beee6:source3:srce5:extrad1:ai-1ee5:nodesll1:hi1eeee"
+	if err := Unmarshal([]byte(input), &torrent); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if torrent.Announce != "url" {
+		t.Fatalf("unexpected announce: %q", torrent.Announce)
+	}
+	if !reflect.DeepEqual(torrent.Extra, map[string]int8{"a": -1}) {
+		t.Fatalf("unexpected extra: %v", torrent.Extra)
+	}
+	if !reflect.DeepEqual(torrent.Nodes, [][2]any{{"h", 1}}) {
+		t.Fatalf("unexpected nodes: %v", torrent.Nodes)
+	}
+	expectedInfo := "d4:name3:dir12:piece lengthi16e6:pieces4:hash7:privatei1e5:filesld6:lengthi3e4:pathl1:a1:beee6:source3:srce"
+	if string(torrent.Info) != expectedInfo {
+		t.Fatalf("unexpected raw info: %q instead of %q", torrent.Info, expectedInfo)
+	}
+
+	var info testBencodeInfo
+	if err := Unmarshal(torrent.Info, &info); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	source := "src"
+	expected := testBencodeInfo{
+		Name:        "dir",
+		PieceLength: 16,
+		Pieces:      []byte("hash"),
+		Private:     true,
+		Files:       []testBencodeFile{{Length: 3, Path: []string{"a", "b"}}},
+		Source:      &source,
+	}
+	if !reflect.DeepEqual(info, expected) {
+		t.Fatalf("unexpected info: %+v instead of %+v", info, expected)
+	}
+
+	encoded, err := Marshal(info)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	var again testBencodeInfo
+	if err := Unmarshal(encoded, &again); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !reflect.DeepEqual(again, expected) {
+		t.Fatalf("unexpected round trip: %+v instead of %+v", again, expected)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		target func() any
+	}{
+		{name: "not a pointer", input: "i1e", target: func() any { return 1 }},
+		{name: "string into int", input: "1:a", target: func() any { return new(int) }},
+		{name: "int into string", input: "i1e", target: func() any { return new(string) }},
+		{name: "overflow", input: "i300e", target: func() any { return new(uint8) }},
+		{name: "beyond int64", input: "i9223372036854775808e", target: func() any { return new(int64) }},
+		{name: "beyond uint64", input: "i18446744073709551616e", target: func() any { return new(uint64) }},
+		{name: "invalid big int", input: "ixe", target: func() any { return new(big.Int) }},
+		{name: "negative into unsigned", input: "i-1e", target: func() any { return new(uint) }},
+		{name: "bool out of range", input: "i2e", target: func() any { return new(bool) }},
+		{name: "list into struct", input: "le", target: func() any { return new(testBencodeFile) }},
+		{name: "wrong field type", input: "d6:lengthi1e4:path3:abce", target: func() any { return new(testBencodeFile) }},
+		{name: "array too short", input: "li1ei2ee", target: func() any { return new([1]int) }},
+		{name: "trailing data", input: "i1ei2e", target: func() any { return new(int) }},
+		{name: "unterminated list", input: "li1e", target: func() any { return new([]int) }},
+		{name: "unterminated dictionary", input: "d1:ai1e", target: func() any { return new(map[string]int) }},
+		{name: "empty", input: "", target: func() any { return new(int) }},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			if err := Unmarshal([]byte(ts.input), ts.target()); err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+}
+
+func TestUnmarshalWideIntegers(t *testing.T) {
+	var v struct {
+		Int64  int64    `bencode:"int64"`
+		Uint64 uint64   `bencode:"uint64"`
+		Big    big.Int  `bencode:"big"`
+		BigPtr *big.Int `bencode:"big ptr"`
+	}
+	input := "d3:bigi-123456789012345678901234567890e7:big ptri42e5:int64i-9223372036854775808e6:uint64i18446744073709551615ee"
+	if err := Unmarshal([]byte(input), &v); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if v.Int64 != -9223372036854775808 || v.Uint64 != 18446744073709551615 {
+		t.Fatalf("unexpected integers: %d %d", v.Int64, v.Uint64)
+	}
+	if v.Big.String() != "-123456789012345678901234567890" || v.BigPtr.String() != "42" {
+		t.Fatalf("unexpected big integers: %s %s", v.Big.String(), v.BigPtr.String())
+	}
+
+	encoded, err := Marshal(v)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if string(encoded) != input {
+		t.Fatalf("unexpected value: %q instead of %q", encoded, input)
+	}
+}
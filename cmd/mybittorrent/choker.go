@@ -0,0 +1,328 @@
+package main
+
+import (
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	rechokeInterval           = 10 * time.Second
+	optimisticUnchokeInterval = 30 * time.Second
+	// number of interested peers unchoked for their rates, the optimistic
+	// unchoke comes on top
+	regularUnchokeSlots = 3
+)
+
+// transferStats counts the payload bytes exchanged with a single peer.
+type transferStats struct {
+	mu         sync.Mutex
+	downloaded int64
+	uploaded   int64
+}
+
+func (s *transferStats) addDownloaded(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.downloaded += int64(n)
+}
+
+func (s *transferStats) addUploaded(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uploaded += int64(n)
+}
+
+func (s *transferStats) totals() (int64, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.downloaded, s.uploaded
+}
+
+type sharedTransferStats struct {
+	stats *transferStats
+	refs  int
+}
+
+// stats of the remote peers by info hash and peer ID, so that our download
+// session to a peer and the connection the peer opened to our seeder count
+// into the same stats, and the choker ranks the peer by what it gives us
+var peerStatsMutex sync.Mutex
+var peerStats = map[string]*sharedTransferStats{}
+
+// acquireTransferStats returns the stats of the peer with the given peer ID
+// for the torrent. Every call has to be paired with releaseTransferStats.
+func acquireTransferStats(infoHash, peerID []byte) *transferStats {
+	peerStatsMutex.Lock()
+	defer peerStatsMutex.Unlock()
+
+	key := string(infoHash) + string(peerID)
+	shared, ok := peerStats[key]
+	if !ok {
+		shared = &sharedTransferStats{stats: &transferStats{}}
+		peerStats[key] = shared
+	}
+	shared.refs++
+	return shared.stats
+}
+
+// releaseTransferStats forgets the stats of the peer once neither a download
+// session nor an incoming connection uses them anymore.
+func releaseTransferStats(infoHash, peerID []byte) {
+	peerStatsMutex.Lock()
+	defer peerStatsMutex.Unlock()
+
+	key := string(infoHash) + string(peerID)
+	if shared, ok := peerStats[key]; ok {
+		shared.refs--
+		if shared.refs <= 0 {
+			delete(peerStats, key)
+		}
+	}
+}
+
+// chokedPeer is a connection whose choke state is decided by a choker. Its
+// fields are guarded by the choker it was added to.
+type chokedPeer struct {
+	stats *transferStats
+	// send writes the CHOKE and UNCHOKE messages to the peer
+	send func(message *peerMessage) error
+	// sendMu keeps the messages to the peer in order, and sentChoked is the
+	// state the peer was told last
+	sendMu     sync.Mutex
+	sentChoked bool
+
+	interested bool
+	choked     bool
+
+	// totals at the previous rechoke and the rates since then, in bytes
+	// per second
+	lastDownloaded int64
+	lastUploaded   int64
+	downloadRate   float64
+	uploadRate     float64
+}
+
+func newChokedPeer(stats *transferStats, send func(message *peerMessage) error) *chokedPeer {
+	return &chokedPeer{stats: stats, send: send, choked: true, sentChoked: true}
+}
+
+// choker implements the choking algorithm of BEP 3. Every rechokeInterval it
+// unchokes the interested peers that give us the best download rates, or
+// that we upload to the fastest once we are seeding, and every
+// optimisticUnchokeInterval it moves the optimistic unchoke to a random
+// other peer so that newcomers get a chance to prove themselves.
+type choker struct {
+	mu             sync.Mutex
+	peers          []*chokedPeer
+	seedMode       bool
+	optimistic     *chokedPeer
+	lastRechoke    time.Time
+	lastOptimistic time.Time
+	now            func() time.Time
+	rand           *rand.Rand
+	stop           chan struct{}
+}
+
+func newChoker() *choker {
+	return &choker{
+		now:  time.Now,
+		rand: rand.New(rand.NewSource(rand.Int63())),
+		stop: make(chan struct{}),
+	}
+}
+
+// setSeedMode switches between ranking peers by how fast they upload to us
+// and, once we have everything, by how fast we upload to them.
+func (c *choker) setSeedMode(seedMode bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seedMode = seedMode
+}
+
+func (c *choker) addPeer(p *chokedPeer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p.lastDownloaded, p.lastUploaded = p.stats.totals()
+	c.peers = append(c.peers, p)
+}
+
+func (c *choker) removePeer(p *chokedPeer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.peers = slices.DeleteFunc(c.peers, func(other *chokedPeer) bool { return other == p })
+	if c.optimistic == p {
+		c.optimistic = nil
+	}
+}
+
+func (c *choker) isChoked(p *chokedPeer) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return p.choked
+}
+
+// setInterested records the interest of the peer. A newly interested peer is
+// unchoked right away while not all upload slots are taken, instead of
+// waiting for the next rechoke.
+func (c *choker) setInterested(p *chokedPeer, interested bool) {
+	var changed []*chokedPeer
+	// deferred calls run last in first out, so the messages go out after
+	// the lock is released
+	defer func() { c.notify(changed) }()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p.interested = interested
+	if !interested || !p.choked {
+		return
+	}
+
+	unchoked := 0
+	for _, other := range c.peers {
+		if other.interested && !other.choked {
+			unchoked++
+		}
+	}
+	if unchoked < regularUnchokeSlots+1 {
+		changed = c.setChoked(p, false, changed)
+	}
+}
+
+// rechoke recalculates the rates of all peers and decides which of them are
+// unchoked until the next rechoke.
+func (c *choker) rechoke() {
+	var changed []*chokedPeer
+	defer func() { c.notify(changed) }()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	elapsed := now.Sub(c.lastRechoke).Seconds()
+	for _, p := range c.peers {
+		downloaded, uploaded := p.stats.totals()
+		if !c.lastRechoke.IsZero() && elapsed > 0 {
+			p.downloadRate = float64(downloaded-p.lastDownloaded) / elapsed
+			p.uploadRate = float64(uploaded-p.lastUploaded) / elapsed
+		}
+		p.lastDownloaded, p.lastUploaded = downloaded, uploaded
+	}
+	c.lastRechoke = now
+
+	previous := c.optimistic
+	if c.optimistic != nil && now.Sub(c.lastOptimistic) >= optimisticUnchokeInterval {
+		c.optimistic = nil
+	}
+
+	ranked := slices.Clone(c.peers)
+	slices.SortStableFunc(ranked, func(a, b *chokedPeer) int {
+		if c.rate(a) > c.rate(b) {
+			return -1
+		}
+		if c.rate(a) < c.rate(b) {
+			return 1
+		}
+		return 0
+	})
+
+	// peers that are not interested but rank above the slowest downloader
+	// are unchoked as well, so that they can start downloading at once
+	// when they become interested
+	unchoke := make(map[*chokedPeer]bool)
+	downloaders := 0
+	for _, p := range ranked {
+		if downloaders >= regularUnchokeSlots {
+			break
+		}
+		if p == c.optimistic {
+			continue
+		}
+		unchoke[p] = true
+		if p.interested {
+			downloaders++
+		}
+	}
+
+	if c.optimistic == nil {
+		// rotate to another peer whenever there is one
+		candidates := []*chokedPeer{}
+		for _, p := range c.peers {
+			if p.interested && !unchoke[p] && p != previous {
+				candidates = append(candidates, p)
+			}
+		}
+		if len(candidates) == 0 && previous != nil && previous.interested && !unchoke[previous] {
+			candidates = append(candidates, previous)
+		}
+		if len(candidates) > 0 {
+			c.optimistic = candidates[c.rand.Intn(len(candidates))]
+			c.lastOptimistic = now
+		}
+	}
+	if c.optimistic != nil {
+		unchoke[c.optimistic] = true
+	}
+
+	for _, p := range c.peers {
+		changed = c.setChoked(p, !unchoke[p], changed)
+	}
+}
+
+func (c *choker) rate(p *chokedPeer) float64 {
+	if c.seedMode {
+		return p.uploadRate
+	}
+	return p.downloadRate
+}
+
+// setChoked changes the choke state of the peer and adds it to changed when
+// the peer has to be told. The caller holds c.mu.
+func (c *choker) setChoked(p *chokedPeer, choked bool, changed []*chokedPeer) []*chokedPeer {
+	if p.choked == choked {
+		return changed
+	}
+	p.choked = choked
+	return append(changed, p)
+}
+
+// notify sends the current choke state to the peers whose state changed. It
+// runs without c.mu held, so that a peer that stops reading from its socket
+// only holds up the messages to itself, not the choker and every other peer.
+func (c *choker) notify(changed []*chokedPeer) {
+	for _, p := range changed {
+		p.sendMu.Lock()
+		c.mu.Lock()
+		choked := p.choked
+		c.mu.Unlock()
+		if choked != p.sentChoked {
+			p.sentChoked = choked
+			id := messageUnchoke
+			if choked {
+				id = messageChoke
+			}
+			// a failed write surfaces on the connection itself
+			p.send(&peerMessage{id: id})
+		}
+		p.sendMu.Unlock()
+	}
+}
+
+// start rechokes every rechokeInterval until the choker is closed.
+func (c *choker) start() {
+	go func() {
+		ticker := time.NewTicker(rechokeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.rechoke()
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (c *choker) close() {
+	close(c.stop)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	current time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.current
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.current = c.current.Add(d)
+}
+
+// newTestChoker returns a choker driven by a fake clock with interested peers
+// that have already been seen by one rechoke.
+func newTestChoker(numPeers int) (*choker, *fakeClock, []*chokedPeer) {
+	clock := &fakeClock{current: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := newChoker()
+	c.now = clock.now
+
+	peers := []*chokedPeer{}
+	for i := 0; i < numPeers; i++ {
+		p := newChokedPeer(&transferStats{}, func(message *peerMessage) error { return nil })
+		c.addPeer(p)
+		p.interested = true
+		peers = append(peers, p)
+	}
+	c.rechoke()
+	return c, clock, peers
+}
+
+func unchokedPeers(c *choker, peers []*chokedPeer) map[int]bool {
+	unchoked := map[int]bool{}
+	for i, p := range peers {
+		if !c.isChoked(p) {
+			unchoked[i] = true
+		}
+	}
+	return unchoked
+}
+
+func TestChokerRotatesOptimisticUnchoke(t *testing.T) {
+	// without any rates yet the first peers are unchoked in the order they
+	// connected
+	c, clock, peers := newTestChoker(5)
+	optimistic := c.optimistic
+	if optimistic != peers[3] && optimistic != peers[4] {
+		t.Fatalf("expected one of the last peers to be unchoked optimistically")
+	}
+
+	// the top peers keep their rates, the optimistic unchoke stays for 30
+	// seconds and then moves on to the other slow peer
+	for _, elapsed := range []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second} {
+		for i, p := range peers[:3] {
+			p.stats.addDownloaded(1000 * (i + 1))
+		}
+		clock.advance(rechokeInterval)
+		c.rechoke()
+
+		if elapsed < optimisticUnchokeInterval && c.optimistic != optimistic {
+			t.Fatalf("optimistic unchoke rotated after %s", elapsed)
+		}
+		if elapsed >= optimisticUnchokeInterval && c.optimistic == optimistic {
+			t.Fatalf("optimistic unchoke did not rotate after %s", elapsed)
+		}
+		if c.isChoked(c.optimistic) {
+			t.Fatalf("optimistic peer is choked")
+		}
+	}
+	if !c.isChoked(optimistic) {
+		t.Fatalf("expected the previous optimistic peer to be choked again")
+	}
+}
+
+func TestChokerUnchokesUninterestedPeersAboveDownloaders(t *testing.T) {
+	c, clock, peers := newTestChoker(6)
+	peers[0].interested = false
+	for i, p := range peers {
+		p.stats.addDownloaded(1000 * (len(peers) - i))
+	}
+	clock.advance(rechokeInterval)
+	c.rechoke()
+
+	// peer 0 is the fastest but not interested, so peers 1 to 3 are the
+	// downloaders and one of 4 and 5 the optimistic unchoke
+	unchoked := unchokedPeers(c, peers)
+	for _, i := range []int{0, 1, 2, 3} {
+		if !unchoked[i] {
+			t.Fatalf("expected peer %d to be unchoked: %v", i, unchoked)
+		}
+	}
+	if len(unchoked) != regularUnchokeSlots+2 {
+		t.Fatalf("unexpected unchoked peers: %v", unchoked)
+	}
+}
+
+func TestChokerUnchokesInterestedPeersWhileSlotsAreFree(t *testing.T) {
+	c := newChoker()
+	sent := []int{}
+	peers := []*chokedPeer{}
+	for i := 0; i < regularUnchokeSlots+2; i++ {
+		p := newChokedPeer(&transferStats{}, func(message *peerMessage) error {
+			sent = append(sent, message.id)
+			return nil
+		})
+		c.addPeer(p)
+		peers = append(peers, p)
+	}
+
+	for _, p := range peers {
+		c.setInterested(p, true)
+	}
+
+	unchoked := unchokedPeers(c, peers)
+	if len(unchoked) != regularUnchokeSlots+1 || len(sent) != regularUnchokeSlots+1 {
+		t.Fatalf("unexpected unchoked peers: %v", unchoked)
+	}
+	for _, id := range sent {
+		if id != messageUnchoke {
+			t.Fatalf("unexpected message sent: %d", id)
+		}
+	}
+}
+
+func TestChokerDoesNotWaitForStuckPeers(t *testing.T) {
+	c := newChoker()
+
+	// a peer that stopped reading from its socket
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	stuck := newChokedPeer(&transferStats{}, func(message *peerMessage) error {
+		close(entered)
+		<-unblock
+		return nil
+	})
+	c.addPeer(stuck)
+	stuck.interested = true
+	go c.rechoke()
+	<-entered
+	defer close(unblock)
+
+	sent := make(chan int, 1)
+	other := newChokedPeer(&transferStats{}, func(message *peerMessage) error {
+		sent <- message.id
+		return nil
+	})
+	c.addPeer(other)
+	go c.setInterested(other, true)
+
+	select {
+	case id := <-sent:
+		if id != messageUnchoke {
+			t.Fatalf("unexpected message: %d", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("choker was blocked by a peer that does not read")
+	}
+	if c.isChoked(other) {
+		t.Fatalf("expected the other peer to be unchoked")
+	}
+}
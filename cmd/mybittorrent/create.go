@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	minAutoPieceLength = 16 * 1024
+	maxAutoPieceLength = 16 * 1024 * 1024
+	// number of pieces the automatic piece length aims to stay below
+	targetPieceCount = 1500
+)
+
+// stringList collects the values of a flag that may be given several times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+type createOptions struct {
+	output string
+	// announce tiers, the first URL is also used as the announce key
+	tiers       [][]string
+	pieceLength int
+	comment     string
+	createdBy   string
+	private     bool
+	webSeeds    []string
+	// creationDate is left out of the torrent when zero
+	creationDate int64
+}
+
+// parseCreateArgs parses the arguments of the create command, which takes the
+// path to share followed or preceded by its options.
+func parseCreateArgs(args []string) (string, createOptions, error) {
+	flags := flag.NewFlagSet("create", flag.ContinueOnError)
+	output := flags.String("o", "", "write the torrent to this file")
+	var announce stringList
+	flags.Var(&announce, "a", "announce tier, comma separated tracker URLs (may be repeated)")
+	pieceLength := flags.Int("l", 0, "piece length in bytes, chosen from the total size when 0")
+	comment := flags.String("c", "", "comment")
+	createdBy := flags.String("created-by", "mybittorrent", "created by")
+	private := flags.Bool("private", false, "set the private flag")
+	var webSeeds stringList
+	flags.Var(&webSeeds, "w", "web seed URL (may be repeated)")
+
+	path := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		path, args = args[0], args[1:]
+	}
+	if err := flags.Parse(args); err != nil {
+		return "", createOptions{}, err
+	}
+	if path == "" && flags.NArg() > 0 {
+		path = flags.Arg(0)
+	}
+	if path == "" || *output == "" {
+		return "", createOptions{}, fmt.Errorf("usage: create <path> -o <out.torrent> [options]")
+	}
+	if *pieceLength < 0 || (*pieceLength > 0 && *pieceLength%minAutoPieceLength != 0) {
+		return "", createOptions{}, fmt.Errorf("piece length must be a multiple of %d", minAutoPieceLength)
+	}
+
+	options := createOptions{
+		output:       *output,
+		pieceLength:  *pieceLength,
+		comment:      *comment,
+		createdBy:    *createdBy,
+		private:      *private,
+		webSeeds:     webSeeds,
+		creationDate: time.Now().Unix(),
+	}
+	for _, tier := range announce {
+		urls := []string{}
+		for _, u := range strings.Split(tier, ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				urls = append(urls, u)
+			}
+		}
+		if len(urls) > 0 {
+			options.tiers = append(options.tiers, urls)
+		}
+	}
+	return path, options, nil
+}
+
+// autoPieceLength picks the smallest power of two piece length that keeps
+// the number of pieces below targetPieceCount, within sane bounds.
+func autoPieceLength(totalLength int64) int {
+	pieceLength := minAutoPieceLength
+	for pieceLength < maxAutoPieceLength && totalLength/int64(pieceLength) >= targetPieceCount {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// collectFiles returns the regular files to share in a stable order. A
+// single file is shared as a single-file torrent.
+func collectFiles(root string) ([]torrentFile, bool, error) {
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to stat %s: %s", root, err.Error())
+	}
+	if !stat.IsDir() {
+		return []torrentFile{{path: []string{filepath.Base(root)}, length: stat.Size()}}, false, nil
+	}
+
+	files := []torrentFile{}
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, torrentFile{path: strings.Split(filepath.ToSlash(rel), "/"), length: info.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to walk %s: %s", root, err.Error())
+	}
+	if len(files) == 0 {
+		return nil, false, fmt.Errorf("no files found in %s", root)
+	}
+	return files, true, nil
+}
+
+// createTorrent builds the metainfo dictionary for the file or directory at
+// root, hashing its pieces in parallel.
+func createTorrent(root string, options createOptions) (map[string]any, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %s", root, err.Error())
+	}
+	files, multiFile, err := collectFiles(root)
+	if err != nil {
+		return nil, err
+	}
+
+	totalLength := int64(0)
+	for _, f := range files {
+		totalLength += f.length
+	}
+	if totalLength == 0 {
+		return nil, fmt.Errorf("cannot create a torrent without any data")
+	}
+	pieceLength := options.pieceLength
+	if pieceLength == 0 {
+		pieceLength = autoPieceLength(totalLength)
+	}
+
+	name := filepath.Base(root)
+	paths, err := filePaths(filepath.Dir(root), name, files, multiFile)
+	if err != nil {
+		return nil, err
+	}
+	if !multiFile {
+		paths = []string{root}
+	}
+
+	verifyFiles := []verifyFile{}
+	offset := int64(0)
+	for i, tf := range files {
+		f, err := os.Open(paths[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %s", paths[i], err.Error())
+		}
+		defer f.Close()
+		verifyFiles = append(verifyFiles, verifyFile{path: paths[i], offset: offset, length: tf.length, f: f, size: tf.length})
+		offset += tf.length
+	}
+
+	numPieces := int((totalLength + int64(pieceLength) - 1) / int64(pieceLength))
+	hashes := make([][]byte, numPieces)
+	err = forEachPiece(numPieces, func(pieceIndex int) error {
+		length := getPieceLengthForIndex(totalLength, pieceLength, pieceIndex)
+		piece, err := readPieceFromFiles(verifyFiles, int64(pieceIndex)*int64(pieceLength), length)
+		if err != nil {
+			return err
+		}
+		if piece == nil {
+			return fmt.Errorf("files changed while hashing piece %d", pieceIndex)
+		}
+		hash := sha1.Sum(piece)
+		hashes[pieceIndex] = hash[:]
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pieces := []byte{}
+	for _, hash := range hashes {
+		pieces = append(pieces, hash...)
+	}
+
+	info := map[string]any{
+		"name":         name,
+		"piece length": pieceLength,
+		"pieces":       string(pieces),
+	}
+	if multiFile {
+		fileList := []any{}
+		for _, f := range files {
+			path := []any{}
+			for _, part := range f.path {
+				path = append(path, part)
+			}
+			fileList = append(fileList, map[string]any{"length": f.length, "path": path})
+		}
+		info["files"] = fileList
+	} else {
+		info["length"] = totalLength
+	}
+	if options.private {
+		info["private"] = 1
+	}
+
+	torrent := map[string]any{"info": info}
+	if len(options.tiers) > 0 {
+		torrent["announce"] = options.tiers[0][0]
+	}
+	if len(options.tiers) > 1 || (len(options.tiers) == 1 && len(options.tiers[0]) > 1) {
+		announceList := []any{}
+		for _, tier := range options.tiers {
+			urls := []any{}
+			for _, u := range tier {
+				urls = append(urls, u)
+			}
+			announceList = append(announceList, urls)
+		}
+		torrent["announce-list"] = announceList
+	}
+	if options.comment != "" {
+		torrent["comment"] = options.comment
+	}
+	if options.createdBy != "" {
+		torrent["created by"] = options.createdBy
+	}
+	if options.creationDate != 0 {
+		torrent["creation date"] = options.creationDate
+	}
+	if len(options.webSeeds) > 0 {
+		urlList := []any{}
+		for _, u := range options.webSeeds {
+			urlList = append(urlList, u)
+		}
+		torrent["url-list"] = urlList
+	}
+	return torrent, nil
+}
+
+// magnetLink builds a magnet link with the info hash, name and trackers of
+// the torrent.
+func magnetLink(infoHash []byte, name string, tiers [][]string) string {
+	link := "magnet:?xt=urn:btih:" + hex.EncodeToString(infoHash) + "&dn=" + url.QueryEscape(name)
+	for _, tier := range tiers {
+		for _, u := range tier {
+			link += "&tr=" + url.QueryEscape(u)
+		}
+	}
+	return link
+}
+
+func create(args []string) ([]string, error) {
+	root, options, err := parseCreateArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	torrent, err := createTorrent(root, options)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, err := encodeBencode(torrent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode torrent: %s", err.Error())
+	}
+	if err := os.WriteFile(options.output, encoded, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write torrent: %s", err.Error())
+	}
+
+	info := torrent["info"].(map[string]any)
+	infoHash, err := getInfoHash(info)
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{
+		fmt.Sprintf("Info Hash: %s", hex.EncodeToString(infoHash)),
+		fmt.Sprintf("Magnet: %s", magnetLink(infoHash, info["name"].(string), options.tiers)),
+	}, nil
+}
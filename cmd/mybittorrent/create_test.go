@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAutoPieceLength(t *testing.T) {
+	tests := []struct {
+		totalLength int64
+		expected    int
+	}{
+		{totalLength: 1, expected: 16 * 1024},
+		{totalLength: 1500*16*1024 - 1, expected: 16 * 1024},
+		{totalLength: 1500 * 16 * 1024, expected: 32 * 1024},
+		{totalLength: 4 << 30, expected: 4 << 20},
+		{totalLength: 1 << 40, expected: 16 << 20},
+	}
+
+	for _, ts := range tests {
+		if actual := autoPieceLength(ts.totalLength); actual != ts.expected {
+			t.Fatalf("unexpected piece length for %d bytes: %d instead of %d", ts.totalLength, actual, ts.expected)
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	dir := t.TempDir()
+	share := filepath.Join(dir, "share")
+	if err := os.MkdirAll(filepath.Join(share, "sub"), 0755); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	data, _ := makeTestTorrentData(40000, sixteenKilobytes)
+	if err := os.WriteFile(filepath.Join(share, "a.bin"), data[:30000], 0644); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(share, "sub", "b.bin"), data[30000:], 0644); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	tests := []struct {
+		name          string
+		path          string
+		args          []string
+		expectedFiles int
+		// where verify finds the data, the parent of a shared directory
+		dataPath string
+	}{
+		{
+			name:          "directory",
+			path:          share,
+			args:          []string{"-a", "http://t1/announce,http://t2/announce", "-a", "udp://t3:80", "-c", "hello", "-private", "-w", "http://seed/"},
+			expectedFiles: 2,
+			dataPath:      dir,
+		},
+		{
+			name:          "single file",
+			path:          filepath.Join(share, "a.bin"),
+			args:          []string{"-l", "32768"},
+			expectedFiles: 1,
+			dataPath:      filepath.Join(share, "a.bin"),
+		},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "out.torrent")
+			lines, err := create(append([]string{ts.path, "-o", output}, ts.args...))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			contents, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			decoded, _, err := decodeBencode(contents)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			dict := decoded.(map[string]any)
+			info := dict["info"].(map[string]any)
+			files, _, _, err := parseFiles(info)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if len(files) != ts.expectedFiles {
+				t.Fatalf("unexpected number of files: %d", len(files))
+			}
+
+			infoHash, err := getInfoHash(info)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			magnet, err := parseMagnetLink(lines[1][len("Magnet: "):])
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if magnet.infoHash != hex.EncodeToString(infoHash) || magnet.fileName != info["name"] {
+				t.Fatalf("unexpected magnet link: %s", lines[1])
+			}
+
+			// the new torrent must match the data it was created from
+			_, ok, err := verify(output, ts.dataPath, false)
+			if err != nil || !ok {
+				t.Fatalf("expected the data to verify: %v, %v", ok, err)
+			}
+		})
+	}
+}
+
+func TestCreateWritesOptionalKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, []byte("hello world"), 0644); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	_, options, err := parseCreateArgs([]string{path, "-o", "out.torrent", "-a", "http://t1/announce,http://t2/announce", "-a", "udp://t3:80", "-c", "hello", "-created-by", "me", "-private", "-w", "http://seed/"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	options.creationDate = 0
+	torrent, err := createTorrent(path, options)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	expected := map[string]any{
+		"announce": "http://t1/announce",
+		"announce-list": []any{
+			[]any{"http://t1/announce", "http://t2/announce"},
+			[]any{"udp://t3:80"},
+		},
+		"comment":    "hello",
+		"created by": "me",
+		"url-list":   []any{"http://seed/"},
+	}
+	for key, value := range expected {
+		if !reflect.DeepEqual(torrent[key], value) {
+			t.Fatalf("unexpected %s: %v instead of %v", key, torrent[key], value)
+		}
+	}
+	if _, ok := torrent["creation date"]; ok {
+		t.Fatalf("unexpected creation date")
+	}
+	info := torrent["info"].(map[string]any)
+	if info["private"] != 1 || info["length"] != int64(11) || info["name"] != "file" {
+		t.Fatalf("unexpected info dictionary: %v", info)
+	}
+}
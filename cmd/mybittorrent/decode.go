@@ -1,113 +1,216 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/big"
 	"strconv"
-	"strings"
-	"unicode"
 	// bencode "github.com/jackpal/bencode-go" // Available if you need it!
 )
 
 // Ensures gofmt doesn't remove the "os" encoding/json import (feel free to remove this!)
 var _ = json.Marshal
 
+// SyntaxError describes malformed bencode and the byte offset it was found
+// at. Peers and trackers send us bencode, so none of it is trusted.
+type SyntaxError struct {
+	Offset int64
+	msg    string
+}
+
+func newSyntaxError(offset int64, format string, args ...any) *SyntaxError {
+	return &SyntaxError{Offset: offset, msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s at offset %d", e.msg, e.Offset)
+}
+
 // Example:
 // - 5:hello -> hello
 // - 10:hello12345 -> hello12345
 func decodeBencode(bencodedString []byte) (any, int, error) {
-	firstRune := rune(bencodedString[0])
-	if unicode.IsDigit(firstRune) {
-		return decodeString(bencodedString)
-	} else if firstRune == 'i' {
-		return decodeInteger(bencodedString)
-	} else if firstRune == 'l' {
-		return decodeList(bencodedString)
-	} else if firstRune == 'd' {
-		return decodeDictionary(bencodedString)
-	} else {
-		return "", -1, fmt.Errorf("unhandled type: '%s'", bencodedString)
+	return decodeValue(bencodedString, 0, 0, false)
+}
+
+// decodeBencodeBig is decodeBencode for input that may hold integers beyond
+// 64 bits, which the spec allows. They are returned as *big.Int instead of
+// failing.
+func decodeBencodeBig(bencodedString []byte) (any, int, error) {
+	return decodeValue(bencodedString, 0, 0, true)
+}
+
+// decodeValue decodes the value starting at pos and returns the position
+// right after it. depth is the number of lists and dictionaries it is in.
+func decodeValue(data []byte, pos, depth int, bigInts bool) (any, int, error) {
+	if pos >= len(data) {
+		return nil, pos, newSyntaxError(int64(pos), "unexpected end of data")
+	}
+
+	switch c := data[pos]; {
+	case c >= '0' && c <= '9':
+		return decodeString(data, pos)
+	case c == 'i':
+		return decodeInteger(data, pos, bigInts)
+	case c == 'l':
+		return decodeList(data, pos, depth+1, bigInts)
+	case c == 'd':
+		result, _, end, err := decodeDictionary(data, pos, depth+1, bigInts, false)
+		return result, end, err
+	default:
+		return nil, pos, newSyntaxError(int64(pos), "unexpected character %q", c)
 	}
 }
 
-func decodeString(bencodedString []byte) (string, int, error) {
-	var firstColonIndex int
+func decodeString(data []byte, pos int) (string, int, error) {
+	colon := bytes.IndexByte(data[pos:], ':')
+	if colon < 0 {
+		return "", pos, newSyntaxError(int64(pos), "string length is not terminated")
+	}
+	colon += pos
 
-	for i := 0; i < len(bencodedString); i++ {
-		if bencodedString[i] == ':' {
-			firstColonIndex = i
+	length := 0
+	for i := pos; i < colon; i++ {
+		if data[i] < '0' || data[i] > '9' {
+			return "", pos, newSyntaxError(int64(i), "invalid character %q in string length", data[i])
+		}
+		length = length*10 + int(data[i]-'0')
+		if length > len(data) {
 			break
 		}
 	}
 
-	lengthStr := string(bencodedString[:firstColonIndex])
+	if remaining := len(data) - colon - 1; length > remaining {
+		return "", pos, newSyntaxError(int64(pos), "string length %s exceeds the remaining %d bytes", data[pos:colon], remaining)
+	}
+	end := colon + 1 + length
+	return string(data[colon+1 : end]), end, nil
+}
 
-	length, err := strconv.Atoi(lengthStr)
+// decodeInteger returns integers that fit into an int as int and other
+// 64-bit integers as int64. Larger integers are returned as *big.Int when
+// bigInts is set and are an error otherwise.
+func decodeInteger(data []byte, pos int, bigInts bool) (any, int, error) {
+	intPart, end, err := integerDigits(data, pos)
 	if err != nil {
-		return "", -1, err
+		return nil, end, err
+	}
+
+	v, err := strconv.ParseInt(intPart, 10, 64)
+	if err == nil {
+		if int64(int(v)) == v {
+			return int(v), end, nil
+		}
+		return v, end, nil
+	}
+	if errors.Is(err, strconv.ErrRange) {
+		if n, ok := new(big.Int).SetString(intPart, 10); ok && bigInts {
+			return n, end, nil
+		}
+		return nil, pos, newSyntaxError(int64(pos), "integer %s does not fit into 64 bits", intPart)
 	}
+	return nil, pos, newSyntaxError(int64(pos), "invalid integer %q", intPart)
+}
 
-	return string(bencodedString[firstColonIndex+1 : firstColonIndex+1+length]), firstColonIndex + 1 + length, nil
+// integerValue returns a decoded integer, which is an int or, when it does
+// not fit into one, an int64. Lengths in torrents have to be read through it,
+// since they can exceed an int on 32-bit platforms.
+func integerValue(v any) (int64, bool) {
+	switch i := v.(type) {
+	case int:
+		return int64(i), true
+	case int64:
+		return i, true
+	default:
+		return 0, false
+	}
 }
 
-func decodeInteger(bencodedString []byte) (int, int, error) {
-	endIndex := strings.Index(string(bencodedString), "e")
-	intPart := string(bencodedString[1:endIndex])
-	v, err := strconv.Atoi(intPart)
-	return v, endIndex + 1, err
+// integerDigits returns the digits of the integer at pos and the position
+// right after it.
+func integerDigits(data []byte, pos int) (string, int, error) {
+	endIndex := bytes.IndexByte(data[pos:], 'e')
+	if endIndex < 0 {
+		return "", pos, newSyntaxError(int64(pos), "integer is not terminated")
+	}
+	endIndex += pos
+	return string(data[pos+1 : endIndex]), endIndex + 1, nil
 }
 
-func decodeList(bencodedString []byte) (any, int, error) {
+func decodeList(data []byte, pos, depth int, bigInts bool) (any, int, error) {
+	if depth > defaultMaxDepth {
+		return nil, pos, newSyntaxError(int64(pos), "nesting deeper than %d", defaultMaxDepth)
+	}
+
 	result := []any{}
-	curIndex := 1 // skip initial 'l'
-	for curIndex < len(bencodedString) && rune(bencodedString[curIndex]) != 'e' {
-		curr := bencodedString[curIndex:]
-		item, newIndex, err := decodeBencode(curr)
+	curIndex := pos + 1 // skip initial 'l'
+	for {
+		if curIndex >= len(data) {
+			return nil, curIndex, newSyntaxError(int64(curIndex), "reached end of the data before finding the end of the list")
+		}
+		if data[curIndex] == 'e' {
+			return result, curIndex + 1, nil
+		}
+
+		item, newIndex, err := decodeValue(data, curIndex, depth, bigInts)
 		if err != nil {
 			return nil, newIndex, err
 		}
-		curIndex += newIndex
+		curIndex = newIndex
 		result = append(result, item)
-
-		if curIndex >= len(bencodedString) {
-			return nil, newIndex, errors.New("reached end of the string before finding the end of the list")
-		}
 	}
+}
 
-	return result, curIndex + 1, nil
+// decodeDictionaryWithSpans decodes a dictionary and also returns the exact
+// bytes every value was decoded from, so that values can be hashed as they
+// were sent instead of as we would encode them. With bigInts set, integers
+// beyond an int64 are returned as *big.Int instead of being rejected.
+func decodeDictionaryWithSpans(bencodedString []byte, bigInts bool) (map[string]any, map[string][]byte, int, error) {
+	if len(bencodedString) == 0 || bencodedString[0] != 'd' {
+		return nil, nil, 0, newSyntaxError(0, "expected a dictionary")
+	}
+	return decodeDictionary(bencodedString, 0, 1, bigInts, true)
 }
 
-func decodeDictionary(bencodedString []byte) (any, int, error) {
+func decodeDictionary(data []byte, pos, depth int, bigInts, withSpans bool) (map[string]any, map[string][]byte, int, error) {
+	if depth > defaultMaxDepth {
+		return nil, nil, pos, newSyntaxError(int64(pos), "nesting deeper than %d", defaultMaxDepth)
+	}
+
 	result := map[string]any{}
-	curIndex := 1
-	for curIndex < len(bencodedString) && rune(bencodedString[curIndex]) != 'e' {
-		var key any
-		var value any
-		var newIndex int
-		var err error
-
-		rawKey := bencodedString[curIndex:]
-		firstRune := rune(rawKey[0])
-		if !unicode.IsDigit(firstRune) {
-			return nil, curIndex, fmt.Errorf("key in dictionary has to be a string: %v", string(rawKey))
+	var spans map[string][]byte
+	if withSpans {
+		spans = map[string][]byte{}
+	}
+	curIndex := pos + 1 // skip initial 'd'
+	for {
+		if curIndex >= len(data) {
+			return nil, nil, curIndex, newSyntaxError(int64(curIndex), "reached end of the data before finding the end of the dictionary")
+		}
+		if data[curIndex] == 'e' {
+			return result, spans, curIndex + 1, nil
 		}
 
-		key, newIndex, err = decodeBencode(rawKey)
+		if data[curIndex] < '0' || data[curIndex] > '9' {
+			return nil, nil, curIndex, newSyntaxError(int64(curIndex), "key in dictionary has to be a string")
+		}
+		key, newIndex, err := decodeString(data, curIndex)
 		if err != nil {
-			return nil, newIndex, err
+			return nil, nil, newIndex, err
 		}
 
-		curIndex += newIndex
-		rawValue := bencodedString[curIndex:]
-		value, newIndex, err = decodeBencode(rawValue)
+		curIndex = newIndex
+		value, newIndex, err := decodeValue(data, curIndex, depth, bigInts)
 		if err != nil {
-			return nil, newIndex, err
+			return nil, nil, newIndex, err
 		}
 
-		curIndex += newIndex
-		result[key.(string)] = value
+		result[key] = value
+		if withSpans {
+			spans[key] = data[curIndex:newIndex]
+		}
+		curIndex = newIndex
 	}
-
-	return result, curIndex + 1, nil
 }
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"math/big"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -30,6 +35,12 @@ func TestDecodeBencode(t *testing.T) {
 			expected:      "-52",
 			expectedIndex: 5,
 		},
+		{
+			name:          "int64",
+			input:         "i-9223372036854775808e",
+			expected:      "-9223372036854775808",
+			expectedIndex: 22,
+		},
 		{
 			name:          "list",
 			input:         "l5:helloi52ee",
@@ -64,3 +75,130 @@ func TestDecodeBencode(t *testing.T) {
 		})
 	}
 }
+
+func TestDecodeBencodeErrors(t *testing.T) {
+	tests := []struct {
+		name           string
+		input          string
+		expectedOffset int64
+	}{
+		{name: "empty", input: "", expectedOffset: 0},
+		{name: "string longer than the data", input: "5:abc", expectedOffset: 0},
+		{name: "huge string length", input: "99999999999999999999999:a", expectedOffset: 0},
+		{name: "string length without colon", input: "3abc", expectedOffset: 0},
+		{name: "invalid string length", input: "1-:a", expectedOffset: 1},
+		{name: "negative string length", input: "-1:a", expectedOffset: 0},
+		{name: "unterminated integer", input: "i12", expectedOffset: 0},
+		{name: "invalid integer", input: "ixe", expectedOffset: 0},
+		{name: "integer beyond 64 bits", input: "li1ei9223372036854775808ee", expectedOffset: 4},
+		{name: "empty list", input: "l", expectedOffset: 1},
+		{name: "unterminated list", input: "li1e", expectedOffset: 4},
+		{name: "truncated list element", input: "li1e3:ab", expectedOffset: 4},
+		{name: "dictionary without value", input: "d1:a", expectedOffset: 4},
+		{name: "dictionary with integer key", input: "di1ei2ee", expectedOffset: 1},
+		{name: "deep nesting", input: strings.Repeat("l", 100000), expectedOffset: defaultMaxDepth},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			_, _, err := decodeBencode([]byte(ts.input))
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if syntaxErr.Offset != ts.expectedOffset {
+				t.Fatalf("unexpected offset: %d instead of %d (%s)", syntaxErr.Offset, ts.expectedOffset, err.Error())
+			}
+		})
+	}
+}
+
+var bencodeFuzzSeeds = []string{
+	"5:hello", "i52e", "i-52e", "l5:helloi52ee", "d3:foo3:bar5:helloi52ee",
+	"d4:infod6:lengthi5e4:name1:ae5:peers6:abcdefe", "lli1eelee", "0:", "i03e", "d1:bi1e1:ai2ee",
+}
+
+// FuzzDecodeBencode makes sure malformed input is reported as a
+// SyntaxError instead of crashing the process.
+func FuzzDecodeBencode(f *testing.F) {
+	for _, seed := range bencodeFuzzSeeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, n, err := decodeBencode(data)
+		if err != nil {
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("unexpected error type: %T", err)
+			}
+			if syntaxErr.Offset < 0 || syntaxErr.Offset > int64(len(data)) {
+				t.Fatalf("unexpected offset %d for %d bytes", syntaxErr.Offset, len(data))
+			}
+			return
+		}
+		if n <= 0 || n > len(data) {
+			t.Fatalf("unexpected index %d for %d bytes", n, len(data))
+		}
+	})
+}
+
+// FuzzBencodeRoundTrip checks that everything we decode encodes to a value
+// that decodes to the same thing, and that canonical input is encoded back
+// byte for byte.
+func FuzzBencodeRoundTrip(f *testing.F) {
+	for _, seed := range bencodeFuzzSeeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoded, n, err := decodeBencode(data)
+		if err != nil {
+			return
+		}
+
+		encoded, err := encodeBencode(decoded)
+		if err != nil {
+			t.Fatalf("unexpected error encoding %#v: %s", decoded, err.Error())
+		}
+		again, m, err := decodeBencode(encoded)
+		if err != nil {
+			t.Fatalf("unexpected error decoding %q: %s", encoded, err.Error())
+		}
+		if m != len(encoded) || !reflect.DeepEqual(again, decoded) {
+			t.Fatalf("unexpected round trip: %#v instead of %#v", again, decoded)
+		}
+
+		if _, err := decodeStrict(data[:n]); err == nil && !bytes.Equal(encoded, data[:n]) {
+			t.Fatalf("canonical input %q was encoded as %q", data[:n], encoded)
+		}
+	})
+}
+
+func TestDecodeBencodeBig(t *testing.T) {
+	input := "li1ei-123456789012345678901234567890ee"
+	decoded, _, err := decodeBencodeBig([]byte(input))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	list := decoded.([]any)
+	if _, ok := list[0].(int); !ok {
+		t.Fatalf("unexpected type: %T instead of int", list[0])
+	}
+	if i, ok := list[1].(*big.Int); !ok || i.String() != "-123456789012345678901234567890" {
+		t.Fatalf("unexpected value: %v", list[1])
+	}
+
+	actualJSON, err := bencodeToJSON(decoded, binaryHex)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if string(actualJSON) != "[1,-123456789012345678901234567890]" {
+		t.Fatalf("unexpected JSON: %s", actualJSON)
+	}
+	encoded, err := jsonToBencode(actualJSON)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if string(encoded) != input {
+		t.Fatalf("unexpected bencode: %q instead of %q", encoded, input)
+	}
+}
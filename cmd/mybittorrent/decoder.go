@@ -0,0 +1,541 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+const (
+	defaultMaxDepth        = 64
+	defaultMaxStringLength = 64 * 1024 * 1024
+	// longest integer that fits into 64 bits, including the sign
+	maxIntegerDigits = 20
+)
+
+// Token is a single bencode token: a string, an int, an int64 or a Delim.
+type Token any
+
+// Delim is the start of a list ('l') or dictionary ('d'), or the end of
+// either ('e').
+type Delim byte
+
+func (d Delim) String() string {
+	return string(d)
+}
+
+// Decoder reads bencode values from a stream, without reading more of it
+// than the values it is asked for need. Nesting depth, string lengths and,
+// optionally, the length of the whole stream are limited, so that a peer
+// cannot make us allocate unbounded memory.
+type Decoder struct {
+	r               *bufio.Reader
+	offset          int64
+	containers      []decoderContainer
+	maxDepth        int
+	maxStringLength int
+	maxLength       int64
+	strict          bool
+	// record collects the bytes of a RawMessage while Decode reads it
+	record *bytes.Buffer
+}
+
+// decoderContainer is a list or dictionary the decoder is inside of.
+type decoderContainer struct {
+	dict bool
+	// for dictionaries, whether the next token is a key and the previous key
+	expectKey bool
+	lastKey   string
+	hasKey    bool
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		r:               bufio.NewReader(r),
+		maxDepth:        defaultMaxDepth,
+		maxStringLength: defaultMaxStringLength,
+	}
+}
+
+// SetMaxDepth limits how deeply lists and dictionaries may be nested.
+func (d *Decoder) SetMaxDepth(maxDepth int) {
+	d.maxDepth = maxDepth
+}
+
+// SetMaxStringLength limits the length of a single string.
+func (d *Decoder) SetMaxStringLength(maxStringLength int) {
+	d.maxStringLength = maxStringLength
+}
+
+// SetMaxLength limits the number of bytes read from the stream in total. Zero,
+// the default, means no limit.
+func (d *Decoder) SetMaxLength(maxLength int64) {
+	d.maxLength = maxLength
+}
+
+// SetStrict makes the decoder reject everything that is not canonical
+// bencode as BEP 3 defines it: integers with leading zeros or a negative
+// zero, string lengths with leading zeros, and dictionary keys that are not
+// sorted or appear twice. Other clients hash such torrents differently.
+func (d *Decoder) SetStrict(strict bool) {
+	d.strict = strict
+}
+
+// InputOffset is the number of bytes read so far.
+func (d *Decoder) InputOffset() int64 {
+	return d.offset
+}
+
+// More reports whether the current list or dictionary has another element.
+func (d *Decoder) More() bool {
+	b, err := d.r.Peek(1)
+	return err == nil && b[0] != 'e'
+}
+
+// Token returns the next token in the stream, io.EOF when the stream ends
+// between two values. Strings are returned as string, integers as int or, when
+// they do not fit into one, int64, and the start and end of lists and
+// dictionaries as Delim.
+func (d *Decoder) Token() (Token, error) {
+	start := d.offset
+	b, err := d.readByte()
+	if err == io.EOF && len(d.containers) == 0 {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, d.unexpectedEOF(err)
+	}
+
+	var parent *decoderContainer
+	if len(d.containers) > 0 {
+		parent = &d.containers[len(d.containers)-1]
+	}
+	if parent != nil && parent.dict && parent.expectKey && b != 'e' {
+		key, err := d.readKey(start, b, parent)
+		if err != nil {
+			return nil, err
+		}
+		parent.expectKey = false
+		return key, nil
+	}
+
+	switch {
+	case b == 'l' || b == 'd':
+		if len(d.containers) >= d.maxDepth {
+			return nil, newSyntaxError(start, "nesting deeper than %d", d.maxDepth)
+		}
+		d.containers = append(d.containers, decoderContainer{dict: b == 'd', expectKey: true})
+		return Delim(b), nil
+	case b == 'e':
+		if parent == nil {
+			return nil, newSyntaxError(start, "unexpected end")
+		}
+		if parent.dict && !parent.expectKey {
+			return nil, newSyntaxError(start, "dictionary key %q has no value", parent.lastKey)
+		}
+		d.containers = d.containers[:len(d.containers)-1]
+		d.valueDone()
+		return Delim(b), nil
+	case b == 'i':
+		v, err := d.readInteger(start)
+		if err != nil {
+			return nil, err
+		}
+		d.valueDone()
+		return v, nil
+	case b >= '0' && b <= '9':
+		v, err := d.readString(start, b)
+		if err != nil {
+			return nil, err
+		}
+		d.valueDone()
+		return v, nil
+	default:
+		return nil, newSyntaxError(start, "unexpected character %q", b)
+	}
+}
+
+// readKey reads the next key of a dictionary, which has to be a string and,
+// in strict mode, sort after the previous key.
+func (d *Decoder) readKey(start int64, first byte, dict *decoderContainer) (string, error) {
+	if first < '0' || first > '9' {
+		return "", newSyntaxError(start, "dictionary key is not a string")
+	}
+	key, err := d.readString(start, first)
+	if err != nil {
+		return "", err
+	}
+	if d.strict && dict.hasKey {
+		if key == dict.lastKey {
+			return "", newSyntaxError(start, "duplicate dictionary key %q", key)
+		}
+		if key < dict.lastKey {
+			return "", newSyntaxError(start, "dictionary key %q is not sorted after %q", key, dict.lastKey)
+		}
+	}
+	dict.lastKey, dict.hasKey = key, true
+	return key, nil
+}
+
+// valueDone records that a complete value was read, after which the
+// dictionary it belongs to expects a key again.
+func (d *Decoder) valueDone() {
+	if len(d.containers) > 0 {
+		parent := &d.containers[len(d.containers)-1]
+		if parent.dict {
+			parent.expectKey = true
+		}
+	}
+}
+
+func (d *Decoder) readInteger(start int64) (any, error) {
+	digits := []byte{}
+	for {
+		b, err := d.readByte()
+		if err != nil {
+			return nil, d.unexpectedEOF(err)
+		}
+		if b == 'e' {
+			break
+		}
+		if len(digits) >= maxIntegerDigits {
+			return nil, newSyntaxError(start, "integer is too long")
+		}
+		digits = append(digits, b)
+	}
+
+	v, err := strconv.ParseInt(string(digits), 10, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		return nil, newSyntaxError(start, "integer %s does not fit into 64 bits", digits)
+	}
+	if err != nil {
+		return nil, newSyntaxError(start, "invalid integer %q", digits)
+	}
+	if d.strict && !canonicalInteger(digits) {
+		return nil, newSyntaxError(start, "integer %q is not canonical", digits)
+	}
+	if int64(int(v)) == v {
+		return int(v), nil
+	}
+	return v, nil
+}
+
+func (d *Decoder) readString(start int64, first byte) (string, error) {
+	length := int(first - '0')
+	for {
+		b, err := d.readByte()
+		if err != nil {
+			return "", d.unexpectedEOF(err)
+		}
+		if b == ':' {
+			break
+		}
+		if b < '0' || b > '9' {
+			return "", newSyntaxError(start, "invalid string length")
+		}
+		if d.strict && first == '0' {
+			return "", newSyntaxError(start, "string length has a leading zero")
+		}
+		length = length*10 + int(b-'0')
+		if length > d.maxStringLength {
+			return "", newSyntaxError(start, "string is longer than %d bytes", d.maxStringLength)
+		}
+	}
+
+	if d.maxLength > 0 && d.offset+int64(length) > d.maxLength {
+		return "", d.tooLong()
+	}
+	s := make([]byte, length)
+	n, err := io.ReadFull(d.r, s)
+	d.offset += int64(n)
+	if d.record != nil {
+		d.record.Write(s[:n])
+	}
+	if err != nil {
+		return "", d.unexpectedEOF(err)
+	}
+	return string(s), nil
+}
+
+// Decode reads the next complete value and stores it in the value v points
+// to, as Unmarshal does. The value is decoded while it is read, within the
+// limits of the decoder, so only what ends up in v is kept in memory.
+func (d *Decoder) Decode(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("cannot unmarshal into non-pointer %T", v)
+	}
+	if _, err := d.r.Peek(1); err == io.EOF && len(d.containers) == 0 {
+		return io.EOF
+	}
+
+	depth := len(d.containers)
+	err := d.decodeValue(rv.Elem())
+	if _, ok := err.(*SyntaxError); err != nil && !ok {
+		// skip the rest of a value that does not fit into v, so that the
+		// next call starts at the next value
+		for len(d.containers) > depth {
+			if _, skipErr := d.Token(); skipErr != nil {
+				return skipErr
+			}
+		}
+	}
+	return err
+}
+
+// decodeValue reads the next value into v.
+func (d *Decoder) decodeValue(v reflect.Value) error {
+	if v.Type() == rawMessageType {
+		var raw bytes.Buffer
+		d.record = &raw
+		err := d.skipValue()
+		d.record = nil
+		if err != nil {
+			return err
+		}
+		v.SetBytes(raw.Bytes())
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decodeValue(v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return fmt.Errorf("cannot unmarshal into %s", v.Type())
+		}
+		decoded, err := d.decodeInterface()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(decoded))
+		return nil
+	}
+
+	start := d.offset
+	token, err := d.Token()
+	if err != nil {
+		return d.unexpectedEOF(err)
+	}
+	switch t := token.(type) {
+	case string:
+		return setString(v, t)
+	case int:
+		return setInteger(v, strconv.Itoa(t))
+	case int64:
+		return setInteger(v, strconv.FormatInt(t, 10))
+	}
+	switch token {
+	case Delim('l'):
+		return d.decodeList(v)
+	case Delim('d'):
+		return d.decodeDictionary(v)
+	default:
+		return newSyntaxError(start, "unexpected end")
+	}
+}
+
+// decodeInterface reads the next value the way decodeBencode returns it.
+func (d *Decoder) decodeInterface() (any, error) {
+	start := d.offset
+	token, err := d.Token()
+	if err != nil {
+		return nil, d.unexpectedEOF(err)
+	}
+	switch token {
+	case Delim('l'):
+		list := []any{}
+		for d.More() {
+			item, err := d.decodeInterface()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+		return list, d.containerEnd()
+	case Delim('d'):
+		dict := map[string]any{}
+		for d.More() {
+			key, err := d.Token()
+			if err != nil {
+				return nil, d.unexpectedEOF(err)
+			}
+			value, err := d.decodeInterface()
+			if err != nil {
+				return nil, err
+			}
+			dict[key.(string)] = value
+		}
+		return dict, d.containerEnd()
+	case Delim('e'):
+		return nil, newSyntaxError(start, "unexpected end")
+	}
+	return token, nil
+}
+
+func (d *Decoder) decodeList(v reflect.Value) error {
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return fmt.Errorf("cannot unmarshal list into %s", v.Type())
+	}
+
+	if v.Kind() == reflect.Slice {
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+	}
+	for i := 0; d.More(); i++ {
+		var elem reflect.Value
+		if v.Kind() == reflect.Slice {
+			v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+			elem = v.Index(i)
+		} else if i < v.Len() {
+			elem = v.Index(i)
+		} else {
+			return fmt.Errorf("list has more than %d elements for %s", v.Len(), v.Type())
+		}
+
+		if err := d.decodeValue(elem); err != nil {
+			return pathError(fmt.Sprintf("list element %d", i), err)
+		}
+	}
+	return d.containerEnd()
+}
+
+func (d *Decoder) decodeDictionary(v reflect.Value) error {
+	var fieldsByName map[string]structField
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("cannot unmarshal dictionary into %s", v.Type())
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	case reflect.Struct:
+		fieldsByName = map[string]structField{}
+		for _, f := range structFields(v.Type()) {
+			fieldsByName[f.name] = f
+		}
+	default:
+		return fmt.Errorf("cannot unmarshal dictionary into %s", v.Type())
+	}
+
+	for d.More() {
+		token, err := d.Token()
+		if err != nil {
+			return d.unexpectedEOF(err)
+		}
+		key := token.(string)
+
+		switch v.Kind() {
+		case reflect.Map:
+			elem := reflect.New(v.Type().Elem()).Elem()
+			err = d.decodeValue(elem)
+			if err == nil {
+				v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+			}
+		default:
+			if f, ok := fieldsByName[key]; ok {
+				err = d.decodeValue(v.Field(f.index))
+			} else {
+				err = d.skipValue()
+			}
+		}
+		if err != nil {
+			return pathError(key, err)
+		}
+	}
+	return d.containerEnd()
+}
+
+// skipValue reads the next value without keeping it.
+func (d *Decoder) skipValue() error {
+	depth := len(d.containers)
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return d.unexpectedEOF(err)
+		}
+		if token == Delim('e') && len(d.containers) < depth {
+			return newSyntaxError(d.offset-1, "unexpected end")
+		}
+		if len(d.containers) == depth {
+			return nil
+		}
+	}
+}
+
+// containerEnd reads the end of the list or dictionary after its last
+// element, which More has already seen or found missing.
+func (d *Decoder) containerEnd() error {
+	if _, err := d.Token(); err != nil {
+		return d.unexpectedEOF(err)
+	}
+	return nil
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if d.maxLength > 0 && d.offset >= d.maxLength {
+		d.r.UnreadByte()
+		return 0, d.tooLong()
+	}
+	d.offset++
+	if d.record != nil {
+		d.record.WriteByte(b)
+	}
+	return b, nil
+}
+
+func (d *Decoder) tooLong() error {
+	return newSyntaxError(d.offset, "data is longer than %d bytes", d.maxLength)
+}
+
+func (d *Decoder) unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return newSyntaxError(d.offset, "unexpected end of data")
+	}
+	return err
+}
+
+// canonicalInteger reports whether the digits of an integer are written the
+// only way BEP 3 allows: no plus sign, no leading zeros and no negative zero.
+func canonicalInteger(digits []byte) bool {
+	if len(digits) > 0 && digits[0] == '-' {
+		digits = digits[1:]
+		if len(digits) > 0 && digits[0] == '0' {
+			return false
+		}
+	}
+	if len(digits) == 0 || (digits[0] == '0' && len(digits) > 1) {
+		return false
+	}
+	for _, b := range digits {
+		if b < '0' || b > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeStrict decodes data that has to be a single canonical bencode value.
+func decodeStrict(data []byte) (any, error) {
+	d := NewDecoder(bytes.NewReader(data))
+	d.SetStrict(true)
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if d.InputOffset() != int64(len(data)) {
+		return nil, newSyntaxError(d.InputOffset(), "unexpected data after value")
+	}
+	return v, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDecoderToken(t *testing.T) {
+	// a reader returning one byte at a time makes sure tokens may span reads
+	d := NewDecoder(iotest.OneByteReader(strings.NewReader("d3:fooli1ei-2ee5:hello0:ei7e")))
+	expected := []Token{Delim('d'), "foo", Delim('l'), 1, -2, Delim('e'), "hello", "", Delim('e'), 7}
+	for i, want := range expected {
+		token, err := d.Token()
+		if err != nil {
+			t.Fatalf("unexpected error at token %d: %s", i, err.Error())
+		}
+		if !reflect.DeepEqual(token, want) {
+			t.Fatalf("unexpected token %d: %#v instead of %#v", i, token, want)
+		}
+	}
+	if _, err := d.Token(); err != io.EOF {
+		t.Fatalf("unexpected error at the end: %v", err)
+	}
+	if d.InputOffset() != 28 {
+		t.Fatalf("unexpected offset: %d", d.InputOffset())
+	}
+}
+
+func TestDecoderDecode(t *testing.T) {
+	d := NewDecoder(strings.NewReader("d8:intervali900e5:peers6:abcdefel1:a1:bei3e"))
+
+	var resp trackerResponse
+	if err := d.Decode(&resp); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if resp.Interval != 900 || resp.Peers != "abcdef" {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+
+	// step into the list and decode its elements one by one
+	if token, err := d.Token(); err != nil || token != Delim('l') {
+		t.Fatalf("unexpected token: %v, %v", token, err)
+	}
+	elements := []string{}
+	for d.More() {
+		var s string
+		if err := d.Decode(&s); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		elements = append(elements, s)
+	}
+	if !reflect.DeepEqual(elements, []string{"a", "b"}) {
+		t.Fatalf("unexpected elements: %v", elements)
+	}
+	if token, err := d.Token(); err != nil || token != Delim('e') {
+		t.Fatalf("unexpected token: %v, %v", token, err)
+	}
+
+	var raw RawMessage
+	if err := d.Decode(&raw); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if string(raw) != "i3e" {
+		t.Fatalf("unexpected raw value: %q", raw)
+	}
+	if err := d.Decode(&raw); err != io.EOF {
+		t.Fatalf("unexpected error at the end: %v", err)
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		input         string
+		maxDepth      int
+		maxString     int
+		maxLength     int64
+		expectedError string
+	}{
+		{name: "too deep", input: "lllleeee", maxDepth: 3, expectedError: "nesting deeper than 3 at offset 3"},
+		{name: "string too long", input: "100:abc", maxString: 10, expectedError: "string is longer than 10 bytes at offset 0"},
+		{name: "stream too long", input: "l1:a1:a1:a1:ae", maxLength: 8, expectedError: "data is longer than 8 bytes at offset 8"},
+		{name: "string past the stream limit", input: "l20:aaaaaaaaaaaaaaaaaaaae", maxLength: 10, expectedError: "data is longer than 10 bytes at offset 4"},
+		{name: "truncated string", input: "5:abc", expectedError: "unexpected end of data at offset 5"},
+		{name: "truncated integer", input: "i12", expectedError: "unexpected end of data at offset 3"},
+		{name: "truncated list", input: "li1e", expectedError: "unexpected end of data at offset 4"},
+		{name: "invalid integer", input: "i1x2e", expectedError: "invalid integer \"1x2\" at offset 0"},
+		{name: "invalid character", input: "li1ex", expectedError: "unexpected character 'x' at offset 4"},
+		{name: "stray end", input: "e", expectedError: "unexpected end at offset 0"},
+		{name: "wrong type", input: "d8:intervali9e5:peersi1ee", expectedError: ""},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			d := NewDecoder(strings.NewReader(ts.input))
+			if ts.maxDepth > 0 {
+				d.SetMaxDepth(ts.maxDepth)
+			}
+			if ts.maxString > 0 {
+				d.SetMaxStringLength(ts.maxString)
+			}
+			if ts.maxLength > 0 {
+				d.SetMaxLength(ts.maxLength)
+			}
+			var v struct {
+				Interval string `bencode:"interval"`
+			}
+			err := d.Decode(&v)
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			if !strings.Contains(err.Error(), ts.expectedError) {
+				t.Fatalf("unexpected error: %q, expected one containing %q", err.Error(), ts.expectedError)
+			}
+		})
+	}
+}
+
+func TestDecoderDecodeDeeperThanDefault(t *testing.T) {
+	depth := defaultMaxDepth + 10
+	input := strings.Repeat("l", depth) + "i7e" + strings.Repeat("e", depth)
+	d := NewDecoder(strings.NewReader(input + "i8e"))
+	d.SetMaxDepth(depth)
+
+	var v any
+	if err := d.Decode(&v); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	for i := 0; i < depth; i++ {
+		list, ok := v.([]any)
+		if !ok || len(list) != 1 {
+			t.Fatalf("unexpected value at depth %d: %v", i, v)
+		}
+		v = list[0]
+	}
+	if v != 7 {
+		t.Fatalf("unexpected innermost value: %v", v)
+	}
+
+	// a value of the wrong type is skipped as a whole
+	d = NewDecoder(strings.NewReader("li1eli2eee" + "i8e"))
+	var s string
+	if err := d.Decode(&s); err == nil {
+		t.Fatalf("expected an error")
+	}
+	var i int
+	if err := d.Decode(&i); err != nil || i != 8 {
+		t.Fatalf("unexpected value after the skipped one: %d, %v", i, err)
+	}
+}
+
+func TestDecoderStrict(t *testing.T) {
+	tests := []struct {
+		name          string
+		input         string
+		expectedError string
+	}{
+		{name: "canonical", input: "d1:ai0e1:bli-3e0:e1:cd1:xi10eee"},
+		{name: "leading zero", input: "li03ee", expectedError: `integer "03" is not canonical at offset 1`},
+		{name: "negative zero", input: "i-0e", expectedError: `integer "-0" is not canonical at offset 0`},
+		{name: "negative leading zero", input: "i-01e", expectedError: "is not canonical at offset 0"},
+		{name: "plus sign", input: "i+1e", expectedError: "is not canonical at offset 0"},
+		{name: "string length with leading zero", input: "l03:abce", expectedError: "string length has a leading zero at offset 1"},
+		{name: "unsorted keys", input: "d1:bi1e1:ai2ee", expectedError: `dictionary key "a" is not sorted after "b" at offset 7`},
+		{name: "duplicate keys", input: "d1:ai1e1:ai2ee", expectedError: `duplicate dictionary key "a" at offset 7`},
+		{name: "unsorted nested keys", input: "d1:ad1:zi1e1:yi2eee", expectedError: `dictionary key "y" is not sorted after "z" at offset 11`},
+		{name: "trailing data", input: "i1ei2e", expectedError: "unexpected data after value at offset 3"},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			// everything is accepted outside of strict mode
+			if ts.name != "trailing data" {
+				var v any
+				if err := NewDecoder(strings.NewReader(ts.input)).Decode(&v); err != nil {
+					t.Fatalf("unexpected error without strict mode: %s", err.Error())
+				}
+			}
+
+			_, err := decodeStrict([]byte(ts.input))
+			if ts.expectedError == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err.Error())
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), ts.expectedError) {
+				t.Fatalf("unexpected error: %v, expected one containing %q", err, ts.expectedError)
+			}
+		})
+	}
+}
+
+func TestDecoderRejectsMalformedDictionaries(t *testing.T) {
+	for _, input := range []string{"di1ei2ee", "d1:ae", "dlee"} {
+		var v any
+		if err := NewDecoder(strings.NewReader(input)).Decode(&v); err == nil {
+			t.Fatalf("expected an error for %q", input)
+		}
+	}
+}
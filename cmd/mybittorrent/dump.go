@@ -0,0 +1,340 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// keys defined by BEP 3 and the extensions we know of; everything else is
+// marked as unknown in the dump
+var (
+	knownMetainfoKeys = map[string]bool{
+		"announce": true, "announce-list": true, "comment": true, "created by": true,
+		"creation date": true, "encoding": true, "httpseeds": true, "info": true,
+		"nodes": true, "url-list": true,
+	}
+	knownInfoKeys = map[string]bool{
+		"files": true, "length": true, "md5sum": true, "name": true,
+		"piece length": true, "pieces": true, "private": true,
+	}
+	knownFileKeys = map[string]bool{"length": true, "md5sum": true, "path": true}
+)
+
+// dumpNode is a single value of the annotated torrent view printed by the
+// dump command. Its JSON form is the machine readable output.
+type dumpNode struct {
+	// Key is the dictionary key, list index or file name the value is
+	// stored under, nil for the top level dictionary
+	Key any `json:"key,omitempty"`
+	// Type is string, integer, list or dictionary for plain bencode values
+	// and pieces, hash, files, directory or file for annotated ones
+	Type  string `json:"type"`
+	Value any    `json:"value,omitempty"`
+	// Note explains the value, e.g. a creation date as a timestamp
+	Note     string      `json:"note,omitempty"`
+	Unknown  bool        `json:"unknown,omitempty"`
+	Children []*dumpNode `json:"children,omitempty"`
+}
+
+type dumpReport struct {
+	InfoHash string    `json:"info_hash,omitempty"`
+	Metainfo *dumpNode `json:"metainfo"`
+}
+
+// dump returns an indented view of everything in a torrent file, annotated
+// with what the values mean, or the same view as JSON. Unlike info it does
+// not require the torrent to be valid, which makes it useful for debugging.
+func dump(file string, jsonOutput bool) ([]string, error) {
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %s", err.Error())
+	}
+	// the same tree decodeBencodeBig returns, along with the bytes of the info
+	// dictionary to hash
+	dict, spans, end, err := decodeDictionaryWithSpans(contents, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode torrent: %s", err.Error())
+	}
+	if end != len(contents) {
+		return nil, fmt.Errorf("unexpected data after the torrent at offset %d", end)
+	}
+
+	report := dumpReport{Metainfo: dumpMetainfo(dict)}
+	if info, ok := spans["info"]; ok {
+		infoHash := sha1.Sum(info)
+		report.InfoHash = hex.EncodeToString(infoHash[:])
+	}
+
+	if jsonOutput {
+		encoded, err := json.Marshal(report)
+		if err != nil {
+			return nil, err
+		}
+		return []string{string(encoded)}, nil
+	}
+
+	lines := []string{}
+	if report.InfoHash != "" {
+		lines = append(lines, fmt.Sprintf("Info Hash: %s", report.InfoHash))
+	}
+	for _, child := range report.Metainfo.Children {
+		lines = append(lines, child.lines("")...)
+	}
+	return lines, nil
+}
+
+func dumpMetainfo(dict map[string]any) *dumpNode {
+	root := dumpValue(nil, dict)
+	markUnknownKeys(root, knownMetainfoKeys)
+
+	for _, child := range root.Children {
+		switch child.Key {
+		case "announce-list":
+			for i, tier := range child.Children {
+				if tier.Type == "list" {
+					tier.Note = fmt.Sprintf("tier %d, %s", i+1, plural(len(tier.Children), "tracker"))
+				}
+			}
+			child.Note = plural(len(child.Children), "tier")
+		case "creation date":
+			if date, ok := integerValue(dict["creation date"]); ok {
+				child.Note = time.Unix(date, 0).UTC().Format(time.RFC3339)
+			}
+		case "info":
+			if info, ok := dict["info"].(map[string]any); ok {
+				annotateInfo(child, info)
+			}
+		}
+	}
+	return root
+}
+
+// annotateInfo annotates the info dictionary node, leaving values that are
+// malformed as they are.
+func annotateInfo(node *dumpNode, info map[string]any) {
+	markUnknownKeys(node, knownInfoKeys)
+
+	files, totalLength, multiFile, filesErr := parseFiles(info)
+	for i, child := range node.Children {
+		switch child.Key {
+		case "pieces":
+			if pieces, ok := info["pieces"].(string); ok && len(pieces)%20 == 0 {
+				node.Children[i] = dumpPieces(child.Key, pieces)
+			}
+		case "piece length", "length":
+			if length, ok := integerValue(info[child.Key.(string)]); ok {
+				child.Note = formatSize(length)
+			}
+		case "private":
+			if private, ok := integerValue(info["private"]); ok && private == 1 {
+				child.Note = "private, peers only come from the trackers"
+			}
+		case "files":
+			rawFiles, ok := info["files"].([]any)
+			if ok && filesErr == nil && multiFile {
+				node.Children[i] = dumpFileTree(child.Key, files, rawFiles)
+			}
+		}
+	}
+
+	notes := []string{}
+	if filesErr == nil {
+		notes = append(notes, plural(len(files), "file"), formatSize(totalLength))
+	}
+	if pieces, ok := info["pieces"].(string); ok {
+		notes = append(notes, plural(len(pieces)/20, "piece"))
+	}
+	if private, ok := integerValue(info["private"]); ok && private == 1 {
+		notes = append(notes, "private")
+	} else {
+		notes = append(notes, "public")
+	}
+	node.Note = strings.Join(notes, ", ")
+}
+
+func dumpPieces(key any, pieces string) *dumpNode {
+	node := &dumpNode{Key: key, Type: "pieces", Note: plural(len(pieces)/20, "piece")}
+	for i := 0; i < len(pieces); i += 20 {
+		node.Children = append(node.Children, &dumpNode{
+			Key:   i / 20,
+			Type:  "hash",
+			Value: hex.EncodeToString([]byte(pieces[i : i+20])),
+		})
+	}
+	return node
+}
+
+// dumpFileTree shows the files of a multi-file torrent as the directory tree
+// they are stored in, with the size of every file and directory. Keys of the
+// file dictionaries other than length and path are kept below the file.
+func dumpFileTree(key any, files []torrentFile, rawFiles []any) *dumpNode {
+	root := &dumpNode{Key: key, Type: "files"}
+	for i, f := range files {
+		dir := root
+		for _, component := range f.path[:len(f.path)-1] {
+			dir = dumpDirectory(dir, component)
+		}
+
+		file := &dumpNode{Key: f.path[len(f.path)-1], Type: "file", Value: f.length}
+		for _, child := range dumpValue(nil, rawFiles[i]).Children {
+			if child.Key != "length" && child.Key != "path" {
+				file.Children = append(file.Children, child)
+			}
+		}
+		markUnknownKeys(file, knownFileKeys)
+		dir.Children = append(dir.Children, file)
+	}
+
+	sumFileTree(root)
+	root.Note = plural(len(files), "file") + ", " + formatSize(root.Value.(int64))
+	root.Value = nil
+	return root
+}
+
+// dumpDirectory returns the directory called name in dir, adding it when
+// it does not exist yet.
+func dumpDirectory(dir *dumpNode, name string) *dumpNode {
+	for _, child := range dir.Children {
+		if child.Type == "directory" && child.Key == name {
+			return child
+		}
+	}
+	child := &dumpNode{Key: name, Type: "directory"}
+	dir.Children = append(dir.Children, child)
+	return child
+}
+
+// sumFileTree sets the value of every directory to the size of its files
+// and notes the sizes in a readable form.
+func sumFileTree(node *dumpNode) int64 {
+	if node.Type == "file" {
+		node.Note = formatSize(node.Value.(int64))
+		return node.Value.(int64)
+	}
+
+	size := int64(0)
+	for _, child := range node.Children {
+		size += sumFileTree(child)
+	}
+	node.Value = size
+	node.Note = formatSize(size)
+	return size
+}
+
+// dumpValue converts a decoded bencode value into a node without any
+// annotations. Dictionary keys are sorted, as in canonical bencode.
+func dumpValue(key, value any) *dumpNode {
+	node := &dumpNode{Key: key}
+	switch v := value.(type) {
+	case string:
+		node.Type = "string"
+		node.Value = toJSONTree(v, binaryHex)
+	case int, int64, *big.Int:
+		node.Type = "integer"
+		node.Value = v
+	case []any:
+		node.Type = "list"
+		for i, item := range v {
+			node.Children = append(node.Children, dumpValue(i, item))
+		}
+	case map[string]any:
+		node.Type = "dictionary"
+		keys := []string{}
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			node.Children = append(node.Children, dumpValue(toJSONTree(k, binaryHex), v[k]))
+		}
+	}
+	return node
+}
+
+// markUnknownKeys marks the children of a dictionary node whose keys are not
+// in known.
+func markUnknownKeys(node *dumpNode, known map[string]bool) {
+	for _, child := range node.Children {
+		key, ok := child.Key.(string)
+		child.Unknown = !ok || !known[key]
+	}
+}
+
+// lines renders the node and its children, indented by two spaces per
+// level. Unknown keys are flagged so that they stand out.
+func (n *dumpNode) lines(indent string) []string {
+	line := indent + formatDumpKey(n.Key) + ":"
+	if n.Value != nil {
+		line += " " + n.formatValue()
+	}
+	if n.Note != "" {
+		line += " (" + n.Note + ")"
+	}
+	if n.Unknown {
+		line += " [unknown key]"
+	}
+
+	lines := []string{line}
+	for _, child := range n.Children {
+		lines = append(lines, child.lines(indent+"  ")...)
+	}
+	return lines
+}
+
+func formatDumpKey(key any) string {
+	switch k := key.(type) {
+	case int:
+		return fmt.Sprintf("[%d]", k)
+	case string:
+		return k
+	case byteString:
+		return "0x" + hex.EncodeToString([]byte(k.data))
+	default:
+		return fmt.Sprint(k)
+	}
+}
+
+func (n *dumpNode) formatValue() string {
+	switch v := n.Value.(type) {
+	case string:
+		if n.Type == "string" {
+			return strconv.Quote(v)
+		}
+		return v
+	case byteString:
+		return fmt.Sprintf("0x%s", hex.EncodeToString([]byte(v.data)))
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// formatSize formats a number of bytes in the largest binary unit that
+// keeps it at one or more, with the exact number for larger sizes.
+func formatSize(size int64) string {
+	if size < 1024 && size > -1024 {
+		return fmt.Sprintf("%d bytes", size)
+	}
+	units := []string{"KiB", "MiB", "GiB", "TiB", "PiB"}
+	value := float64(size) / 1024
+	unit := 0
+	for (value >= 1024 || value <= -1024) && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s, %d bytes", value, units[unit], size)
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func writeDumpTorrent(t *testing.T) string {
+	torrent, err := encodeBencode(map[string]any{
+		"announce":      "http://a/announce",
+		"announce-list": []any{[]any{"http://a/announce", "http://b/announce"}, []any{"udp://c"}},
+		"creation date": 1490916601,
+		"x-custom":      "\xff\x00",
+		"info": map[string]any{
+			"name":         "dir",
+			"piece length": 16384,
+			"pieces":       strings.Repeat("\x01", 20) + strings.Repeat("\xab", 20),
+			"private":      1,
+			"source":       "tracker",
+			"files": []any{
+				map[string]any{"length": 2048, "path": []any{"sub", "a.bin"}},
+				map[string]any{"length": 100, "path": []any{"sub", "b.txt"}, "attr": "h"},
+				map[string]any{"length": 20000, "path": []any{"c.bin"}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	torrentPath := filepath.Join(t.TempDir(), "test.torrent")
+	if err := os.WriteFile(torrentPath, torrent, 0644); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	return torrentPath
+}
+
+func TestDump(t *testing.T) {
+	torrentPath := writeDumpTorrent(t)
+	lines, err := dump(torrentPath, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	m, err := loadMetainfo(torrentPath, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	expected := []string{
+		"Info Hash: " + m.infoHashHex(),
+		`announce: "http://a/announce"`,
+		"announce-list: (2 tiers)",
+		"  [0]: (tier 1, 2 trackers)",
+		`    [0]: "http://a/announce"`,
+		`    [1]: "http://b/announce"`,
+		"  [1]: (tier 2, 1 tracker)",
+		`    [0]: "udp://c"`,
+		"creation date: 1490916601 (2017-03-30T23:30:01Z)",
+		"info: (3 files, 21.6 KiB, 22148 bytes, 2 pieces, private)",
+		"  files: (3 files, 21.6 KiB, 22148 bytes)",
+		"    sub: 2148 (2.1 KiB, 2148 bytes)",
+		"      a.bin: 2048 (2.0 KiB, 2048 bytes)",
+		"      b.txt: 100 (100 bytes)",
+		`        attr: "h" [unknown key]`,
+		"    c.bin: 20000 (19.5 KiB, 20000 bytes)",
+		`  name: "dir"`,
+		"  piece length: 16384 (16.0 KiB, 16384 bytes)",
+		"  pieces: (2 pieces)",
+		"    [0]: 0101010101010101010101010101010101010101",
+		"    [1]: abababababababababababababababababababab",
+		"  private: 1 (private, peers only come from the trackers)",
+		`  source: "tracker" [unknown key]`,
+		"x-custom: 0xff00 [unknown key]",
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Fatalf("unexpected lines:\n%s\ninstead of\n%s", strings.Join(lines, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestDumpJSON(t *testing.T) {
+	lines, err := dump("../../sample.torrent", true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(lines) != 1 {
+		t.Fatalf("unexpected number of lines: %d", len(lines))
+	}
+
+	var report struct {
+		InfoHash string `json:"info_hash"`
+		Metainfo struct {
+			Children []struct {
+				Key      string `json:"key"`
+				Note     string `json:"note"`
+				Children []struct {
+					Key      string `json:"key"`
+					Type     string `json:"type"`
+					Children []struct {
+						Value string `json:"value"`
+					} `json:"children"`
+				} `json:"children"`
+			} `json:"children"`
+		} `json:"metainfo"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &report); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if report.InfoHash != "d69f91e6b2ae4c542468d1073a71d4ea13879a7f" {
+		t.Fatalf("unexpected info hash: %s", report.InfoHash)
+	}
+	info := report.Metainfo.Children[2]
+	if info.Key != "info" || info.Note != "1 file, 89.9 KiB, 92063 bytes, 3 pieces, public" {
+		t.Fatalf("unexpected info: %+v", info)
+	}
+	pieces := info.Children[3]
+	if pieces.Type != "pieces" || len(pieces.Children) != 3 || pieces.Children[0].Value != "e876f67a2a8886e8f36b136726c30fa29703022d" {
+		t.Fatalf("unexpected pieces: %+v", pieces)
+	}
+}
+
+func TestDumpErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name     string
+		contents string
+	}{
+		{name: "not a dictionary", contents: "li1ee"},
+		{name: "truncated", contents: "d4:info"},
+		{name: "trailing data", contents: "de1:x"},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			path := filepath.Join(dir, "test.torrent")
+			if err := os.WriteFile(path, []byte(ts.contents), 0644); err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if _, err := dump(path, false); err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+}
+
+func TestDumpBigIntegers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.torrent")
+	if err := os.WriteFile(path, []byte("d13:creation datei123456789012345678901234567890ee"), 0644); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	lines, err := dump(path, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !slices.Contains(lines, "creation date: 123456789012345678901234567890") {
+		t.Fatalf("unexpected output: %v", lines)
+	}
+
+	// everything else rejects them
+	if _, err := loadMetainfo(path, false); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"math/big"
 	"slices"
 )
 
@@ -10,9 +11,17 @@ func encodeBencode(obj any) ([]byte, error) {
 	case string:
 		str := obj.(string)
 		return []byte(fmt.Sprintf("%d:%s", len(str), str)), nil
-	case int:
-		i := obj.(int)
-		return []byte(fmt.Sprintf("i%de", i)), nil
+	case []byte:
+		b := obj.([]byte)
+		return []byte(fmt.Sprintf("%d:%s", len(b), b)), nil
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return []byte(fmt.Sprintf("i%de", obj)), nil
+	case *big.Int:
+		i := obj.(*big.Int)
+		if i == nil {
+			return nil, fmt.Errorf("cannot encode nil *big.Int")
+		}
+		return []byte(fmt.Sprintf("i%se", i.String())), nil
 	case []any:
 		ls := obj.([]any)
 		v := "l"
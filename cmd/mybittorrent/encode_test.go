@@ -1,6 +1,9 @@
 package main
 
-import "testing"
+import (
+	"math/big"
+	"testing"
+)
 
 func TestEncodeBencode(t *testing.T) {
 	tests := []struct {
@@ -23,6 +26,31 @@ func TestEncodeBencode(t *testing.T) {
 			name:     "negative int",
 			input:    -5,
 		},
+		{
+			expected: "i-128e",
+			name:     "int8",
+			input:    int8(-128),
+		},
+		{
+			expected: "i9223372036854775807e",
+			name:     "int64",
+			input:    int64(9223372036854775807),
+		},
+		{
+			expected: "i18446744073709551615e",
+			name:     "uint64",
+			input:    uint64(18446744073709551615),
+		},
+		{
+			expected: "i123456789012345678901234567890e",
+			name:     "big int",
+			input:    testBigInt("123456789012345678901234567890"),
+		},
+		{
+			expected: "4:\x00\x01\xfe\xff",
+			name:     "byte slice",
+			input:    []byte{0x00, 0x01, 0xfe, 0xff},
+		},
 		{
 			expected: "l5:helloi52ee",
 			name:     "list",
@@ -51,3 +79,11 @@ func TestEncodeBencode(t *testing.T) {
 		})
 	}
 }
+
+func testBigInt(s string) *big.Int {
+	i, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		panic("invalid big integer " + s)
+	}
+	return i
+}
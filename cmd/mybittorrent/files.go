@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+type torrentFile struct {
+	path   []string
+	length int64
+}
+
+// parseFiles returns the files described by an info dictionary together with
+// their combined length. A single-file torrent is returned as one file named
+// after the torrent.
+func parseFiles(info map[string]any) ([]torrentFile, int64, bool, error) {
+	name, ok := info["name"].(string)
+	if !ok || name == "" {
+		return nil, 0, false, fmt.Errorf("info dictionary is missing a name")
+	}
+	if !safePathComponent(name) {
+		return nil, 0, false, fmt.Errorf("info dictionary has an unsafe name: %q", name)
+	}
+
+	if length, ok := integerValue(info["length"]); ok {
+		return []torrentFile{{path: []string{name}, length: length}}, length, false, nil
+	}
+
+	rawFiles, ok := info["files"].([]any)
+	if !ok {
+		return nil, 0, false, fmt.Errorf("info dictionary has neither length nor files")
+	}
+
+	files := []torrentFile{}
+	totalLength := int64(0)
+	for i, rawFile := range rawFiles {
+		fileDict, ok := rawFile.(map[string]any)
+		if !ok {
+			return nil, 0, false, fmt.Errorf("file %d is not a dictionary", i)
+		}
+
+		length, ok := integerValue(fileDict["length"])
+		if !ok {
+			return nil, 0, false, fmt.Errorf("file %d is missing a length", i)
+		}
+
+		rawPath, ok := fileDict["path"].([]any)
+		if !ok || len(rawPath) == 0 {
+			return nil, 0, false, fmt.Errorf("file %d is missing a path", i)
+		}
+
+		path := []string{}
+		for _, rawComponent := range rawPath {
+			component, ok := rawComponent.(string)
+			if !ok {
+				return nil, 0, false, fmt.Errorf("file %d has a non string path component", i)
+			}
+			if !safePathComponent(component) {
+				return nil, 0, false, fmt.Errorf("file %d has an unsafe path component: %q", i, component)
+			}
+			path = append(path, component)
+		}
+
+		files = append(files, torrentFile{path: path, length: length})
+		totalLength += length
+	}
+
+	return files, totalLength, true, nil
+}
+
+// safePathComponent reports whether a name from a torrent can be used as a
+// single file or directory name without leaving the download directory.
+// Torrents and metadata come from strangers, so nothing else may be joined
+// into a path.
+func safePathComponent(component string) bool {
+	return component != "" && component != "." && component != ".." && !strings.ContainsAny(component, "/\\")
+}
+
+// filePaths maps every file in the torrent to the location it is written to on
+// disk. Single-file torrents are written to the target itself, multi-file
+// torrents to a directory named after the torrent inside the target.
+func filePaths(downloadTarget, name string, files []torrentFile, multiFile bool) ([]string, error) {
+	if !multiFile {
+		return []string{downloadTarget}, nil
+	}
+	if !safePathComponent(name) {
+		return nil, fmt.Errorf("unsafe torrent name: %q", name)
+	}
+
+	paths := []string{}
+	for _, f := range files {
+		for _, component := range f.path {
+			if !safePathComponent(component) {
+				return nil, fmt.Errorf("unsafe path component: %q", component)
+			}
+		}
+		parts := append([]string{downloadTarget, name}, f.path...)
+		paths = append(paths, filepath.Join(parts...))
+	}
+	return paths, nil
+}
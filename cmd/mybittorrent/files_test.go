@@ -0,0 +1,73 @@
+package main
+
+import "testing"
+
+func TestParseFiles(t *testing.T) {
+	tests := []struct {
+		name              string
+		info              map[string]any
+		expectedLength    int64
+		expectedFiles     int
+		expectedMultiFile bool
+		expectError       bool
+	}{
+		{
+			name:           "single file",
+			info:           map[string]any{"name": "sample.txt", "length": 92063},
+			expectedLength: 92063,
+			expectedFiles:  1,
+		},
+		{
+			name: "multi file",
+			info: map[string]any{
+				"name": "dir",
+				"files": []any{
+					map[string]any{"length": 10, "path": []any{"a.txt"}},
+					map[string]any{"length": 20, "path": []any{"sub", "b.txt"}},
+				},
+			},
+			expectedLength:    30,
+			expectedFiles:     2,
+			expectedMultiFile: true,
+		},
+		{
+			name: "unsafe path",
+			info: map[string]any{
+				"name": "dir",
+				"files": []any{
+					map[string]any{"length": 10, "path": []any{"..", "a.txt"}},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name:        "missing length and files",
+			info:        map[string]any{"name": "dir"},
+			expectError: true,
+		},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			files, length, multiFile, err := parseFiles(ts.info)
+			if ts.expectError {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if length != ts.expectedLength {
+				t.Fatalf("unexpected length: %d instead of %d", length, ts.expectedLength)
+			}
+			if len(files) != ts.expectedFiles {
+				t.Fatalf("unexpected number of files: %d instead of %d", len(files), ts.expectedFiles)
+			}
+			if multiFile != ts.expectedMultiFile {
+				t.Fatalf("unexpected multi file flag: %v instead of %v", multiFile, ts.expectedMultiFile)
+			}
+		})
+	}
+}
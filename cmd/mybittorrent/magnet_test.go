@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha1"
+	"net"
+	"strings"
+	"testing"
+)
+
+// newFakeMetadataPeer starts a peer that answers the first metadata request
+// with rawInfo, whatever it contains.
+func newFakeMetadataPeer(t *testing.T, infoHash, rawInfo []byte) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err.Error())
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if _, err := readExactLength(conn, 68); err != nil {
+			return
+		}
+		hs := handshake{infoHash: infoHash, peerID: createRandomID(), supportExtensions: true}
+		conn.Write(hs.makeMessage())
+
+		extHandshake, _ := encodeBencode(map[string]any{"m": map[string]any{"ut_metadata": 3}})
+		conn.Write(makePeerMessage(messageExtended, append([]byte{0}, extHandshake...)))
+
+		// our extension handshake, then the metadata request
+		reader := newMessageReader(conn)
+		if _, err := reader.readExtendedMessage(0); err != nil {
+			return
+		}
+		if _, err := reader.readExtendedMessage(3); err != nil {
+			return
+		}
+
+		header, _ := encodeBencode(map[string]any{"msg_type": 1, "piece": 0, "total_size": len(rawInfo)})
+		payload := append([]byte{ourMetadataExtensionId}, header...)
+		conn.Write(makePeerMessage(messageExtended, append(payload, rawInfo...)))
+
+		// wait for the client to hang up
+		readExactLength(conn, 1)
+	}()
+
+	return listener.Addr().String()
+}
+
+func encodeTestInfo(t *testing.T, name string) []byte {
+	rawInfo, err := encodeBencode(map[string]any{
+		"name":         name,
+		"piece length": 4,
+		"pieces":       strings.Repeat("h", 20),
+		"files": []any{
+			map[string]any{"length": 3, "path": []any{"a"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	return rawInfo
+}
+
+func TestGetDownloadInfoThroughMetadata(t *testing.T) {
+	rawInfo := encodeTestInfo(t, "dir")
+	infoHash := sha1.Sum(rawInfo)
+	peer := newFakeMetadataPeer(t, infoHash[:], rawInfo)
+
+	di, err := getDownloadInfoThroughMetadataFromPeers([]string{peer}, infoHash[:])
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if di.name != "dir" || !di.multiFile || di.fileLength != 3 || di.pieceLength != 4 || len(di.pieceHashesByIndex) != 1 {
+		t.Fatalf("unexpected download info: %+v", di)
+	}
+}
+
+func TestGetDownloadInfoThroughMetadataRejectsBadMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		rawInfo  []byte
+		infoHash func(rawInfo []byte) []byte
+	}{
+		{
+			// would write the files next to the download directory
+			name:    "parent directory name",
+			rawInfo: encodeTestInfo(t, ".."),
+			infoHash: func(rawInfo []byte) []byte {
+				hash := sha1.Sum(rawInfo)
+				return hash[:]
+			},
+		},
+		{
+			name:    "hash mismatch",
+			rawInfo: encodeTestInfo(t, "dir"),
+			infoHash: func(rawInfo []byte) []byte {
+				hash := sha1.Sum(encodeTestInfo(t, "other"))
+				return hash[:]
+			},
+		},
+		{
+			name:    "zero piece length",
+			rawInfo: []byte("d5:filesld6:lengthi3e4:pathl1:aeee4:name3:dir12:piece lengthi0e6:pieces0:e"),
+			infoHash: func(rawInfo []byte) []byte {
+				hash := sha1.Sum(rawInfo)
+				return hash[:]
+			},
+		},
+		{
+			name:    "name of the wrong type",
+			rawInfo: []byte("d6:lengthi3e4:namei1e12:piece lengthi4e6:pieces20:hhhhhhhhhhhhhhhhhhhhe"),
+			infoHash: func(rawInfo []byte) []byte {
+				hash := sha1.Sum(rawInfo)
+				return hash[:]
+			},
+		},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			infoHash := ts.infoHash(ts.rawInfo)
+			peer := newFakeMetadataPeer(t, infoHash, ts.rawInfo)
+			if _, err := getDownloadInfoThroughMetadataFromPeers([]string{peer}, infoHash); err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+}
+
+func TestFilePathsRejectsUnsafeNames(t *testing.T) {
+	files := []torrentFile{{path: []string{"a"}, length: 1}}
+	for _, name := range []string{"..", ".", "", "a/b", `a\b`} {
+		if _, err := filePaths("/tmp/target", name, files, true); err == nil {
+			t.Fatalf("expected an error for %q", name)
+		}
+	}
+	if _, err := filePaths("/tmp/target", "dir", []torrentFile{{path: []string{"..", "x"}, length: 1}}, true); err == nil {
+		t.Fatalf("expected an error for a parent directory component")
+	}
+}
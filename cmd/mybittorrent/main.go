@@ -1,13 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
-	"math"
 	"math/rand"
 	"net"
 	"net/http"
@@ -36,17 +36,47 @@ func main() {
 	command := os.Args[1]
 
 	if command == "decode" {
-		// Uncomment this block to pass the first stage
-		bencodedValue := os.Args[2]
+		// strings that are not valid UTF-8 are printed as hex, or base64
+		// with the optional --base64 flag
+		encoding := binaryHex
+		args := []string{}
+		for _, arg := range os.Args[2:] {
+			if arg == "--base64" {
+				encoding = binaryBase64
+			} else {
+				args = append(args, arg)
+			}
+		}
+		if len(args) != 1 {
+			fmt.Println("usage: decode [--base64] <bencoded value>")
+			os.Exit(1)
+		}
 
-		decoded, _, err := decodeBencode([]byte(bencodedValue))
+		decoded, _, err := decodeBencodeBig([]byte(args[0]))
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
 
-		jsonOutput, _ := json.Marshal(decoded)
+		jsonOutput, err := bencodeToJSON(decoded, encoding)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
 		fmt.Println(string(jsonOutput))
+	} else if command == "encode" {
+		if len(os.Args) != 3 {
+			fmt.Println("usage: encode <json value>")
+			os.Exit(1)
+		}
+
+		encoded, err := jsonToBencode([]byte(os.Args[2]))
+		if err != nil {
+			fmt.Printf("failed to encode: %s\n", err.Error())
+			os.Exit(1)
+		}
+		// written as is, the output is binary and has no trailing newline
+		os.Stdout.Write(encoded)
 	} else if command == "info" {
 		lines, err := info(os.Args[2])
 		if err != nil {
@@ -87,7 +117,12 @@ func main() {
 			os.Exit(1)
 		}
 	} else if command == "download" {
-		if err := downloadFile(os.Args[3], os.Args[4]); err != nil {
+		target, file, options, err := parseDownloadArgs("download", os.Args[2:])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if err := downloadFile(target, file, options); err != nil {
 			fmt.Printf("failed to download file: %s\n", err.Error())
 			os.Exit(1)
 		}
@@ -116,10 +151,83 @@ func main() {
 			os.Exit(1)
 		}
 	} else if command == "magnet_download" {
-		if err := magnet_download(os.Args[3], os.Args[4]); err != nil {
+		target, link, options, err := parseDownloadArgs("magnet_download", os.Args[2:])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if err := magnet_download(target, link, options); err != nil {
 			fmt.Printf("failed to download file: %s\n", err.Error())
 			os.Exit(1)
 		}
+	} else if command == "verify" {
+		// the optional --json flag may appear anywhere after the command
+		args := []string{}
+		jsonOutput := false
+		for _, arg := range os.Args[2:] {
+			if arg == "--json" {
+				jsonOutput = true
+			} else {
+				args = append(args, arg)
+			}
+		}
+		if len(args) != 2 {
+			fmt.Println("usage: verify [--json] <torrent> <path>")
+			os.Exit(1)
+		}
+
+		lines, ok, err := verify(args[0], args[1], jsonOutput)
+		if err != nil {
+			fmt.Printf("failed to verify: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+	} else if command == "dump" {
+		// the optional --json flag may appear anywhere after the command
+		args := []string{}
+		jsonOutput := false
+		for _, arg := range os.Args[2:] {
+			if arg == "--json" {
+				jsonOutput = true
+			} else {
+				args = append(args, arg)
+			}
+		}
+		if len(args) != 1 {
+			fmt.Println("usage: dump [--json] <torrent>")
+			os.Exit(1)
+		}
+
+		lines, err := dump(args[0], jsonOutput)
+		if err != nil {
+			fmt.Printf("failed to dump torrent: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+	} else if command == "create" {
+		lines, err := create(os.Args[2:])
+		if err != nil {
+			fmt.Printf("failed to create torrent: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+	} else if command == "seed" {
+		if err := seed(os.Args[2], os.Args[3]); err != nil {
+			fmt.Printf("failed to seed: %s\n", err.Error())
+			os.Exit(1)
+		}
 	} else {
 		fmt.Println("Unknown command: " + command)
 		os.Exit(1)
@@ -127,109 +235,61 @@ func main() {
 }
 
 func info(file string) ([]string, error) {
-	contents, err := readFile(file)
-	if err != nil {
-		return nil, fmt.Errorf("error opening file: %s", err.Error())
-	}
-
-	decoded, _, err := decodeBencode(contents)
+	m, err := loadMetainfo(file, true)
 	if err != nil {
 		return nil, err
 	}
 
-	dict, ok := decoded.(map[string]any)
-	if !ok {
-		return nil, fmt.Errorf("invalid bencode")
-	}
-
-	baseUrl := dict["announce"].(string)
-	info := dict["info"].(map[string]any)
-	length := info["length"].(int)
-
-	encodedInfo, err := encodeBencode(info)
-	if err != nil {
-		return nil, err
-	}
-
-	h := sha1.New()
-	h.Write(encodedInfo)
-	hash := hex.EncodeToString(h.Sum(nil))
-
-	piecesLength := info["piece length"].(int)
-	pieces := info["pieces"].(string)
 	hashes := []string{}
-	for cur := 0; cur < len(pieces); cur += 20 {
-		hashes = append(hashes, hex.EncodeToString([]byte(pieces[cur:cur+20])))
+	for _, hash := range m.Info.PieceHashes() {
+		hashes = append(hashes, hex.EncodeToString(hash[:]))
 	}
 
 	result := []string{
-		fmt.Sprintf("Tracker URL: %s", baseUrl),
-		fmt.Sprintf("Length: %d", length),
-		fmt.Sprintf("Info Hash: %s", hash),
-		fmt.Sprintf("Piece Length: %d", piecesLength),
-		"Piece Hashes:",
+		fmt.Sprintf("Tracker URL: %s", m.Announce),
+		fmt.Sprintf("Length: %d", m.Info.TotalLength()),
+	}
+	if m.HasAnnounceList {
+		result = append(result, "Tracker Tiers:")
+		for i, tier := range m.AnnounceTiers {
+			result = append(result, fmt.Sprintf("%d: %s", i, strings.Join(tier, " ")))
+		}
+	}
+	if m.Info.MultiFile {
+		result = append(result, "Files:")
+		for _, f := range m.Info.Files {
+			result = append(result, fmt.Sprintf("%s (%d)", strings.Join(f.path, "/"), f.length))
+		}
 	}
+	result = append(result,
+		fmt.Sprintf("Info Hash: %s", m.infoHashHex()),
+		fmt.Sprintf("Piece Length: %d", m.Info.PieceLength),
+		"Piece Hashes:",
+	)
 	result = append(result, hashes...)
 
 	return result, nil
 }
 
-func readFile(file string) ([]byte, error) {
-	f, err := os.Open(file)
-	if err != nil {
-		return nil, fmt.Errorf("error opening file: %s", err.Error())
-	}
-
-	contents, err := io.ReadAll(f)
-	if err != nil {
-		return nil, fmt.Errorf("error reading file: %s", err.Error())
-	}
-	return contents, nil
-}
-
 func peers(file string) ([]string, error) {
 	result := []string{}
-	contents, err := readFile(file)
-	if err != nil {
-		return nil, fmt.Errorf("error reading file: %s", err.Error())
-	}
-
-	decoded, _, err := decodeBencode(contents)
-	if err != nil {
-		return nil, err
-	}
-
-	dict, ok := decoded.(map[string]any)
-	if !ok {
-		return nil, fmt.Errorf("invalid bencode")
-	}
-
-	baseUrl := dict["announce"].(string)
-	info := dict["info"].(map[string]any)
-	length := info["length"].(int)
-
-	hashBytes, err := getInfoHash(info)
+	m, err := loadMetainfo(file, false)
 	if err != nil {
 		return nil, err
 	}
 
-	responseBodyBytes, err := sendRequest(baseUrl, hashBytes, length)
+	peers, err := requestPeersFromTiers(m.trackerTiers(), m.InfoHash[:], m.Info.TotalLength())
 	if err != nil {
-		return nil, fmt.Errorf("error reading response body: %s", err.Error())
+		return nil, fmt.Errorf("error requesting peers from tracker: %s", err.Error())
 	}
-
-	resp, _, err := decodeBencode(responseBodyBytes)
-	if err != nil {
-		return nil, fmt.Errorf("error failed to decoded response: %s", err.Error())
-	}
-
-	respDict := resp.(map[string]any)
-	peers := getPeers(respDict)
 	result = append(result, peers...)
 
 	return result, nil
 }
 
+// getInfoHash hashes an info dictionary we built ourselves. Torrents that
+// were read from a file are hashed from their original bytes instead, see
+// parseMetainfo.
 func getInfoHash(info map[string]any) ([]byte, error) {
 	encodedInfo, err := encodeBencode(info)
 	if err != nil {
@@ -242,7 +302,9 @@ func getInfoHash(info map[string]any) ([]byte, error) {
 	return hashBytes, nil
 }
 
-func sendRequest(trackerURL string, infoHash []byte, length int) ([]byte, error) {
+// sendRequest announces to an HTTP tracker and decodes its response straight
+// from the connection.
+func sendRequest(trackerURL string, infoHash []byte, length int64) (*trackerResponse, error) {
 	u, err := url.Parse(trackerURL)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing base url: %s", err.Error())
@@ -251,7 +313,7 @@ func sendRequest(trackerURL string, infoHash []byte, length int) ([]byte, error)
 	params := url.Values{}
 	params.Add("info_hash", string(infoHash))
 	params.Add("peer_id", createUniqueId())
-	params.Add("port", "6881")
+	params.Add("port", strconv.Itoa(listenPort))
 	params.Add("uploaded", "0")
 	params.Add("downloaded", "0")
 	params.Add("left", fmt.Sprintf("%d", length))
@@ -269,27 +331,59 @@ func sendRequest(trackerURL string, infoHash []byte, length int) ([]byte, error)
 	}
 	defer response.Body.Close()
 
-	responseBodyBytes, err := io.ReadAll(response.Body)
-	if err != nil {
-		return nil, fmt.Errorf("error reading response body: %s", err.Error())
+	decoder := NewDecoder(response.Body)
+	decoder.SetMaxDepth(maxTrackerResponseDepth)
+	decoder.SetMaxStringLength(maxTrackerResponseString)
+	decoder.SetMaxLength(maxTrackerResponseLength)
+	resp := &trackerResponse{}
+	if err := decoder.Decode(resp); err != nil {
+		return nil, fmt.Errorf("error decoding response: %s", err.Error())
 	}
 
-	return responseBodyBytes, nil
+	return resp, nil
 }
 
-func getPeers(dict map[string]any) []string {
-	peers := []string{}
-	possiblePeers, ok := dict["peers"]
-	if ok {
-		peersBytes := []byte(possiblePeers.(string))
-		for i := 0; i < len(peersBytes); i += 6 {
-			ip0 := peersBytes[i]
-			ip1 := peersBytes[i+1]
-			ip2 := peersBytes[i+2]
-			ip3 := peersBytes[i+3]
-			port := binary.BigEndian.Uint16([]byte{peersBytes[i+4], peersBytes[i+5]})
-			peers = append(peers, fmt.Sprintf("%d.%d.%d.%d:%d", ip0, ip1, ip2, ip3, port))
+// getPeers returns the peers of a tracker response, which are either a
+// compact string or, from trackers that ignore compact=1, a list of
+// dictionaries with an ip and a port.
+func getPeers(resp *trackerResponse) ([]string, error) {
+	switch peers := resp.Peers.(type) {
+	case nil:
+		return []string{}, nil
+	case string:
+		return parseCompactPeers([]byte(peers)), nil
+	case []any:
+		result := []string{}
+		for i, rawPeer := range peers {
+			peer, ok := rawPeer.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("peer %d is not a dictionary", i)
+			}
+			ip, ok := peer["ip"].(string)
+			if !ok || ip == "" {
+				return nil, fmt.Errorf("peer %d is missing the ip", i)
+			}
+			port, ok := integerValue(peer["port"])
+			if !ok || port <= 0 || port > 65535 {
+				return nil, fmt.Errorf("peer %d has an invalid port", i)
+			}
+			result = append(result, net.JoinHostPort(ip, strconv.FormatInt(port, 10)))
 		}
+		return result, nil
+	default:
+		return nil, fmt.Errorf("unexpected peers of type %T", resp.Peers)
+	}
+}
+
+func parseCompactPeers(peersBytes []byte) []string {
+	peers := []string{}
+	for i := 0; i+6 <= len(peersBytes); i += 6 {
+		ip0 := peersBytes[i]
+		ip1 := peersBytes[i+1]
+		ip2 := peersBytes[i+2]
+		ip3 := peersBytes[i+3]
+		port := binary.BigEndian.Uint16([]byte{peersBytes[i+4], peersBytes[i+5]})
+		peers = append(peers, fmt.Sprintf("%d.%d.%d.%d:%d", ip0, ip1, ip2, ip3, port))
 	}
 	return peers
 }
@@ -308,33 +402,13 @@ type handshake struct {
 func performHandshake(file, peerConnectionString string) ([]string, error) {
 	result := []string{}
 
-	contents, err := readFile(file)
-	if err != nil {
-		return nil, fmt.Errorf("error reading file: %s", err.Error())
-	}
-
-	decoded, _, err := decodeBencode(contents)
-	if err != nil {
-		return nil, err
-	}
-
-	dict, ok := decoded.(map[string]any)
-	if !ok {
-		return nil, fmt.Errorf("invalid bencode")
-	}
-
-	info := dict["info"].(map[string]any)
-	encodedInfo, err := encodeBencode(info)
+	m, err := loadMetainfo(file, false)
 	if err != nil {
 		return nil, err
 	}
 
-	h := sha1.New()
-	h.Write(encodedInfo)
-	hashBytes := h.Sum(nil)
-
 	hs := handshake{
-		infoHash: hashBytes,
+		infoHash: m.InfoHash[:],
 		peerID:   []byte("00112233445566778899"),
 	}
 
@@ -387,118 +461,34 @@ func (hs *handshake) parseMessage(message []byte) error {
 }
 
 func downloadPiece(targetLocation, file string, pieceIndex int) error {
-	contents, err := readFile(file)
-	if err != nil {
-		return fmt.Errorf("error reading file: %s", err.Error())
-	}
-
-	decoded, _, err := decodeBencode(contents)
-	if err != nil {
-		return err
-	}
-
-	dict, ok := decoded.(map[string]any)
-	if !ok {
-		return fmt.Errorf("invalid bencode")
-	}
-
-	baseUrl := dict["announce"].(string)
-	info := dict["info"].(map[string]any)
-	fileLength := info["length"].(int)
-	pieceLength := info["piece length"].(int)
-	fmt.Println(string(contents))
-	pieces := info["pieces"].(string)
-	hashByIndex := calcPieceHashes(pieces)
-
-	infoHashBytes, err := getInfoHash(info)
+	m, err := loadMetainfo(file, false)
 	if err != nil {
 		return err
 	}
-
-	responseBodyBytes, err := sendRequest(baseUrl, infoHashBytes, fileLength)
-	if err != nil {
-		return fmt.Errorf("error reading response body: %s", err.Error())
+	if pieceIndex < 0 || pieceIndex >= m.Info.PieceCount() {
+		return fmt.Errorf("piece %d out of range, the torrent has %d pieces", pieceIndex, m.Info.PieceCount())
 	}
 
-	resp, _, err := decodeBencode(responseBodyBytes)
+	peers, err := requestPeersFromTiers(m.trackerTiers(), m.InfoHash[:], m.Info.TotalLength())
 	if err != nil {
-		return fmt.Errorf("error failed to decoded response: %s", err.Error())
+		return fmt.Errorf("error requesting peers from tracker: %s", err.Error())
 	}
-
-	respDict := resp.(map[string]any)
-	peers := getPeers(respDict)
 	if len(peers) < 1 {
 		return fmt.Errorf("did not receive enough peers")
 	}
 
-	peer := peers[0]
-	hs := handshake{
-		infoHash: infoHashBytes,
-		peerID:   createRandomID(),
-	}
-
-	conn, err := net.Dial("tcp", peer)
-	if err != nil {
-		return fmt.Errorf("failed to connect via tcp to peer: %s", err.Error())
-	}
-	defer conn.Close()
-
-	_, err = doHandshakeOnConnection(conn, &hs)
-	if err != nil {
-		return fmt.Errorf("failed to do handshake with peer: %s", err.Error())
-	}
-
-	response, err := waitForNextMessage(conn)
-	if err != nil {
-		return fmt.Errorf("failed wait for new message: %s", err.Error())
-	}
-	_, _ = parseMessage(response)
-
-	response, err = sendInterested(conn)
-	if err != nil {
-		return fmt.Errorf("failed send interested message: %s", err.Error())
-	}
-	_, _ = parseMessage(response)
-
-	actualPieceLength := getPieceLengthForIndex(fileLength, pieceLength, pieceIndex)
-	expectedBlocks := calcExpectedBlocks(actualPieceLength)
-
-	currentOffset := 0
-	blocks := [][]byte{}
-	for i := 0; i < expectedBlocks; i++ {
-		requestLength := int(math.Min(float64(sixteenKilobytes), float64(actualPieceLength-currentOffset)))
-		message := createRequestMessage(pieceIndex, currentOffset, requestLength)
-
-		_, err := conn.Write(message)
-		if err != nil {
-			return fmt.Errorf("failed to read response after request message: %s", err.Error())
-		}
-
-		resp, err := readExactLength(conn, requestLength+13)
-		if err != nil {
-			return fmt.Errorf("failed to read piece message: %s", err.Error())
-		}
-
-		_, _, _, block := parsePieceMessage(resp)
-		blocks = append(blocks, block)
-		currentOffset += requestLength
-	}
-
-	newPiece := []byte{}
-	for _, b := range blocks {
-		newPiece = append(newPiece, b...)
+	pd := pieceDownloader{
+		peerConnectionString: peers[0],
+		infoHashBytes:        m.InfoHash[:],
+		fileLength:           m.Info.TotalLength(),
+		pieceLength:          m.Info.PieceLength,
+		pieceHashesByIndex:   m.Info.pieceHashesByIndex(),
 	}
+	defer pd.close()
 
-	pieceHash, err := hashBytesNew(newPiece)
+	newPiece, err := pd.Download(pieceIndex)
 	if err != nil {
-		return fmt.Errorf("failed to generate hash for new piece")
-	}
-
-	expectedHash := hashByIndex[pieceIndex]
-	fmt.Println("eHash", expectedHash)
-	fmt.Println("aHash", pieceHash)
-	if pieceHash != expectedHash {
-		return fmt.Errorf("piece hash did not match hash in torrent file. actual: %s, expected: %s", pieceHash, expectedHash)
+		return err
 	}
 
 	if err = os.WriteFile(targetLocation, newPiece, 0666); err != nil {
@@ -527,22 +517,14 @@ func calcExpectedBlocks(pieceLength int) int {
 	return expectedBlocks
 }
 
-func getPieceLengthForIndex(fileLength, pieceLength, pieceIndex int) int {
-	pieceLengthsByIndex := calcPieceLengthMap(fileLength, pieceLength)
-	return pieceLengthsByIndex[pieceIndex]
-}
-
-func calcPieceLengthMap(fileLength, pieceLength int) map[int]int {
-	result := make(map[int]int)
-	currentIndex := 0
-	current := 0
-	for current+pieceLength <= fileLength {
-		result[currentIndex] = pieceLength
-		current += pieceLength
-		currentIndex++
-	}
-	result[currentIndex] = fileLength - current
-	return result
+// getPieceLengthForIndex is pieceLength for every piece but the last, which
+// holds whatever data is left, and 0 for indexes past the end of the data.
+func getPieceLengthForIndex(fileLength int64, pieceLength, pieceIndex int) int {
+	start := int64(pieceIndex) * int64(pieceLength)
+	if pieceIndex < 0 || start >= fileLength {
+		return 0
+	}
+	return int(min(int64(pieceLength), fileLength-start))
 }
 
 func hashBytesNew(obj []byte) (string, error) {
@@ -617,229 +599,79 @@ func readExactLength(conn net.Conn, size int) ([]byte, error) {
 	return result, nil
 }
 
-func waitForNextMessage(conn net.Conn) ([]byte, error) {
-	result := []byte{}
-	buffer := make([]byte, 1024)
-	n, err := conn.Read(buffer)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read from tcp connection: %s", err.Error())
-	}
-	result = append(result, buffer[:n]...)
-	for n == 1024 {
-		time.Sleep(10 * time.Millisecond)
-		n, err = conn.Read(buffer)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read from tcp connection: %s", err.Error())
-		}
-		result = append(result, buffer[:n]...)
-	}
-	return result, nil
-}
-
-func sendInterested(conn net.Conn) ([]byte, error) {
-	message := []byte{}
-	message = binary.BigEndian.AppendUint32(message, uint32(1))
-	message = append(message, byte(2))
-	_, err := conn.Write(message)
-	if err != nil {
-		return nil, fmt.Errorf("failed to write interested message")
-	}
-
-	return waitForNextMessage(conn)
-}
-
-func sendMessageAndWaitForResponse(conn net.Conn, message []byte) ([]byte, error) {
-	_, err := conn.Write(message)
-	if err != nil {
-		return nil, fmt.Errorf("failed to write interested message")
-	}
-
-	return waitForNextMessage(conn)
-}
-
-func parseMessage(message []byte) (byte, []byte) {
-	length := binary.BigEndian.Uint32(message[:4])
-	id := message[4]
-	rest := []byte{}
-	if length > 1 {
-		rest = message[5:]
-	}
-	return id, rest
+// downloadOptions are the options of the download and magnet_download
+// commands.
+type downloadOptions struct {
+	// number of block requests kept in flight per peer
+	queueDepth int
+	// endgame requests the last pieces from several peers at once
+	endgame bool
 }
 
-func parsePieceMessage(message []byte) (byte, uint32, uint32, []byte) {
-	length := binary.BigEndian.Uint32(message[:4])
-	id := message[4]
-	index := binary.BigEndian.Uint32(message[5:9])
-	begin := binary.BigEndian.Uint32(message[9:13])
-	block := []byte{}
-	if length > 1 {
-		block = message[13:]
-	}
-	return id, index, begin, block
+func (o downloadOptions) apply(di *downloadInfo) {
+	di.requestQueueDepth = o.queueDepth
+	di.endgame = o.endgame
 }
 
-func createRequestMessage(index, begin, length int) []byte {
-	message := []byte{}
-	message = binary.BigEndian.AppendUint32(message, uint32(13))
-	message = append(message, byte(6))
-	message = binary.BigEndian.AppendUint32(message, uint32(index))
-	message = binary.BigEndian.AppendUint32(message, uint32(begin))
-	message = binary.BigEndian.AppendUint32(message, uint32(length))
-	return message
-}
+// parseDownloadArgs parses the arguments of the download and magnet_download
+// commands, -o <target> followed by the torrent or magnet link, with the
+// options anywhere in between.
+func parseDownloadArgs(command string, args []string) (string, string, downloadOptions, error) {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	output := flags.String("o", "", "write the download to this path")
+	queueDepth := flags.Int("queue-depth", defaultRequestQueueDepth, "number of block requests kept in flight per peer")
+	noEndgame := flags.Bool("no-endgame", false, "do not request the last pieces from several peers at once")
 
-func downloadFile(downloadTarget, file string) error {
-	contents, err := readFile(file)
-	if err != nil {
-		return fmt.Errorf("error reading file: %s", err.Error())
+	// flag stops at the first argument that is not a flag, so pick those up
+	// one at a time
+	positional := []string{}
+	for {
+		if err := flags.Parse(args); err != nil {
+			return "", "", downloadOptions{}, err
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
 	}
-
-	fmt.Println(string(contents))
-	decoded, _, err := decodeBencode(contents)
-	if err != nil {
-		return err
+	if *output == "" || len(positional) != 1 {
+		return "", "", downloadOptions{}, fmt.Errorf("usage: %s -o <target> [--queue-depth N] [--no-endgame] <source>", command)
 	}
-
-	dict, ok := decoded.(map[string]any)
-	if !ok {
-		return fmt.Errorf("invalid bencode")
+	if *queueDepth <= 0 {
+		return "", "", downloadOptions{}, fmt.Errorf("queue depth must be positive: %d", *queueDepth)
 	}
 
-	baseUrl := dict["announce"].(string)
-	info := dict["info"].(map[string]any)
-	fileLength := info["length"].(int)
-	pieceLength := info["piece length"].(int)
-	pieces := info["pieces"].(string)
-	hashByIndex := calcPieceHashes(pieces)
-	numOfPieces := len(hashByIndex)
-	fmt.Println("number of pieces:", numOfPieces)
+	return *output, positional[0], downloadOptions{queueDepth: *queueDepth, endgame: !*noEndgame}, nil
+}
 
-	infoHashBytes, err := getInfoHash(info)
+func downloadFile(downloadTarget, file string, options downloadOptions) error {
+	m, err := loadMetainfo(file, false)
 	if err != nil {
 		return err
 	}
 
-	responseBodyBytes, err := sendRequest(baseUrl, infoHashBytes, fileLength)
+	peers, err := requestPeersFromTiers(m.trackerTiers(), m.InfoHash[:], m.Info.TotalLength())
 	if err != nil {
-		return fmt.Errorf("error reading response body: %s", err.Error())
+		return fmt.Errorf("error requesting peers from tracker: %s", err.Error())
 	}
-
-	resp, _, err := decodeBencode(responseBodyBytes)
-	if err != nil {
-		return fmt.Errorf("error failed to decoded response: %s", err.Error())
-	}
-
-	respDict := resp.(map[string]any)
-	peers := getPeers(respDict)
 	if len(peers) < 1 {
 		return fmt.Errorf("did not receive enough peers")
 	}
 
-	workers := make([]pieceDownloader, len(peers))
-	fmt.Println("creating", len(peers), "workers")
-	for i, p := range peers {
-		workers[i] = pieceDownloader{
-			peerConnectionString: p,
-			infoHashBytes:        infoHashBytes,
-			fileLength:           fileLength,
-			pieceLength:          pieceLength,
-			pieceHashesByIndex:   hashByIndex,
-		}
-	}
-
-	// comms channels
-	results := make(chan downloadedPiece, numOfPieces)
-	outrightFailures := make(chan int, numOfPieces)
-	piecesToDownload := make(chan pieceToDownload, numOfPieces)
-
-	// start workers
-	fmt.Println("starting workers...")
-	var pieceDownloaderWaitGroup sync.WaitGroup
-	cleanup := sync.OnceFunc(func() {
-		close(results)
-		close(outrightFailures)
-	})
-	for _, w := range workers {
-		pieceDownloaderWaitGroup.Add(1)
-		go func() {
-			defer pieceDownloaderWaitGroup.Done()
-			for downloadedablePiece := range piecesToDownload {
-				fmt.Println("downloading piece index", downloadedablePiece.pieceIndex)
-				pieceIndex := downloadedablePiece.pieceIndex
-				pieceBytes, err := w.Download(pieceIndex)
-				if err != nil {
-					fmt.Printf("failed to download piece index %d, reinserting to queue: %s\n", pieceIndex, err.Error())
-					if downloadedablePiece.attempt <= 10 {
-						// time.Sleep(100 * time.Millisecond)
-						piecesToDownload <- pieceToDownload{
-							pieceIndex: pieceIndex,
-							attempt:    downloadedablePiece.attempt + 1,
-						}
-					} else {
-						outrightFailures <- pieceIndex
-					}
-				} else {
-					fmt.Println("downloaded piece index", pieceIndex)
-					results <- downloadedPiece{
-						pieceIndex: pieceIndex,
-						piece:      pieceBytes,
-					}
-				}
-			}
-			cleanup()
-		}()
-	}
-
-	// seed queue
-	fmt.Println("seeding pieces to download queue", len(hashByIndex))
-	for pieceIndex := range hashByIndex {
-		fmt.Println("seeding piece index", pieceIndex)
-		piecesToDownload <- pieceToDownload{
-			pieceIndex: pieceIndex,
-			attempt:    1,
-		}
-	}
-
-	// collect results from workers
-	fmt.Println("collecting results from workers")
-	downloadedFilePieces := make(map[int][]byte)
-	failedFilePieces := make(map[int]any)
-	for len(downloadedFilePieces)+len(failedFilePieces) < len(hashByIndex) {
-		select {
-		case dp := <-results:
-			downloadedFilePieces[dp.pieceIndex] = dp.piece
-		case fp := <-outrightFailures:
-			failedFilePieces[fp] = nil
-		}
-	}
-
-	// stop workers
-	fmt.Println("waiting for workers to finish...")
-	close(piecesToDownload)
-	pieceDownloaderWaitGroup.Wait()
-	fmt.Println("workers finished. Checking results...")
-
-	// if any pice persistently failed, then fail
-	if len(failedFilePieces) > 0 {
-		return fmt.Errorf("failed to download one or more pieces: %d", len(failedFilePieces))
-	}
-
-	// collect pieces into file
-	fmt.Println("all pieces downloaded and hashes checked, piecing together file")
-	fileBytes := []byte{}
-	for pieceIndex := 0; pieceIndex < numOfPieces; pieceIndex++ {
-		piece, ok := downloadedFilePieces[pieceIndex]
-		if !ok {
-			return fmt.Errorf("missing download piece! %d", pieceIndex)
-		}
-		fileBytes = append(fileBytes, piece...)
+	di := downloadInfo{
+		infoHashBytes:      m.InfoHash[:],
+		name:               m.Info.Name,
+		files:              m.Info.Files,
+		multiFile:          m.Info.MultiFile,
+		fileLength:         m.Info.TotalLength(),
+		pieceLength:        m.Info.PieceLength,
+		pieceHashesByIndex: m.Info.pieceHashesByIndex(),
 	}
+	options.apply(&di)
 
-	// write file
-	fmt.Println("writing file")
-	if err = os.WriteFile(downloadTarget, fileBytes, 0666); err != nil {
-		return fmt.Errorf("failed to open temp file to write file: %s", err.Error())
+	if err = downloadFileUsingWorkers(downloadTarget, peers, di); err != nil {
+		return err
 	}
 
 	fmt.Println("successfully wrote file. Finished")
@@ -849,14 +681,27 @@ func downloadFile(downloadTarget, file string) error {
 type pieceDownloader struct {
 	peerConnectionString string
 	infoHashBytes        []byte
-	fileLength           int
+	fileLength           int64
 	pieceLength          int
 	pieceHashesByIndex   map[int]string
+	requestQueueDepth    int
+	// how long the worker waits on a peer it has nothing to request from
+	// before sending a keep-alive, keepAliveInterval when zero
+	keepAliveInterval time.Duration
+	picker            *piecePicker
+	session           *peerSession
+
+	mu          sync.Mutex
+	interrupted bool
 }
 
+// number of times in a row we try to reach a peer before giving up on it
+const maxPeerConnectAttempts = 3
+
 type pieceToDownload struct {
 	pieceIndex int
 	attempt    int
+	partial    *partialPiece
 }
 
 type downloadedPiece struct {
@@ -864,77 +709,154 @@ type downloadedPiece struct {
 	piece      []byte
 }
 
-func (p pieceDownloader) Download(pieceIndex int) ([]byte, error) {
-	peer := p.peerConnectionString
-	hs := handshake{
-		infoHash: p.infoHashBytes,
-		peerID:   createRandomID(),
-	}
+// Download fetches a single piece from the peer, reusing the connection from
+// previous calls. A connection that failed is dropped and the next call
+// reconnects.
+func (p *pieceDownloader) Download(pieceIndex int) ([]byte, error) {
+	actualPieceLength := getPieceLengthForIndex(p.fileLength, p.pieceLength, pieceIndex)
+	return p.downloadPartial(pieceIndex, newPartialPiece(actualPieceLength))
+}
 
-	conn, err := net.Dial("tcp", peer)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect via tcp to peer: %s", err.Error())
+// downloadPartial fetches the blocks of the piece that are still missing
+// from partial.
+func (p *pieceDownloader) downloadPartial(pieceIndex int, partial *partialPiece) ([]byte, error) {
+	if err := p.connect(); err != nil {
+		return nil, err
 	}
-	defer conn.Close()
 
-	_, err = doHandshakeOnConnection(conn, &hs)
+	actualPieceLength := getPieceLengthForIndex(p.fileLength, p.pieceLength, pieceIndex)
+	expectedHash := p.pieceHashesByIndex[pieceIndex]
+	downloadedPiece, err := p.session.downloadPiece(pieceIndex, actualPieceLength, expectedHash, partial)
 	if err != nil {
-		return nil, fmt.Errorf("failed to do handshake with peer: %s", err.Error())
+		p.close()
+		return nil, err
 	}
 
-	response, err := waitForNextMessage(conn)
-	if err != nil {
-		return nil, fmt.Errorf("failed wait for new message: %s", err.Error())
+	fmt.Println(pieceIndex, ":", time.Now().Format(time.RFC3339), "eHash", expectedHash)
+	return downloadedPiece, nil
+}
+
+func (p *pieceDownloader) connect() error {
+	if p.session != nil {
+		return nil
 	}
-	_, _ = parseMessage(response)
 
-	response, err = sendInterested(conn)
+	session, err := newPeerSession(p.peerConnectionString, p.infoHashBytes, len(p.pieceHashesByIndex))
 	if err != nil {
-		return nil, fmt.Errorf("failed send interested message: %s", err.Error())
+		return err
+	}
+	if p.requestQueueDepth > 0 {
+		session.setRequestQueueDepth(p.requestQueueDepth)
+	}
+	if p.keepAliveInterval > 0 {
+		session.keepAliveInterval = p.keepAliveInterval
+	}
+	if p.picker != nil {
+		session.onHave = p.picker.peerHasPiece
 	}
-	_, _ = parseMessage(response)
 
-	actualPieceLength := getPieceLengthForIndex(p.fileLength, p.pieceLength, pieceIndex)
-	expectedBlocks := calcExpectedBlocks(actualPieceLength)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.interrupted {
+		session.close()
+		return fmt.Errorf("downloader was interrupted")
+	}
+	p.session = session
+	return nil
+}
 
-	currentOffset := 0
-	blocks := [][]byte{}
-	for i := 0; i < expectedBlocks; i++ {
-		requestLength := int(math.Min(float64(sixteenKilobytes), float64(actualPieceLength-currentOffset)))
-		message := createRequestMessage(pieceIndex, currentOffset, requestLength)
+// run downloads the pieces the picker hands out for this peer until the picker
+// is closed or the peer cannot be reached anymore.
+func (p *pieceDownloader) run(results chan<- downloadedPiece, outrightFailures chan<- int) {
+	connectFailures := 0
+	for !p.picker.isClosed() {
+		if err := p.connect(); err != nil {
+			connectFailures++
+			if connectFailures >= maxPeerConnectAttempts {
+				fmt.Printf("giving up on peer %s: %s\n", p.peerConnectionString, err.Error())
+				return
+			}
+			continue
+		}
+		connectFailures = 0
 
-		_, err := conn.Write(message)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read response after request message: %s", err.Error())
+		// taken before pop, so that a change in between is not missed
+		wake := p.picker.updated()
+		downloadedablePiece, ok := p.picker.pop(p.session.hasPiece)
+		if !ok {
+			// the peer has none of the pieces we still need, wait for it to
+			// announce more or for the picker to have more to hand out
+			if err := p.session.waitIdle(wake); err != nil {
+				p.close()
+			}
+			continue
 		}
 
-		resp, err := readExactLength(conn, requestLength+13)
+		pieceIndex := downloadedablePiece.pieceIndex
+		partial := downloadedablePiece.partial
+
+		fmt.Println("downloading piece index", pieceIndex, "from", p.peerConnectionString)
+		pieceBytes, err := p.downloadPartial(pieceIndex, partial)
+		if err == errPieceDownloadedElsewhere {
+			p.picker.release(downloadedablePiece)
+			continue
+		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to read piece message: %s", err.Error())
+			if !p.picker.release(downloadedablePiece) {
+				fmt.Printf("failed to download piece index %d, left to other peers: %s\n", pieceIndex, err.Error())
+				continue
+			}
+			fmt.Printf("failed to download piece index %d, reinserting to queue: %s\n", pieceIndex, err.Error())
+			if downloadedablePiece.attempt <= 10 {
+				retry := pieceToDownload{
+					pieceIndex: pieceIndex,
+					attempt:    downloadedablePiece.attempt + 1,
+				}
+				if partial.receivedBlocks() > 0 {
+					retry.partial = partial
+				}
+				p.picker.push(retry)
+			} else {
+				outrightFailures <- pieceIndex
+			}
+			continue
 		}
 
-		_, _, _, block := parsePieceMessage(resp)
-		blocks = append(blocks, block)
-		currentOffset += requestLength
+		if !p.picker.pieceCompleted(pieceIndex) {
+			continue
+		}
+		fmt.Println("downloaded piece index", pieceIndex)
+		results <- downloadedPiece{
+			pieceIndex: pieceIndex,
+			piece:      pieceBytes,
+		}
 	}
+}
 
-	downloadedPiece := []byte{}
-	for _, b := range blocks {
-		downloadedPiece = append(downloadedPiece, b...)
+// interrupt unblocks a worker that is waiting on its peer. It is safe to call
+// from another goroutine.
+func (p *pieceDownloader) interrupt() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.interrupted = true
+	if p.session != nil {
+		p.session.close()
 	}
+}
 
-	pieceHash, err := hashBytesNew(downloadedPiece)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate hash for new piece")
-	}
+func (p *pieceDownloader) close() {
+	if p.session != nil {
+		if p.picker != nil {
+			for _, pieceIndex := range p.session.pieces() {
+				p.picker.peerLostPiece(pieceIndex)
+			}
+		}
 
-	expectedHash := p.pieceHashesByIndex[pieceIndex]
-	fmt.Println(pieceIndex, ":", time.Now().Format(time.RFC3339), "eHash", expectedHash)
-	fmt.Println(pieceIndex, ":", time.Now().Format(time.RFC3339), "aHash", pieceHash)
-	if pieceHash != expectedHash {
-		return nil, fmt.Errorf("piece hash did not match hash in torrent file. actual: %s, expected: %s", pieceHash, expectedHash)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.session.close()
+		p.session = nil
 	}
-	return downloadedPiece, nil
 }
 
 func magnet_parse(link string) error {
@@ -956,7 +878,7 @@ func parseMagnetLink(link string) (*magnetLinkData, error) {
 	query := magnetUrl.Query()
 	xt := query.Get("xt")
 	dn := query.Get("dn")
-	tr := query.Get("tr")
+	trs := query["tr"]
 
 	if !strings.HasPrefix(xt, "urn:btih:") {
 		return nil, fmt.Errorf("unexpected magnet url type. Missing urn:bith")
@@ -964,17 +886,39 @@ func parseMagnetLink(link string) (*magnetLinkData, error) {
 
 	infoHash := xt[9:]
 
+	trackerURL := ""
+	if len(trs) > 0 {
+		trackerURL = trs[0]
+	}
+
+	// every tracker gets a tier of its own, so that all of them are asked
+	// for peers
+	tiers := [][]string{}
+	for _, tracker := range trs {
+		tiers = append(tiers, []string{tracker})
+	}
+
 	return &magnetLinkData{
-		trackerURL: tr,
-		fileName:   dn,
-		infoHash:   infoHash,
+		trackerURL:  trackerURL,
+		trackerURLs: trs,
+		fileName:    dn,
+		infoHash:    infoHash,
+		trackers:    newAnnounceTiers(tiers),
 	}, nil
 }
 
 type magnetLinkData struct {
-	trackerURL string
-	fileName   string
-	infoHash   string
+	trackerURL  string
+	trackerURLs []string
+	fileName    string
+	infoHash    string
+	trackers    *announceTiers
+}
+
+// trackerTiers returns the tiers of the trackers of the magnet link, one
+// tracker per tier.
+func (m *magnetLinkData) trackerTiers() *announceTiers {
+	return m.trackers
 }
 
 func magnet_handshake(link string) error {
@@ -988,18 +932,10 @@ func magnet_handshake(link string) error {
 		return fmt.Errorf("failed to decode info hash: %s", err.Error())
 	}
 
-	responseBodyBytes, err := sendRequest(data.trackerURL, infoHashBytes, 999)
+	peers, err := requestPeersFromTiers(data.trackerTiers(), infoHashBytes, 999)
 	if err != nil {
-		return fmt.Errorf("error reading response body: %s", err.Error())
+		return fmt.Errorf("error requesting peers from tracker: %s", err.Error())
 	}
-
-	resp, _, err := decodeBencode(responseBodyBytes)
-	if err != nil {
-		return fmt.Errorf("error failed to decoded response: %s", err.Error())
-	}
-
-	respDict := resp.(map[string]any)
-	peers := getPeers(respDict)
 	if len(peers) < 1 {
 		return fmt.Errorf("did not receive enough peers")
 	}
@@ -1035,22 +971,12 @@ func magnet_handshake(link string) error {
 		}
 		// fmt.Println("peer supports extensions")
 
-		fmt.Println("reading bitfield message")
-		response, err := readOneResponse(conn)
+		fmt.Println("waiting for extension handshake")
+		reader := newMessageReader(conn)
+		payload, err := reader.readExtendedMessage(0)
 		if err != nil {
-			return fmt.Errorf("failed wait for bitfield message: %s", err.Error())
+			return fmt.Errorf("failed to read extension handshake: %s", err.Error())
 		}
-
-		id, _ := parseMessage(response)
-		fmt.Println("received message with id:", id)
-
-		fmt.Println("waiting for extension handshake?")
-		extensionHandshakeMessage, err := readOneResponse(conn)
-		if err != nil {
-			return fmt.Errorf("failed to read extension handshake")
-		}
-
-		payload := extractPayloadFromExtensionHandshakeMessage(extensionHandshakeMessage)
 		decodedPayload, _, err := decodeBencode(payload)
 		if err != nil {
 			return fmt.Errorf("failed to decode payload: %s", err.Error())
@@ -1059,8 +985,14 @@ func magnet_handshake(link string) error {
 		jsonBytes, err := json.Marshal(decodedPayload)
 		fmt.Println("extension payload:", string(jsonBytes))
 
-		m := decodedPayload.(map[string]any)["m"]
-		utMetadata := m.(map[string]any)["ut_metadata"].(int)
+		var extHandshake extensionHandshake
+		if err := Unmarshal(payload, &extHandshake); err != nil {
+			return fmt.Errorf("failed to decode extension handshake: %s", err.Error())
+		}
+		utMetadata, ok := extHandshake.M["ut_metadata"]
+		if !ok {
+			return fmt.Errorf("peer does not support metadata exchange")
+		}
 
 		fmt.Println("Peer Metadata Extension ID:", utMetadata)
 
@@ -1083,12 +1015,10 @@ func magnet_handshake(link string) error {
 func createExtensionMessage() ([]byte, error) {
 	length := uint32(2) // includes id, and extension message id
 
-	payload := map[string]any{
-		"m": map[string]any{
-			"ut_metadata": ourMetadataExtensionId,
-		},
+	payload := extensionHandshake{
+		M: map[string]int{"ut_metadata": ourMetadataExtensionId},
 	}
-	encoded, err := encodeBencode(payload)
+	encoded, err := Marshal(payload)
 	if err != nil {
 		return nil, fmt.Errorf("failed to bencode extension payload: %s", err.Error())
 	}
@@ -1109,12 +1039,9 @@ func createExtensionMessage() ([]byte, error) {
 func createRequestMetadataMessage(id int) ([]byte, error) {
 	length := uint32(2) // peer message id and metadata id from peer
 
-	requestMessage := map[string]any{
-		"msg_type": 0,
-		"piece":    0,
-	}
+	requestMessage := metadataMessage{MsgType: 0, Piece: 0}
 
-	encoded, err := encodeBencode(requestMessage)
+	encoded, err := Marshal(requestMessage)
 	if err != nil {
 		return nil, fmt.Errorf("failed to encoded request message: %s", err.Error())
 	}
@@ -1130,43 +1057,30 @@ func createRequestMetadataMessage(id int) ([]byte, error) {
 	return message, nil
 }
 
-func sendMessageAndReadExactResponse(conn net.Conn, message []byte) ([]byte, error) {
-	_, err := conn.Write(message)
+// parseMetadata reads the info dictionary from a ut_metadata data message of
+// BEP 9. The metadata comes from a peer, so it has to hash to the info hash
+// of the magnet link before it is used at all, and is then validated like
+// the info dictionary of a torrent file.
+func parseMetadata(payload, infoHash []byte) (InfoDict, error) {
+	_, index, err := decodeBencode(payload)
 	if err != nil {
-		return nil, fmt.Errorf("failed to write interested message")
+		return InfoDict{}, fmt.Errorf("failed to decode payload: %s", err.Error())
 	}
+	rawInfo := payload[index:]
 
-	return readOneResponse(conn)
-}
-
-func readOneResponse(conn net.Conn) ([]byte, error) {
-	buffer := make([]byte, 4)
-	n, err := conn.Read(buffer)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read length from tcp connection: %s", err.Error())
+	if hash := sha1.Sum(rawInfo); !bytes.Equal(hash[:], infoHash) {
+		return InfoDict{}, fmt.Errorf("metadata hash %x does not match the info hash %x", hash, infoHash)
 	}
 
-	if n != 4 {
-		return nil, fmt.Errorf("failed to read message length from connection: %s", err.Error())
-	}
-
-	fmt.Println(buffer)
-
-	length := binary.BigEndian.Uint32(buffer)
-	fmt.Println("need to read", length, "bytes for message")
-
-	result, err := readExactLength(conn, int(length))
+	decoded, err := decodeStrict(rawInfo)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read length given at beginning of message: %s", err.Error())
+		return InfoDict{}, fmt.Errorf("failed to decode metadata: %s", err.Error())
 	}
-
-	return append(buffer, result...), nil
-}
-
-func extractPayloadFromExtensionHandshakeMessage(message []byte) []byte {
-	// message len = 4 bytes + message id = 1 byte + extension message id = 1 byte
-	preambleLength := 4 + 1 + 1
-	return message[preambleLength:]
+	info, ok := decoded.(map[string]any)
+	if !ok {
+		return InfoDict{}, fmt.Errorf("metadata is not a dictionary")
+	}
+	return parseInfoDict(info)
 }
 
 func magnet_info(link string) error {
@@ -1180,18 +1094,10 @@ func magnet_info(link string) error {
 		return fmt.Errorf("failed to decode info hash: %s", err.Error())
 	}
 
-	responseBodyBytes, err := sendRequest(data.trackerURL, infoHashBytes, 999)
-	if err != nil {
-		return fmt.Errorf("error reading response body: %s", err.Error())
-	}
-
-	resp, _, err := decodeBencode(responseBodyBytes)
+	peers, err := requestPeersFromTiers(data.trackerTiers(), infoHashBytes, 999)
 	if err != nil {
-		return fmt.Errorf("error failed to decoded response: %s", err.Error())
+		return fmt.Errorf("error requesting peers from tracker: %s", err.Error())
 	}
-
-	respDict := resp.(map[string]any)
-	peers := getPeers(respDict)
 	if len(peers) < 1 {
 		return fmt.Errorf("did not receive enough peers")
 	}
@@ -1225,27 +1131,20 @@ func magnet_info(link string) error {
 			continue
 		}
 
-		response, err := readOneResponse(conn)
+		reader := newMessageReader(conn)
+		payload, err := reader.readExtendedMessage(0)
 		if err != nil {
-			return fmt.Errorf("failed wait for bitfield message: %s", err.Error())
+			return fmt.Errorf("failed to read extension handshake: %s", err.Error())
 		}
-
-		parseMessage(response)
-
-		extensionHandshakeMessage, err := readOneResponse(conn)
-		if err != nil {
-			return fmt.Errorf("failed to read extension handshake")
+		var extHandshake extensionHandshake
+		if err := Unmarshal(payload, &extHandshake); err != nil {
+			return fmt.Errorf("failed to decode extension handshake: %s", err.Error())
 		}
-
-		payload := extractPayloadFromExtensionHandshakeMessage(extensionHandshakeMessage)
-		decodedPayload, _, err := decodeBencode(payload)
-		if err != nil {
-			return fmt.Errorf("failed to decode payload: %s", err.Error())
+		utMetadata, ok := extHandshake.M["ut_metadata"]
+		if !ok {
+			return fmt.Errorf("peer does not support metadata exchange")
 		}
 
-		m := decodedPayload.(map[string]any)["m"]
-		utMetadata := m.(map[string]any)["ut_metadata"].(int)
-
 		message, err := createExtensionMessage()
 		if err != nil {
 			return fmt.Errorf("failed to create extension message: %s", err.Error())
@@ -1266,39 +1165,22 @@ func magnet_info(link string) error {
 			return fmt.Errorf("failed to write create metadata message to connection: %s", err.Error())
 		}
 
-		response, err = readOneResponse(conn)
+		payload, err = reader.readExtendedMessage(ourMetadataExtensionId)
 		if err != nil {
-			return fmt.Errorf("failed to read extension message from connection: %s", err.Error())
+			return fmt.Errorf("failed to read metadata message from connection: %s", err.Error())
 		}
-
-		payload = extractPayloadFromExtensionHandshakeMessage(response)
-		decodedPayload, index, err := decodeBencode(payload)
-		if err != nil {
-			return fmt.Errorf("failed to decode payload: %s", err.Error())
-		}
-
-		metaDataPieceContents, _, err := decodeBencode(payload[index:])
+		info, err := parseMetadata(payload, infoHashBytes)
 		if err != nil {
-			return fmt.Errorf("failed to decode payload: %s", err.Error())
-		}
-
-		h := sha1.New()
-		h.Write(payload[index:])
-		hash := hex.EncodeToString(h.Sum(nil))
-
-		pieces := metaDataPieceContents.(map[string]any)["pieces"].(string)
-		hashes := []string{}
-		for cur := 0; cur < len(pieces); cur += 20 {
-			hashes = append(hashes, hex.EncodeToString([]byte(pieces[cur:cur+20])))
+			return fmt.Errorf("invalid metadata from peer: %s", err.Error())
 		}
 
 		fmt.Println("Tracker URL:", data.trackerURL)
-		fmt.Println("Length:", metaDataPieceContents.(map[string]any)["length"].(int))
-		fmt.Println("Info Hash:", hash)
-		fmt.Println("Piece Length:", metaDataPieceContents.(map[string]any)["piece length"].(int))
+		fmt.Println("Length:", info.TotalLength())
+		fmt.Println("Info Hash:", data.infoHash)
+		fmt.Println("Piece Length:", info.PieceLength)
 		fmt.Println("Piece Hashes:")
-		for _, h := range hashes {
-			fmt.Println(h)
+		for _, h := range info.PieceHashes() {
+			fmt.Println(hex.EncodeToString(h[:]))
 		}
 		break
 	}
@@ -1316,18 +1198,10 @@ func magnet_download_piece(target, link string, pieceIndex int) error {
 		return fmt.Errorf("failed to decode info hash: %s", err.Error())
 	}
 
-	responseBodyBytes, err := sendRequest(data.trackerURL, infoHashBytes, 999)
-	if err != nil {
-		return fmt.Errorf("error reading response body: %s", err.Error())
-	}
-
-	resp, _, err := decodeBencode(responseBodyBytes)
+	peers, err := requestPeersFromTiers(data.trackerTiers(), infoHashBytes, 999)
 	if err != nil {
-		return fmt.Errorf("error failed to decoded response: %s", err.Error())
+		return fmt.Errorf("error requesting peers from tracker: %s", err.Error())
 	}
-
-	respDict := resp.(map[string]any)
-	peers := getPeers(respDict)
 	if len(peers) < 1 {
 		return fmt.Errorf("did not receive enough peers")
 	}
@@ -1356,27 +1230,20 @@ func magnet_download_piece(target, link string, pieceIndex int) error {
 			continue
 		}
 
-		response, err := readOneResponse(conn)
+		reader := newMessageReader(conn)
+		payload, err := reader.readExtendedMessage(0)
 		if err != nil {
-			return fmt.Errorf("failed wait for bitfield message: %s", err.Error())
+			return fmt.Errorf("failed to read extension handshake: %s", err.Error())
 		}
-
-		parseMessage(response)
-
-		extensionHandshakeMessage, err := readOneResponse(conn)
-		if err != nil {
-			return fmt.Errorf("failed to read extension handshake")
+		var extHandshake extensionHandshake
+		if err := Unmarshal(payload, &extHandshake); err != nil {
+			return fmt.Errorf("failed to decode extension handshake: %s", err.Error())
 		}
-
-		payload := extractPayloadFromExtensionHandshakeMessage(extensionHandshakeMessage)
-		decodedPayload, _, err := decodeBencode(payload)
-		if err != nil {
-			return fmt.Errorf("failed to decode payload: %s", err.Error())
+		utMetadata, ok := extHandshake.M["ut_metadata"]
+		if !ok {
+			return fmt.Errorf("peer does not support metadata exchange")
 		}
 
-		m := decodedPayload.(map[string]any)["m"]
-		utMetadata := m.(map[string]any)["ut_metadata"].(int)
-
 		message, err := createExtensionMessage()
 		if err != nil {
 			return fmt.Errorf("failed to create extension message: %s", err.Error())
@@ -1397,44 +1264,33 @@ func magnet_download_piece(target, link string, pieceIndex int) error {
 			return fmt.Errorf("failed to write create metadata message to connection: %s", err.Error())
 		}
 
-		response, err = readOneResponse(conn)
+		payload, err = reader.readExtendedMessage(ourMetadataExtensionId)
 		if err != nil {
-			return fmt.Errorf("failed to read extension message from connection: %s", err.Error())
+			return fmt.Errorf("failed to read metadata message from connection: %s", err.Error())
 		}
-
-		payload = extractPayloadFromExtensionHandshakeMessage(response)
-		decodedPayload, index, err := decodeBencode(payload)
+		info, err := parseMetadata(payload, infoHashBytes)
 		if err != nil {
-			return fmt.Errorf("failed to decode payload: %s", err.Error())
+			return fmt.Errorf("invalid metadata from peer: %s", err.Error())
 		}
-
-		metaDataPieceContents, _, err := decodeBencode(payload[index:])
-		if err != nil {
-			return fmt.Errorf("failed to decode payload: %s", err.Error())
+		if pieceIndex < 0 || pieceIndex >= info.PieceCount() {
+			return fmt.Errorf("piece index %d is out of range, the torrent has %d pieces", pieceIndex, info.PieceCount())
 		}
 
-		// h := sha1.New()
-		// h.Write(payload[index:])
-		// checkInfoHashBytes := h.Sum(nil)
-		// if checkInfoHashBytes
-
-		pieces := metaDataPieceContents.(map[string]any)["pieces"].(string)
-		pieceHashesByIndex := calcPieceHashes(pieces)
-
 		pd = pieceDownloader{
 			peerConnectionString: peer,
 			infoHashBytes:        infoHashBytes,
-			fileLength:           metaDataPieceContents.(map[string]any)["length"].(int),
-			pieceLength:          metaDataPieceContents.(map[string]any)["piece length"].(int),
-			pieceHashesByIndex:   pieceHashesByIndex,
+			fileLength:           info.TotalLength(),
+			pieceLength:          info.PieceLength,
+			pieceHashesByIndex:   info.pieceHashesByIndex(),
 		}
 
 		break
 	}
 
 	piece, err := pd.Download(pieceIndex)
+	pd.close()
 	if err != nil {
-		fmt.Errorf("failed to download piece from peer: %s", err.Error())
+		return fmt.Errorf("failed to download piece from peer: %s", err.Error())
 	}
 
 	fmt.Println("writing file")
@@ -1447,14 +1303,18 @@ func magnet_download_piece(target, link string, pieceIndex int) error {
 
 type downloadInfo struct {
 	infoHashBytes      []byte
-	fileLength         int
+	name               string
+	files              []torrentFile
+	multiFile          bool
+	fileLength         int64
 	pieceLength        int
 	pieceHashesByIndex map[int]string
+	requestQueueDepth  int
+	// endgame requests the last pieces from several peers at once
+	endgame bool
 }
 
 func getDownloadInfoThroughMetadataFromPeers(peers []string, infoHashBytes []byte) (downloadInfo, error) {
-	numOfPiecesInFile := 0
-	var di *downloadInfo = nil
 	for _, peer := range peers {
 		hs := handshake{
 			infoHash:          infoHashBytes,
@@ -1478,27 +1338,20 @@ func getDownloadInfoThroughMetadataFromPeers(peers []string, infoHashBytes []byt
 			continue
 		}
 
-		response, err := readOneResponse(conn)
+		reader := newMessageReader(conn)
+		payload, err := reader.readExtendedMessage(0)
 		if err != nil {
-			return downloadInfo{}, fmt.Errorf("failed wait for bitfield message: %s", err.Error())
+			return downloadInfo{}, fmt.Errorf("failed to read extension handshake: %s", err.Error())
 		}
-
-		parseMessage(response)
-
-		extensionHandshakeMessage, err := readOneResponse(conn)
-		if err != nil {
-			return downloadInfo{}, fmt.Errorf("failed to read extension handshake")
+		var extHandshake extensionHandshake
+		if err := Unmarshal(payload, &extHandshake); err != nil {
+			return downloadInfo{}, fmt.Errorf("failed to decode extension handshake: %s", err.Error())
 		}
-
-		payload := extractPayloadFromExtensionHandshakeMessage(extensionHandshakeMessage)
-		decodedPayload, _, err := decodeBencode(payload)
-		if err != nil {
-			return downloadInfo{}, fmt.Errorf("failed to decode payload: %s", err.Error())
+		utMetadata, ok := extHandshake.M["ut_metadata"]
+		if !ok {
+			return downloadInfo{}, fmt.Errorf("peer does not support metadata exchange")
 		}
 
-		m := decodedPayload.(map[string]any)["m"]
-		utMetadata := m.(map[string]any)["ut_metadata"].(int)
-
 		message, err := createExtensionMessage()
 		if err != nil {
 			return downloadInfo{}, fmt.Errorf("failed to create extension message: %s", err.Error())
@@ -1519,64 +1372,30 @@ func getDownloadInfoThroughMetadataFromPeers(peers []string, infoHashBytes []byt
 			return downloadInfo{}, fmt.Errorf("failed to write create metadata message to connection: %s", err.Error())
 		}
 
-		response, err = readOneResponse(conn)
+		payload, err = reader.readExtendedMessage(ourMetadataExtensionId)
 		if err != nil {
-			return downloadInfo{}, fmt.Errorf("failed to read extension message from connection: %s", err.Error())
+			return downloadInfo{}, fmt.Errorf("failed to read metadata message from connection: %s", err.Error())
 		}
-
-		payload = extractPayloadFromExtensionHandshakeMessage(response)
-		decodedPayload, index, err := decodeBencode(payload)
+		info, err := parseMetadata(payload, infoHashBytes)
 		if err != nil {
-			return downloadInfo{}, fmt.Errorf("failed to decode payload: %s", err.Error())
-		}
-
-		metaDataPieceContents, _, err := decodeBencode(payload[index:])
-		if err != nil {
-			return downloadInfo{}, fmt.Errorf("failed to decode payload: %s", err.Error())
-		}
-
-		// we could verify the hash and fail here but not _really_ necessary right now, so leaving it.
-		// h := sha1.New()
-		// h.Write(payload[index:])
-		// checkInfoHashBytes := h.Sum(nil)
-		// if checkInfoHashBytes
-
-		pieces := metaDataPieceContents.(map[string]any)["pieces"].(string)
-		pieceHashesByIndex := calcPieceHashes(pieces)
-
-		fileLength := metaDataPieceContents.(map[string]any)["length"].(int)
-		pieceLength := metaDataPieceContents.(map[string]any)["piece length"].(int)
-		numOfPiecesInFile = fileLength / pieceLength
-		if fileLength%pieceLength > 0 {
-			numOfPiecesInFile++
-		}
-		fmt.Println("num of pieces in file:", numOfPiecesInFile)
-
-		if di == nil {
-			di = &downloadInfo{
-				infoHashBytes:      infoHashBytes,
-				fileLength:         fileLength,
-				pieceLength:        pieceLength,
-				pieceHashesByIndex: pieceHashesByIndex,
-			}
-		} else {
-			for index, hash := range pieceHashesByIndex {
-				if _, ok := di.pieceHashesByIndex[index]; !ok {
-					di.pieceHashesByIndex[index] = hash
-				}
-			}
+			fmt.Printf("invalid metadata from peer %s: %s. Try next peer...\n", peer, err.Error())
+			continue
 		}
 
-		fmt.Println("current number of piece hashes by index:", len(di.pieceHashesByIndex))
-
-		if len(di.pieceHashesByIndex) == numOfPiecesInFile {
-			return *di, nil
-		}
+		return downloadInfo{
+			infoHashBytes:      infoHashBytes,
+			name:               info.Name,
+			files:              info.Files,
+			multiFile:          info.MultiFile,
+			fileLength:         info.TotalLength(),
+			pieceLength:        info.PieceLength,
+			pieceHashesByIndex: info.pieceHashesByIndex(),
+		}, nil
 	}
-	return downloadInfo{}, fmt.Errorf("failed to find enough peers that supports extensions")
+	return downloadInfo{}, fmt.Errorf("failed to find a peer that supports extensions and sends valid metadata")
 }
 
-func magnet_download(target, link string) error {
+func magnet_download(target, link string, options downloadOptions) error {
 	data, err := parseMagnetLink(link)
 	if err != nil {
 		return fmt.Errorf("failed to parse magnet link: %s", err.Error())
@@ -1587,18 +1406,10 @@ func magnet_download(target, link string) error {
 		return fmt.Errorf("failed to decode info hash: %s", err.Error())
 	}
 
-	responseBodyBytes, err := sendRequest(data.trackerURL, infoHashBytes, 999)
+	peers, err := requestPeersFromTiers(data.trackerTiers(), infoHashBytes, 999)
 	if err != nil {
-		return fmt.Errorf("error reading response body: %s", err.Error())
+		return fmt.Errorf("error requesting peers from tracker: %s", err.Error())
 	}
-
-	resp, _, err := decodeBencode(responseBodyBytes)
-	if err != nil {
-		return fmt.Errorf("error failed to decoded response: %s", err.Error())
-	}
-
-	respDict := resp.(map[string]any)
-	peers := getPeers(respDict)
 	if len(peers) < 1 {
 		return fmt.Errorf("did not receive enough peers")
 	}
@@ -1610,6 +1421,8 @@ func magnet_download(target, link string) error {
 
 	fmt.Printf("%+v", downloadInfo)
 
+	options.apply(&downloadInfo)
+
 	if err = downloadFileUsingWorkers(target, peers, downloadInfo); err != nil {
 		return fmt.Errorf("failed to download the file using workers: %s", err.Error())
 	}
@@ -1617,115 +1430,184 @@ func magnet_download(target, link string) error {
 	return nil
 }
 
+// collectPieces hands every piece the workers deliver to write and records it
+// in downloaded, until all numOfPieces pieces are downloaded or failed or the
+// workers are gone. It returns the pieces that failed for good. A piece that
+// cannot be written ends the collection right away: the picker already
+// counts it as done, so no worker would ever deliver it again.
+func collectPieces(results <-chan downloadedPiece, outrightFailures <-chan int, workersDone <-chan struct{}, numOfPieces int, downloaded map[int]bool, write func(dp downloadedPiece) error) (map[int]any, error) {
+	failed := make(map[int]any)
+	for len(downloaded)+len(failed) < numOfPieces {
+		select {
+		case dp := <-results:
+			if err := write(dp); err != nil {
+				return failed, err
+			}
+			downloaded[dp.pieceIndex] = true
+		case fp := <-outrightFailures:
+			failed[fp] = nil
+		case <-workersDone:
+			return failed, nil
+		}
+	}
+	return failed, nil
+}
+
 func downloadFileUsingWorkers(downloadTarget string, peers []string, di downloadInfo) error {
 	numOfPieces := len(di.pieceHashesByIndex)
 	fmt.Println("number of pieces:", numOfPieces)
 
-	workers := make([]pieceDownloader, len(peers))
+	paths, err := filePaths(downloadTarget, di.name, di.files, di.multiFile)
+	if err != nil {
+		return err
+	}
+	existing := existingData(paths)
+	storage, err := openPieceStorage(paths, di.files, di.pieceLength)
+	if err != nil {
+		return fmt.Errorf("failed to prepare files for download: %s", err.Error())
+	}
+	defer storage.close()
+
+	// pick up where a previous run stopped, trusting the fast-resume data
+	// when the files did not change since it was written
+	resumePath := resumeFilePath(downloadTarget, di.name, di.multiFile)
+	have, ok := loadResumeData(resumePath, di.infoHashBytes, numOfPieces, paths)
+	if !ok {
+		have = make([]bool, numOfPieces)
+		if existing {
+			fmt.Println("checking existing data")
+			if have, err = checkPieces(storage, di.fileLength, di.pieceLength, di.pieceHashesByIndex); err != nil {
+				return fmt.Errorf("failed to check existing data: %s", err.Error())
+			}
+		}
+	}
+
+	picker := newPiecePicker(di.fileLength, di.pieceLength)
+	picker.setEndgame(di.endgame)
+
+	// seed picker with the pieces we do not have yet, only those are
+	// downloaded
+	downloadedFilePieces := make(map[int]bool)
+	for pieceIndex := range di.pieceHashesByIndex {
+		if have[pieceIndex] {
+			downloadedFilePieces[pieceIndex] = true
+			picker.pieceCompleted(pieceIndex)
+			continue
+		}
+		picker.push(pieceToDownload{
+			pieceIndex: pieceIndex,
+			attempt:    1,
+		})
+	}
+
+	fmt.Printf("%d of %d pieces already downloaded\n", len(downloadedFilePieces), numOfPieces)
+	if len(downloadedFilePieces) == numOfPieces {
+		return finishDownload(storage, resumePath)
+	}
+
+	saver := newResumeSaver(resumePath, di.infoHashBytes, paths)
+
+	workers := make([]*pieceDownloader, len(peers))
 	fmt.Println("creating", len(peers), "workers")
 	for i, p := range peers {
-		workers[i] = pieceDownloader{
+		workers[i] = &pieceDownloader{
 			peerConnectionString: p,
 			infoHashBytes:        di.infoHashBytes,
 			fileLength:           di.fileLength,
 			pieceLength:          di.pieceLength,
 			pieceHashesByIndex:   di.pieceHashesByIndex,
+			requestQueueDepth:    di.requestQueueDepth,
+			picker:               picker,
 		}
 	}
 
-	// comms channels
-	results := make(chan downloadedPiece, numOfPieces)
+	// comms channels. results only holds one piece per worker so that the
+	// number of pieces kept in memory is bounded by the pieces in flight.
+	results := make(chan downloadedPiece, len(workers))
 	outrightFailures := make(chan int, numOfPieces)
-	piecesToDownload := make(chan pieceToDownload, numOfPieces)
 
 	// start workers
 	fmt.Println("starting workers...")
 	var pieceDownloaderWaitGroup sync.WaitGroup
-	cleanup := sync.OnceFunc(func() {
-		close(results)
-		close(outrightFailures)
-	})
 	for _, w := range workers {
 		pieceDownloaderWaitGroup.Add(1)
 		go func() {
 			defer pieceDownloaderWaitGroup.Done()
-			for downloadedablePiece := range piecesToDownload {
-				fmt.Println("downloading piece index", downloadedablePiece.pieceIndex)
-				pieceIndex := downloadedablePiece.pieceIndex
-				pieceBytes, err := w.Download(pieceIndex)
-				if err != nil {
-					fmt.Printf("failed to download piece index %d, reinserting to queue: %s\n", pieceIndex, err.Error())
-					if downloadedablePiece.attempt <= 10 {
-						// time.Sleep(100 * time.Millisecond)
-						piecesToDownload <- pieceToDownload{
-							pieceIndex: pieceIndex,
-							attempt:    downloadedablePiece.attempt + 1,
-						}
-					} else {
-						outrightFailures <- pieceIndex
-					}
-				} else {
-					fmt.Println("downloaded piece index", pieceIndex)
-					results <- downloadedPiece{
-						pieceIndex: pieceIndex,
-						piece:      pieceBytes,
-					}
-				}
-			}
-			cleanup()
+			defer w.close()
+			w.run(results, outrightFailures)
 		}()
 	}
 
-	// seed queue
-	fmt.Println("seeding pieces to download queue", len(di.pieceHashesByIndex))
-	for pieceIndex := range di.pieceHashesByIndex {
-		fmt.Println("seeding piece index", pieceIndex)
-		piecesToDownload <- pieceToDownload{
-			pieceIndex: pieceIndex,
-			attempt:    1,
-		}
-	}
+	workersDone := make(chan struct{})
+	go func() {
+		pieceDownloaderWaitGroup.Wait()
+		close(workersDone)
+	}()
 
-	// collect results from workers
+	// collect results from workers, writing each verified piece to disk as
+	// soon as it arrives
 	fmt.Println("collecting results from workers")
-	downloadedFilePieces := make(map[int][]byte)
-	failedFilePieces := make(map[int]any)
-	for len(downloadedFilePieces)+len(failedFilePieces) < len(di.pieceHashesByIndex) {
-		select {
-		case dp := <-results:
-			downloadedFilePieces[dp.pieceIndex] = dp.piece
-		case fp := <-outrightFailures:
-			failedFilePieces[fp] = nil
+	failedFilePieces, writeErr := collectPieces(results, outrightFailures, workersDone, numOfPieces, downloadedFilePieces, func(dp downloadedPiece) error {
+		if err := storage.writePiece(dp.pieceIndex, dp.piece); err != nil {
+			return err
 		}
-	}
+		have[dp.pieceIndex] = true
+		if err := saver.pieceWritten(have); err != nil {
+			fmt.Println(err)
+		}
+		return nil
+	})
 
-	// stop workers
+	// stop workers, taking the pieces they still deliver so that none of
+	// them blocks on results
 	fmt.Println("waiting for workers to finish...")
-	close(piecesToDownload)
+	picker.close()
+	for _, w := range workers {
+		w.interrupt()
+	}
+	go func() {
+		for {
+			select {
+			case <-results:
+			case <-workersDone:
+				return
+			}
+		}
+	}()
 	pieceDownloaderWaitGroup.Wait()
 	fmt.Println("workers finished. Checking results...")
 
+	// record what an incomplete download got, a restart continues from there
+	if len(downloadedFilePieces) < numOfPieces {
+		if err := saver.save(have); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	if writeErr != nil {
+		return fmt.Errorf("failed to write piece to disk: %s", writeErr.Error())
+	}
+
 	// if any pice persistently failed, then fail
 	if len(failedFilePieces) > 0 {
 		return fmt.Errorf("failed to download one or more pieces: %d", len(failedFilePieces))
 	}
 
-	// collect pieces into file
-	fmt.Println("all pieces downloaded and hashes checked, piecing together file")
-	fileBytes := []byte{}
-	for pieceIndex := 0; pieceIndex < numOfPieces; pieceIndex++ {
-		piece, ok := downloadedFilePieces[pieceIndex]
-		if !ok {
-			return fmt.Errorf("missing download piece! %d", pieceIndex)
-		}
-		fileBytes = append(fileBytes, piece...)
+	if missing := len(di.pieceHashesByIndex) - len(downloadedFilePieces); missing > 0 {
+		return fmt.Errorf("no peers left to download %d remaining pieces from", missing)
 	}
 
-	// write file
-	fmt.Println("writing file")
-	if err := os.WriteFile(downloadTarget, fileBytes, 0666); err != nil {
-		return fmt.Errorf("failed to open temp file to write file: %s", err.Error())
-	}
+	return finishDownload(storage, resumePath)
+}
 
+// finishDownload closes the files of a complete download. The resume data is
+// no longer needed then.
+func finishDownload(storage *pieceStorage, resumePath string) error {
+	if err := storage.close(); err != nil {
+		return fmt.Errorf("failed to close downloaded files: %s", err.Error())
+	}
+	if err := os.Remove(resumePath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove resume data: %s", err.Error())
+	}
 	return nil
 }
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// keep-alive messages have no id, we use -1 to tell them apart
+const messageKeepAlive = -1
+
+// largest message we accept from a peer, a 16KiB block plus header is far
+// below this but bitfields of huge torrents can get big
+const maxPeerMessageLength = 1 << 21
+
+var messageNames = map[int]string{
+	messageKeepAlive:     "keep-alive",
+	messageChoke:         "choke",
+	messageUnchoke:       "unchoke",
+	messageInterested:    "interested",
+	messageNotInterested: "not interested",
+	messageHave:          "have",
+	messageBitfield:      "bitfield",
+	messageRequest:       "request",
+	messagePiece:         "piece",
+	messageCancel:        "cancel",
+	messagePort:          "port",
+	messageExtended:      "extended",
+}
+
+// peerMessage is a single message of the peer wire protocol with the length
+// prefix and id stripped from the payload.
+type peerMessage struct {
+	id      int
+	payload []byte
+}
+
+func (m *peerMessage) String() string {
+	if name, ok := messageNames[m.id]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", m.id)
+}
+
+func (m *peerMessage) serialize() []byte {
+	if m.id == messageKeepAlive {
+		return []byte{0, 0, 0, 0}
+	}
+	message := []byte{}
+	message = binary.BigEndian.AppendUint32(message, uint32(len(m.payload)+1))
+	message = append(message, byte(m.id))
+	return append(message, m.payload...)
+}
+
+func (m *peerMessage) expect(id, minLength int) error {
+	if m.id != id {
+		return fmt.Errorf("expected %s message but got %s", messageNames[id], m)
+	}
+	if len(m.payload) < minLength {
+		return fmt.Errorf("%s message was too small: %d bytes", m, len(m.payload))
+	}
+	return nil
+}
+
+// have returns the piece index of a HAVE message.
+func (m *peerMessage) have() (int, error) {
+	if err := m.expect(messageHave, 4); err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint32(m.payload[0:4])), nil
+}
+
+// request returns the index, begin and length of a REQUEST or CANCEL message.
+func (m *peerMessage) request() (int, int, int, error) {
+	id := messageRequest
+	if m.id == messageCancel {
+		id = messageCancel
+	}
+	if err := m.expect(id, 12); err != nil {
+		return 0, 0, 0, err
+	}
+	index := int(binary.BigEndian.Uint32(m.payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(m.payload[4:8]))
+	length := int(binary.BigEndian.Uint32(m.payload[8:12]))
+	return index, begin, length, nil
+}
+
+// piece returns the index, begin and block of a PIECE message.
+func (m *peerMessage) piece() (int, int, []byte, error) {
+	if err := m.expect(messagePiece, 8); err != nil {
+		return 0, 0, nil, err
+	}
+	index := int(binary.BigEndian.Uint32(m.payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(m.payload[4:8]))
+	return index, begin, m.payload[8:], nil
+}
+
+// port returns the DHT port of a PORT message.
+func (m *peerMessage) port() (int, error) {
+	if err := m.expect(messagePort, 2); err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(m.payload[0:2])), nil
+}
+
+// extended returns the extension message id and the payload of an extended
+// message.
+func (m *peerMessage) extended() (int, []byte, error) {
+	if err := m.expect(messageExtended, 1); err != nil {
+		return 0, nil, err
+	}
+	return int(m.payload[0]), m.payload[1:], nil
+}
+
+// extensionHandshake is the payload of the extension handshake, see
+// https://www.bittorrent.org/beps/bep_0010.html
+type extensionHandshake struct {
+	// M maps the extensions the peer supports to the ids it wants them sent
+	// with
+	M            map[string]int `bencode:"m"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+	Reqq         int            `bencode:"reqq,omitempty"`
+}
+
+// metadataMessage is the dictionary at the start of every ut_metadata
+// message, see https://www.bittorrent.org/beps/bep_0009.html
+type metadataMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+func newHaveMessage(pieceIndex int) *peerMessage {
+	return &peerMessage{id: messageHave, payload: binary.BigEndian.AppendUint32(nil, uint32(pieceIndex))}
+}
+
+func newRequestMessage(id, index, begin, length int) *peerMessage {
+	payload := []byte{}
+	payload = binary.BigEndian.AppendUint32(payload, uint32(index))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(begin))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(length))
+	return &peerMessage{id: id, payload: payload}
+}
+
+func newPieceMessage(index, begin int, block []byte) *peerMessage {
+	payload := []byte{}
+	payload = binary.BigEndian.AppendUint32(payload, uint32(index))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(begin))
+	payload = append(payload, block...)
+	return &peerMessage{id: messagePiece, payload: payload}
+}
+
+// messageReader reads length prefixed messages from a peer connection, one
+// whole message at a time, no matter how they were split into TCP segments.
+type messageReader struct {
+	r *bufio.Reader
+}
+
+func newMessageReader(r io.Reader) *messageReader {
+	return &messageReader{r: bufio.NewReader(r)}
+}
+
+func (mr *messageReader) readMessage() (*peerMessage, error) {
+	lengthBytes := make([]byte, 4)
+	if _, err := io.ReadFull(mr.r, lengthBytes); err != nil {
+		return nil, fmt.Errorf("failed to read message length: %s", err.Error())
+	}
+
+	length := binary.BigEndian.Uint32(lengthBytes)
+	if length == 0 {
+		return &peerMessage{id: messageKeepAlive}, nil
+	}
+	if length > maxPeerMessageLength {
+		return nil, fmt.Errorf("message length %d exceeds the maximum of %d", length, maxPeerMessageLength)
+	}
+
+	message := make([]byte, length)
+	if _, err := io.ReadFull(mr.r, message); err != nil {
+		return nil, fmt.Errorf("failed to read message of length %d: %s", length, err.Error())
+	}
+
+	return &peerMessage{id: int(message[0]), payload: message[1:]}, nil
+}
+
+// waitForData waits until the next message starts to arrive, without
+// consuming anything. Errors are those of the connection, so that a timeout
+// can be told apart.
+func (mr *messageReader) waitForData() error {
+	_, err := mr.r.Peek(1)
+	return err
+}
+
+// readExtendedMessage reads messages until an extended message with the given
+// extension id arrives, skipping anything else the peer sends in between.
+func (mr *messageReader) readExtendedMessage(extensionID int) ([]byte, error) {
+	for {
+		message, err := mr.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		if message.id != messageExtended {
+			continue
+		}
+
+		id, payload, err := message.extended()
+		if err != nil {
+			return nil, err
+		}
+		if id == extensionID {
+			return payload, nil
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"testing/iotest"
+)
+
+func TestMessageReaderFraming(t *testing.T) {
+	stream := []byte{}
+	stream = append(stream, (&peerMessage{id: messageUnchoke}).serialize()...)
+	stream = append(stream, (&peerMessage{id: messageKeepAlive}).serialize()...)
+	stream = append(stream, newHaveMessage(7).serialize()...)
+	stream = append(stream, newPieceMessage(3, 16384, []byte("block")).serialize()...)
+	stream = append(stream, newRequestMessage(messageCancel, 1, 2, 3).serialize()...)
+	stream = append(stream, (&peerMessage{id: messagePort, payload: []byte{0x1A, 0xE1}}).serialize()...)
+	stream = append(stream, (&peerMessage{id: messageExtended, payload: []byte{0, 'd', 'e'}}).serialize()...)
+
+	// deliver the stream one byte at a time so every message is split
+	reader := newMessageReader(iotest.OneByteReader(bytes.NewReader(stream)))
+
+	expectedIDs := []int{messageUnchoke, messageKeepAlive, messageHave, messagePiece, messageCancel, messagePort, messageExtended}
+	messages := []*peerMessage{}
+	for range expectedIDs {
+		message, err := reader.readMessage()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		messages = append(messages, message)
+	}
+
+	for i, id := range expectedIDs {
+		if messages[i].id != id {
+			t.Fatalf("unexpected message %d: %s instead of %s", i, messages[i], messageNames[id])
+		}
+	}
+
+	if pieceIndex, err := messages[2].have(); err != nil || pieceIndex != 7 {
+		t.Fatalf("unexpected have: %d, %v", pieceIndex, err)
+	}
+	index, begin, block, err := messages[3].piece()
+	if err != nil || index != 3 || begin != 16384 || string(block) != "block" {
+		t.Fatalf("unexpected piece: %d, %d, %s, %v", index, begin, block, err)
+	}
+	index, begin, length, err := messages[4].request()
+	if err != nil || index != 1 || begin != 2 || length != 3 {
+		t.Fatalf("unexpected cancel: %d, %d, %d, %v", index, begin, length, err)
+	}
+	if port, err := messages[5].port(); err != nil || port != 6881 {
+		t.Fatalf("unexpected port: %d, %v", port, err)
+	}
+	extensionID, payload, err := messages[6].extended()
+	if err != nil || extensionID != 0 || string(payload) != "de" {
+		t.Fatalf("unexpected extended: %d, %s, %v", extensionID, payload, err)
+	}
+
+	if _, err := reader.readMessage(); err == nil {
+		t.Fatalf("expected an error at the end of the stream")
+	}
+}
+
+func TestMessageReaderRejectsOversizedMessages(t *testing.T) {
+	reader := newMessageReader(bytes.NewReader([]byte{0xFF, 0xFF, 0xFF, 0xFF, messagePiece}))
+	if _, err := reader.readMessage(); err == nil {
+		t.Fatalf("expected an error for an oversized message")
+	}
+}
+
+func TestPeerMessageValidatesPayload(t *testing.T) {
+	if _, _, _, err := (&peerMessage{id: messagePiece, payload: []byte{0, 0}}).piece(); err == nil {
+		t.Fatalf("expected an error for a truncated piece message")
+	}
+	if _, err := (&peerMessage{id: messageUnchoke}).have(); err == nil {
+		t.Fatalf("expected an error when reading have from an unchoke message")
+	}
+}
+
+func TestReadExtendedMessageSkipsOtherMessages(t *testing.T) {
+	stream := []byte{}
+	stream = append(stream, (&peerMessage{id: messageBitfield, payload: []byte{0xFF}}).serialize()...)
+	stream = append(stream, newHaveMessage(1).serialize()...)
+	stream = append(stream, (&peerMessage{id: messageKeepAlive}).serialize()...)
+	stream = append(stream, (&peerMessage{id: messageExtended, payload: []byte{0, 'd', 'e'}}).serialize()...)
+
+	payload, err := newMessageReader(bytes.NewReader(stream)).readExtendedMessage(0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if string(payload) != "de" {
+		t.Fatalf("unexpected payload: %s", payload)
+	}
+}
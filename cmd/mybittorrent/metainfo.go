@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Metainfo is the contents of a .torrent file, see
+// https://www.bittorrent.org/beps/bep_0003.html#metainfo-files
+type Metainfo struct {
+	// Announce is the tracker URL, empty for trackerless torrents
+	Announce string
+	// AnnounceTiers are the tracker tiers of BEP 12, falling back to a single
+	// tier with Announce
+	AnnounceTiers [][]string
+	// HasAnnounceList reports whether the torrent had an announce-list
+	HasAnnounceList bool
+	Info            InfoDict
+	InfoHash        [20]byte
+
+	// trackers are the announce tiers that announces go through
+	trackers *announceTiers
+}
+
+// InfoDict is the info dictionary of a torrent, the part the info hash is
+// calculated from.
+type InfoDict struct {
+	Name        string
+	PieceLength int
+	// Pieces are the concatenated SHA-1 hashes of all pieces
+	Pieces  string
+	Private bool
+	// Files holds a single entry named after the torrent for single-file
+	// torrents
+	Files     []torrentFile
+	MultiFile bool
+}
+
+// TotalLength is the sum of the lengths of all files.
+func (i *InfoDict) TotalLength() int64 {
+	length := int64(0)
+	for _, f := range i.Files {
+		length += f.length
+	}
+	return length
+}
+
+// PieceCount is the number of pieces the data is split into.
+func (i *InfoDict) PieceCount() int {
+	return len(i.Pieces) / 20
+}
+
+// PieceHashes returns the SHA-1 hash of every piece.
+func (i *InfoDict) PieceHashes() [][20]byte {
+	hashes := make([][20]byte, i.PieceCount())
+	for pieceIndex := range hashes {
+		copy(hashes[pieceIndex][:], i.Pieces[pieceIndex*20:])
+	}
+	return hashes
+}
+
+// pieceHashesByIndex returns the hex encoded hash of every piece, the form
+// the downloaders compare downloaded pieces with.
+func (i *InfoDict) pieceHashesByIndex() map[int]string {
+	return calcPieceHashes(i.Pieces)
+}
+
+// loadMetainfo reads and validates the torrent file. In strict mode the file
+// has to be canonical bencode, see Decoder.SetStrict.
+func loadMetainfo(file string, strict bool) (*Metainfo, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %s", err.Error())
+	}
+	defer f.Close()
+
+	decoder := NewDecoder(f)
+	decoder.SetStrict(strict)
+	var contents RawMessage
+	if err := decoder.Decode(&contents); err != nil {
+		return nil, fmt.Errorf("error reading file: %s", err.Error())
+	}
+	return parseMetainfo(contents)
+}
+
+// parseMetainfo decodes a torrent and checks that all required fields are
+// present and have the right types, so that callers never have to.
+func parseMetainfo(contents []byte) (*Metainfo, error) {
+	if len(contents) == 0 {
+		return nil, fmt.Errorf("torrent file is empty")
+	}
+	if contents[0] != 'd' {
+		return nil, fmt.Errorf("torrent is not a dictionary")
+	}
+	dict, spans, _, err := decodeDictionaryWithSpans(contents, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode torrent: %s", err.Error())
+	}
+
+	m := &Metainfo{}
+	if rawAnnounce, ok := dict["announce"]; ok {
+		if m.Announce, ok = rawAnnounce.(string); !ok {
+			return nil, fmt.Errorf("announce is not a string")
+		}
+	}
+	_, m.HasAnnounceList = dict["announce-list"]
+	m.AnnounceTiers = parseAnnounceTiers(dict)
+	// BEP 12 shuffles the tiers once, later announces keep the order that
+	// promoting responding trackers leaves behind
+	m.trackers = newAnnounceTiers(m.AnnounceTiers)
+	shuffleTiers(m.trackers.tiers)
+
+	rawInfo, ok := dict["info"]
+	if !ok {
+		return nil, fmt.Errorf("torrent is missing the info dictionary")
+	}
+	info, ok := rawInfo.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("info is not a dictionary")
+	}
+	if m.Info, err = parseInfoDict(info); err != nil {
+		return nil, err
+	}
+
+	// the info hash covers the info dictionary exactly as it appears in the
+	// file, which need not be how we would encode it
+	m.InfoHash = sha1.Sum(spans["info"])
+
+	return m, nil
+}
+
+func parseInfoDict(info map[string]any) (InfoDict, error) {
+	d := InfoDict{}
+
+	name, ok := info["name"].(string)
+	if !ok || name == "" {
+		return InfoDict{}, fmt.Errorf("info dictionary is missing a name")
+	}
+	if !safePathComponent(name) {
+		return InfoDict{}, fmt.Errorf("info dictionary has an unsafe name: %q", name)
+	}
+	d.Name = name
+
+	pieceLength, ok := integerValue(info["piece length"])
+	if !ok {
+		return InfoDict{}, fmt.Errorf("info dictionary is missing the piece length")
+	}
+	// pieces are held in memory, so their length has to fit into an int
+	if pieceLength <= 0 || int64(int(pieceLength)) != pieceLength {
+		return InfoDict{}, fmt.Errorf("invalid piece length: %d", pieceLength)
+	}
+	d.PieceLength = int(pieceLength)
+
+	if d.Pieces, ok = info["pieces"].(string); !ok {
+		return InfoDict{}, fmt.Errorf("info dictionary is missing the piece hashes")
+	}
+	if len(d.Pieces)%20 != 0 {
+		return InfoDict{}, fmt.Errorf("piece hashes have a length of %d, which is not a multiple of 20", len(d.Pieces))
+	}
+
+	if rawPrivate, ok := info["private"]; ok {
+		private, ok := integerValue(rawPrivate)
+		if !ok {
+			return InfoDict{}, fmt.Errorf("private flag is not an integer")
+		}
+		d.Private = private == 1
+	}
+
+	files, _, multiFile, err := parseFiles(info)
+	if err != nil {
+		return InfoDict{}, err
+	}
+	for _, f := range files {
+		if f.length < 0 {
+			return InfoDict{}, fmt.Errorf("file %s has a negative length", strings.Join(f.path, "/"))
+		}
+	}
+	d.Files, d.MultiFile = files, multiFile
+
+	expectedPieces := (d.TotalLength() + int64(d.PieceLength) - 1) / int64(d.PieceLength)
+	if int64(d.PieceCount()) != expectedPieces {
+		return InfoDict{}, fmt.Errorf("torrent has %d piece hashes but %d pieces of data", d.PieceCount(), expectedPieces)
+	}
+
+	return d, nil
+}
+
+// infoHashHex is the info hash in the form it is printed and used in magnet
+// links.
+func (m *Metainfo) infoHashHex() string {
+	return hex.EncodeToString(m.InfoHash[:])
+}
+
+// trackerTiers returns the announce tiers, shuffled when the torrent was
+// loaded as BEP 12 asks.
+func (m *Metainfo) trackerTiers() *announceTiers {
+	return m.trackers
+}
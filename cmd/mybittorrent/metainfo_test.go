@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseMetainfo(t *testing.T) {
+	twoHashes := strings.Repeat("a", 20) + strings.Repeat("b", 20)
+	tests := []struct {
+		name                string
+		torrent             map[string]any
+		expectedPieceCount  int
+		expectedTotalLength int64
+		expectedFiles       int
+		expectedError       string
+	}{
+		{
+			name: "single file",
+			torrent: map[string]any{
+				"announce": "http://tracker/announce",
+				"info":     map[string]any{"name": "a.txt", "length": 30, "piece length": 16, "pieces": twoHashes},
+			},
+			expectedPieceCount:  2,
+			expectedTotalLength: 30,
+			expectedFiles:       1,
+		},
+		{
+			name: "multi file",
+			torrent: map[string]any{
+				"info": map[string]any{
+					"name":         "dir",
+					"piece length": 16,
+					"pieces":       twoHashes,
+					"files": []any{
+						map[string]any{"length": 10, "path": []any{"a.txt"}},
+						map[string]any{"length": 20, "path": []any{"sub", "b.txt"}},
+					},
+				},
+			},
+			expectedPieceCount:  2,
+			expectedTotalLength: 30,
+			expectedFiles:       2,
+		},
+		{
+			// beyond an int on 32-bit platforms, where the decoder returns
+			// them as int64
+			name: "lengths above 2^31",
+			torrent: map[string]any{
+				"info": map[string]any{
+					"name":         "dir",
+					"piece length": int64(1 << 30),
+					"pieces":       twoHashes + strings.Repeat("c", 20),
+					"files": []any{
+						map[string]any{"length": int64(5 << 29), "path": []any{"a.bin"}},
+						map[string]any{"length": int64(1 << 29), "path": []any{"b.bin"}},
+					},
+				},
+			},
+			expectedPieceCount:  3,
+			expectedTotalLength: 3 << 30,
+			expectedFiles:       2,
+		},
+		{
+			name:          "missing info",
+			torrent:       map[string]any{"announce": "http://tracker/announce"},
+			expectedError: "missing the info dictionary",
+		},
+		{
+			name:          "info is not a dictionary",
+			torrent:       map[string]any{"info": "info"},
+			expectedError: "info is not a dictionary",
+		},
+		{
+			name: "announce is not a string",
+			torrent: map[string]any{
+				"announce": 1,
+				"info":     map[string]any{"name": "a.txt", "length": 30, "piece length": 16, "pieces": twoHashes},
+			},
+			expectedError: "announce is not a string",
+		},
+		{
+			name: "piece length is not an integer",
+			torrent: map[string]any{
+				"info": map[string]any{"name": "a.txt", "length": 30, "piece length": "16", "pieces": twoHashes},
+			},
+			expectedError: "missing the piece length",
+		},
+		{
+			name: "pieces are not a multiple of 20",
+			torrent: map[string]any{
+				"info": map[string]any{"name": "a.txt", "length": 30, "piece length": 16, "pieces": twoHashes[1:]},
+			},
+			expectedError: "not a multiple of 20",
+		},
+		{
+			name: "piece count does not match the length",
+			torrent: map[string]any{
+				"info": map[string]any{"name": "a.txt", "length": 40, "piece length": 16, "pieces": twoHashes},
+			},
+			expectedError: "2 piece hashes but 3 pieces",
+		},
+		{
+			name: "missing length and files",
+			torrent: map[string]any{
+				"info": map[string]any{"name": "a.txt", "piece length": 16, "pieces": twoHashes},
+			},
+			expectedError: "neither length nor files",
+		},
+		{
+			name: "unsafe name",
+			torrent: map[string]any{
+				"info": map[string]any{"name": "..", "length": 30, "piece length": 16, "pieces": twoHashes},
+			},
+			expectedError: "unsafe name",
+		},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			encoded, err := encodeBencode(ts.torrent)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			m, err := parseMetainfo(encoded)
+			if ts.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), ts.expectedError) {
+					t.Fatalf("unexpected error: %v, expected one containing %q", err, ts.expectedError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if m.Info.PieceCount() != ts.expectedPieceCount {
+				t.Fatalf("unexpected piece count: %d instead of %d", m.Info.PieceCount(), ts.expectedPieceCount)
+			}
+			if m.Info.TotalLength() != ts.expectedTotalLength {
+				t.Fatalf("unexpected total length: %d instead of %d", m.Info.TotalLength(), ts.expectedTotalLength)
+			}
+			if len(m.Info.Files) != ts.expectedFiles {
+				t.Fatalf("unexpected number of files: %d instead of %d", len(m.Info.Files), ts.expectedFiles)
+			}
+			hashes := m.Info.PieceHashes()
+			if string(hashes[0][:]) != twoHashes[:20] || string(hashes[1][:]) != twoHashes[20:] {
+				t.Fatalf("unexpected piece hashes: %x", hashes)
+			}
+		})
+	}
+}
+
+func TestParseMetainfoRejectsNonDictionary(t *testing.T) {
+	for _, contents := range []string{"", "i42e", "l4:spame", "d4:info"} {
+		if _, err := parseMetainfo([]byte(contents)); err == nil {
+			t.Fatalf("expected an error for %q", contents)
+		}
+	}
+}
+
+func TestParseMetainfoHashesRawInfo(t *testing.T) {
+	hash := strings.Repeat("h", 20)
+	tests := []struct {
+		name string
+		info string
+	}{
+		{
+			name: "canonical",
+			info: "d6:lengthi5e4:name5:a.txt12:piece lengthi16e6:pieces20:" + hash + "e",
+		},
+		{
+			name: "unsorted keys",
+			info: "d4:name5:a.txt6:lengthi5e6:pieces20:" + hash + "12:piece lengthi16ee",
+		},
+		{
+			name: "non utf-8 strings and unknown fields",
+			info: "d6:lengthi5e4:name5:a.txt12:piece lengthi16e6:pieces20:" + hash + "4:zzzz3:\xff\xfe\x00e",
+		},
+		{
+			name: "integers that do not round trip",
+			info: "d6:lengthi005e4:name5:a.txt12:piece lengthi16e6:pieces20:" + hash + "4:zzzzi-0ee",
+		},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			m, err := parseMetainfo([]byte("d8:announce4:http4:info" + ts.info + "e"))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			expected := sha1.Sum([]byte(ts.info))
+			if m.InfoHash != expected {
+				t.Fatalf("unexpected info hash: %x instead of %x", m.InfoHash, expected)
+			}
+		})
+	}
+}
+
+func TestLoadMetainfoStrict(t *testing.T) {
+	info := "d4:name5:a.txt6:lengthi5e12:piece lengthi16e6:pieces20:" + strings.Repeat("h", 20) + "e"
+	file := filepath.Join(t.TempDir(), "unsorted.torrent")
+	if err := os.WriteFile(file, []byte("d4:info"+info+"e"), 0644); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	if _, err := loadMetainfo(file, false); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	_, err := loadMetainfo(file, true)
+	if err == nil || !strings.Contains(err.Error(), `dictionary key "length" is not sorted after "name" at offset 21`) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	messageChoke         = 0
+	messageUnchoke       = 1
+	messageInterested    = 2
+	messageNotInterested = 3
+	messageHave          = 4
+	messageBitfield      = 5
+	messageRequest       = 6
+	messagePiece         = 7
+	messageCancel        = 8
+	messagePort          = 9
+	messageExtended      = 20
+)
+
+const peerReadTimeout = 30 * time.Second
+
+// peers drop connections that stay silent for two minutes, so a session we
+// have nothing to request on sends a keep-alive before that
+const keepAliveInterval = 90 * time.Second
+
+// number of block requests kept outstanding per peer, unless the peer asks for
+// fewer with the reqq key of its extension handshake
+const defaultRequestQueueDepth = 10
+
+// peerSession is a long-lived connection to a single peer. It keeps track of
+// whether the peer is choking us and which pieces it has, so that many pieces
+// can be downloaded over the same connection.
+type peerSession struct {
+	peer       string
+	conn       net.Conn
+	reader     *messageReader
+	numPieces  int
+	choked     bool
+	interested bool
+	bitfield   []byte
+
+	requestQueueDepth int
+	peerRequestLimit  int
+	keepAliveInterval time.Duration
+	// stats are shared with the connection the peer may have opened to our
+	// seeder, they are keyed by the info hash and the ID of the peer
+	stats        *transferStats
+	infoHash     []byte
+	remotePeerID []byte
+	closeOnce    sync.Once
+
+	// onHave is called for every piece the peer announces, once per piece
+	onHave func(pieceIndex int)
+}
+
+// newPeerSession dials the peer and performs the handshake. The peer starts
+// out choking us, as per the protocol.
+func newPeerSession(peer string, infoHash []byte, numPieces int) (*peerSession, error) {
+	conn, err := net.DialTimeout("tcp", peer, peerReadTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect via tcp to peer: %s", err.Error())
+	}
+
+	hs := handshake{
+		infoHash:          infoHash,
+		peerID:            createRandomID(),
+		supportExtensions: true,
+	}
+
+	conn.SetDeadline(time.Now().Add(peerReadTimeout))
+	remote, err := doHandshakeOnConnection(conn, &hs)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to do handshake with peer: %s", err.Error())
+	}
+	conn.SetDeadline(time.Time{})
+
+	return &peerSession{
+		peer:      peer,
+		conn:      conn,
+		reader:    newMessageReader(conn),
+		numPieces: numPieces,
+		choked:    true,
+		bitfield:  make([]byte, (numPieces+7)/8),
+
+		requestQueueDepth: defaultRequestQueueDepth,
+		keepAliveInterval: keepAliveInterval,
+		stats:             acquireTransferStats(infoHash, remote.peerID),
+		infoHash:          infoHash,
+		remotePeerID:      remote.peerID,
+	}, nil
+}
+
+func (s *peerSession) setRequestQueueDepth(depth int) {
+	s.requestQueueDepth = depth
+}
+
+// queueDepth is the number of requests we keep in flight, capped by the reqq
+// the peer advertised in its extension handshake.
+func (s *peerSession) queueDepth() int {
+	depth := s.requestQueueDepth
+	if s.peerRequestLimit > 0 && s.peerRequestLimit < depth {
+		depth = s.peerRequestLimit
+	}
+	return max(depth, 1)
+}
+
+// close closes the connection. It may be called more than once, and from
+// another goroutine to interrupt a read.
+func (s *peerSession) close() error {
+	s.closeOnce.Do(func() {
+		releaseTransferStats(s.infoHash, s.remotePeerID)
+	})
+	return s.conn.Close()
+}
+
+// hasPiece reports whether the peer announced the piece, either in its
+// bitfield or with a HAVE message.
+func (s *peerSession) hasPiece(pieceIndex int) bool {
+	byteIndex := pieceIndex / 8
+	if pieceIndex < 0 || byteIndex >= len(s.bitfield) {
+		return false
+	}
+	return s.bitfield[byteIndex]>>(7-uint(pieceIndex%8))&1 != 0
+}
+
+func (s *peerSession) setPiece(pieceIndex int) {
+	if pieceIndex < 0 || pieceIndex >= s.numPieces || s.hasPiece(pieceIndex) {
+		return
+	}
+	s.bitfield[pieceIndex/8] |= 1 << (7 - uint(pieceIndex%8))
+	if s.onHave != nil {
+		s.onHave(pieceIndex)
+	}
+}
+
+// pieces returns the indexes of all pieces the peer announced.
+func (s *peerSession) pieces() []int {
+	pieces := []int{}
+	for i := 0; i < s.numPieces; i++ {
+		if s.hasPiece(i) {
+			pieces = append(pieces, i)
+		}
+	}
+	return pieces
+}
+
+// readMessage reads the next message from the peer, giving up when the peer
+// stays silent for too long.
+func (s *peerSession) readMessage() (*peerMessage, error) {
+	s.conn.SetReadDeadline(time.Now().Add(peerReadTimeout))
+	return s.reader.readMessage()
+}
+
+// waitIdle waits until the peer sends a message, which is then handled, or
+// until wake is closed. A peer that stays silent is not an error, it gets a
+// keep-alive every keepAliveInterval and the session stays open.
+func (s *peerSession) waitIdle(wake <-chan struct{}) error {
+	s.conn.SetReadDeadline(time.Now().Add(s.keepAliveInterval))
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-wake:
+			// cuts the wait below short, nothing has been read yet
+			s.conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	err := s.reader.waitForData()
+	close(stop)
+	<-stopped
+
+	if err != nil {
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			return fmt.Errorf("failed waiting for message: %s", err.Error())
+		}
+		select {
+		case <-wake:
+			return nil
+		default:
+		}
+		if err := s.writeMessage(&peerMessage{id: messageKeepAlive}); err != nil {
+			return fmt.Errorf("failed to write keep-alive: %s", err.Error())
+		}
+		return nil
+	}
+
+	message, err := s.readMessage()
+	if err != nil {
+		return err
+	}
+	s.handleMessage(message)
+	return nil
+}
+
+func (s *peerSession) writeMessage(message *peerMessage) error {
+	_, err := s.conn.Write(message.serialize())
+	return err
+}
+
+// handleMessage updates the session state for messages that are not a direct
+// response to one of our requests.
+func (s *peerSession) handleMessage(message *peerMessage) {
+	switch message.id {
+	case messageChoke:
+		s.choked = true
+	case messageUnchoke:
+		s.choked = false
+	case messageHave:
+		if pieceIndex, err := message.have(); err == nil {
+			s.setPiece(pieceIndex)
+		}
+	case messageBitfield:
+		for i := 0; i < s.numPieces && i/8 < len(message.payload); i++ {
+			if message.payload[i/8]>>(7-uint(i%8))&1 != 0 {
+				s.setPiece(i)
+			}
+		}
+	case messageExtended:
+		// extension handshake, see https://www.bittorrent.org/beps/bep_0010.html
+		extensionID, payload, err := message.extended()
+		if err != nil || extensionID != 0 {
+			return
+		}
+		var handshake extensionHandshake
+		if err := Unmarshal(payload, &handshake); err != nil {
+			return
+		}
+		if handshake.Reqq > 0 {
+			s.peerRequestLimit = handshake.Reqq
+		}
+	}
+}
+
+// ensureUnchoked tells the peer we are interested, if we have not done so
+// already, and waits until the peer unchokes us.
+func (s *peerSession) ensureUnchoked() error {
+	if !s.interested {
+		if err := s.writeMessage(&peerMessage{id: messageInterested}); err != nil {
+			return fmt.Errorf("failed to write interested message: %s", err.Error())
+		}
+		s.interested = true
+	}
+
+	for s.choked {
+		message, err := s.readMessage()
+		if err != nil {
+			return fmt.Errorf("failed waiting for unchoke: %s", err.Error())
+		}
+		s.handleMessage(message)
+	}
+	return nil
+}
+
+// errPieceDownloadedElsewhere is returned by downloadPiece when the piece was
+// finished by another peer in endgame mode.
+var errPieceDownloadedElsewhere = errors.New("piece was downloaded from another peer")
+
+// downloadPiece requests the blocks of the piece, keeping up to queueDepth
+// requests in flight, and returns the piece once its hash has been checked.
+// Blocks may arrive in any order and are placed by their begin offset.
+//
+// Other messages may arrive between blocks at any time. When the peer chokes
+// us it discards our outstanding requests, so they are dropped here as well
+// and requested again once the peer unchokes us.
+//
+// Blocks are collected in partial, which may already hold blocks from an
+// earlier attempt. If the download fails partway partial keeps the blocks
+// received so far. In endgame mode partial is shared with sessions to other
+// peers; whenever a block arrives the other peers that were asked for the
+// same block get a CANCEL.
+func (s *peerSession) downloadPiece(pieceIndex, pieceLength int, expectedHash string, partial *partialPiece) ([]byte, error) {
+	defer partial.forget(s)
+
+	expectedBlocks := calcExpectedBlocks(pieceLength)
+	// begin offset to length of every request currently in flight
+	pending := make(map[int]int)
+	for {
+		if partial.receivedBlocks() == expectedBlocks {
+			return nil, errPieceDownloadedElsewhere
+		}
+
+		// blocks another peer delivered in the meantime were cancelled
+		for begin := range pending {
+			if partial.has(begin) {
+				delete(pending, begin)
+			}
+		}
+
+		if s.choked {
+			clear(pending)
+			if err := s.ensureUnchoked(); err != nil {
+				return nil, err
+			}
+		}
+
+		for begin := 0; begin < pieceLength && len(pending) < s.queueDepth(); begin += sixteenKilobytes {
+			if _, ok := pending[begin]; ok || partial.has(begin) {
+				continue
+			}
+			requestLength := min(sixteenKilobytes, pieceLength-begin)
+			message := newRequestMessage(messageRequest, pieceIndex, begin, requestLength)
+			if err := s.writeMessage(message); err != nil {
+				return nil, fmt.Errorf("failed to write request message: %s", err.Error())
+			}
+			pending[begin] = requestLength
+			partial.request(s, begin)
+		}
+
+		message, err := s.readMessage()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read piece message: %s", err.Error())
+		}
+		if message.id != messagePiece {
+			s.handleMessage(message)
+			continue
+		}
+
+		index, begin, block, err := message.piece()
+		if err != nil {
+			return nil, err
+		}
+
+		// ignore blocks we did not ask for, or asked for before being choked
+		requestLength, ok := pending[begin]
+		if index != pieceIndex || !ok || len(block) != requestLength {
+			continue
+		}
+		delete(pending, begin)
+		s.stats.addDownloaded(len(block))
+
+		others, complete := partial.receive(s, begin, block, expectedBlocks)
+		for _, other := range others {
+			other.writeMessage(newRequestMessage(messageCancel, pieceIndex, begin, requestLength))
+		}
+		if complete {
+			break
+		}
+	}
+
+	pieceHash, err := hashBytesNew(partial.data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate hash for new piece")
+	}
+
+	if pieceHash != expectedHash {
+		partial.reset()
+		return nil, fmt.Errorf("piece hash did not match hash in torrent file. actual: %s, expected: %s", pieceHash, expectedHash)
+	}
+	return partial.data, nil
+}
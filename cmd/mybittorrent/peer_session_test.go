@@ -0,0 +1,643 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePeer is an in-process seed that serves the pieces of data to anyone
+// who completes the handshake.
+type fakePeer struct {
+	listener    net.Listener
+	infoHash    []byte
+	data        []byte
+	pieceLength int
+
+	// reqq is advertised in an extension handshake when set
+	reqq int
+	// holdRequests makes the peer wait for this many outstanding requests
+	// of a piece before answering them in reverse order
+	holdRequests int
+	// chokeAfterBlocks makes the peer choke once after sending this many
+	// blocks, drop every request it receives while choking and unchoke again
+	// shortly after
+	chokeAfterBlocks int
+	// noisy makes the peer send have, keep-alive and unrequested blocks
+	// in between the blocks that were requested
+	noisy bool
+	// pieces restricts the pieces the peer has, all pieces when nil
+	pieces []int
+	// announceLater are pieces the peer announces with HAVE messages shortly
+	// after the handshake
+	announceLater []int
+	// blockDelay makes the peer answer every request only after this long,
+	// unless the request was cancelled in the meantime
+	blockDelay time.Duration
+	// peerID is sent in the handshake, a random one when nil
+	peerID []byte
+
+	mu                 sync.Mutex
+	connections        int
+	unexpectedRequests int
+	cancels            int
+	keepAlives         int
+	requestedPieces    map[int]bool
+	// number of requests for every block, by piece index and begin offset
+	requestedBlocks map[[2]int]int
+}
+
+func newFakePeer(t *testing.T, infoHash, data []byte, pieceLength int, options ...func(fp *fakePeer)) *fakePeer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err.Error())
+	}
+	fp := &fakePeer{
+		listener:        listener,
+		infoHash:        infoHash,
+		data:            data,
+		pieceLength:     pieceLength,
+		requestedPieces: make(map[int]bool),
+		requestedBlocks: make(map[[2]int]int),
+	}
+	for _, option := range options {
+		option(fp)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go fp.serve()
+	return fp
+}
+
+func (fp *fakePeer) address() string {
+	return fp.listener.Addr().String()
+}
+
+func (fp *fakePeer) connectionCount() int {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return fp.connections
+}
+
+func (fp *fakePeer) unexpectedRequestCount() int {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return fp.unexpectedRequests
+}
+
+func (fp *fakePeer) wasRequested(pieceIndex int) bool {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return fp.requestedPieces[pieceIndex]
+}
+
+func (fp *fakePeer) cancelCount() int {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return fp.cancels
+}
+
+// requestCounts returns how often every block was requested.
+func (fp *fakePeer) requestCounts() map[[2]int]int {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	counts := map[[2]int]int{}
+	for block, n := range fp.requestedBlocks {
+		counts[block] = n
+	}
+	return counts
+}
+
+func (fp *fakePeer) keepAliveCount() int {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return fp.keepAlives
+}
+
+func (fp *fakePeer) serve() {
+	for {
+		conn, err := fp.listener.Accept()
+		if err != nil {
+			return
+		}
+		fp.mu.Lock()
+		fp.connections++
+		fp.mu.Unlock()
+		go fp.handle(conn)
+	}
+}
+
+func (fp *fakePeer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	if _, err := readExactLength(conn, 68); err != nil {
+		return
+	}
+	peerID := fp.peerID
+	if peerID == nil {
+		peerID = createRandomID()
+	}
+	hs := handshake{infoHash: fp.infoHash, peerID: peerID, supportExtensions: fp.reqq > 0}
+	conn.Write(hs.makeMessage())
+
+	numPieces := (len(fp.data) + fp.pieceLength - 1) / fp.pieceLength
+	has := make([]bool, numPieces)
+	for i := range has {
+		has[i] = fp.pieces == nil
+	}
+	for _, i := range fp.pieces {
+		has[i] = true
+	}
+
+	bitfield := make([]byte, (numPieces+7)/8)
+	for i := 0; i < numPieces; i++ {
+		if has[i] {
+			bitfield[i/8] |= 1 << (7 - uint(i%8))
+		}
+	}
+	conn.Write(makePeerMessage(messageBitfield, bitfield))
+
+	if fp.reqq > 0 {
+		payload, _ := encodeBencode(map[string]any{"reqq": fp.reqq})
+		conn.Write(makePeerMessage(messageExtended, append([]byte{0}, payload...)))
+	}
+
+	var writeMutex sync.Mutex
+	choked := false
+	write := func(message []byte) {
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		conn.Write(message)
+	}
+
+	if len(fp.announceLater) > 0 {
+		time.AfterFunc(50*time.Millisecond, func() {
+			writeMutex.Lock()
+			defer writeMutex.Unlock()
+			for _, i := range fp.announceLater {
+				has[i] = true
+				conn.Write(newHaveMessage(i).serialize())
+			}
+		})
+	}
+
+	// requests waiting for blockDelay, by piece index and begin offset
+	delayed := map[[2]int]bool{}
+	held := [][]byte{}
+	remainingByPiece := map[int]int{}
+	blocksSent := 0
+	reader := newMessageReader(conn)
+	for {
+		message, err := reader.readMessage()
+		if err != nil {
+			return
+		}
+
+		switch message.id {
+		case messageKeepAlive:
+			fp.mu.Lock()
+			fp.keepAlives++
+			fp.mu.Unlock()
+		case messageInterested:
+			write(makePeerMessage(messageUnchoke, nil))
+		case messageCancel:
+			index, begin, _, err := message.request()
+			if err != nil {
+				return
+			}
+			fp.mu.Lock()
+			fp.cancels++
+			fp.mu.Unlock()
+			writeMutex.Lock()
+			delete(delayed, [2]int{index, begin})
+			writeMutex.Unlock()
+		case messageRequest:
+			index, begin, blockLength, err := message.request()
+			if err != nil {
+				return
+			}
+			fp.mu.Lock()
+			fp.requestedPieces[index] = true
+			fp.requestedBlocks[[2]int{index, begin}]++
+			fp.mu.Unlock()
+
+			writeMutex.Lock()
+			isChoked := choked
+			hasPiece := has[index]
+			writeMutex.Unlock()
+			if !hasPiece {
+				fp.mu.Lock()
+				fp.unexpectedRequests++
+				fp.mu.Unlock()
+				return
+			}
+			if isChoked {
+				continue
+			}
+
+			offset := index*fp.pieceLength + begin
+			payload := newPieceMessage(index, begin, fp.data[offset:offset+blockLength]).payload
+
+			if fp.noisy {
+				write(newHaveMessage(0).serialize())
+				write((&peerMessage{id: messageKeepAlive}).serialize())
+				write(newPieceMessage(index, begin+1, []byte("unrequested")).serialize())
+			}
+
+			if fp.blockDelay > 0 {
+				key := [2]int{index, begin}
+				writeMutex.Lock()
+				delayed[key] = true
+				writeMutex.Unlock()
+				time.AfterFunc(fp.blockDelay, func() {
+					writeMutex.Lock()
+					defer writeMutex.Unlock()
+					if delayed[key] {
+						delete(delayed, key)
+						conn.Write(makePeerMessage(messagePiece, payload))
+					}
+				})
+				continue
+			}
+
+			if fp.holdRequests == 0 {
+				write(makePeerMessage(messagePiece, payload))
+				blocksSent++
+				if blocksSent == fp.chokeAfterBlocks {
+					writeMutex.Lock()
+					choked = true
+					conn.Write(makePeerMessage(messageChoke, nil))
+					writeMutex.Unlock()
+					time.AfterFunc(50*time.Millisecond, func() {
+						writeMutex.Lock()
+						defer writeMutex.Unlock()
+						choked = false
+						conn.Write(makePeerMessage(messageUnchoke, nil))
+					})
+				}
+				continue
+			}
+
+			if _, ok := remainingByPiece[index]; !ok {
+				pieceLength := min(fp.pieceLength, len(fp.data)-index*fp.pieceLength)
+				remainingByPiece[index] = calcExpectedBlocks(pieceLength)
+			}
+			held = append(held, payload)
+			if len(held) == min(fp.holdRequests, remainingByPiece[index]) {
+				for i := len(held) - 1; i >= 0; i-- {
+					write(makePeerMessage(messagePiece, held[i]))
+				}
+				remainingByPiece[index] -= len(held)
+				held = [][]byte{}
+			}
+		}
+	}
+}
+
+func makePeerMessage(id byte, payload []byte) []byte {
+	message := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+	message = append(message, id)
+	return append(message, payload...)
+}
+
+func makeTestTorrentData(length, pieceLength int) ([]byte, map[int]string) {
+	data := make([]byte, length)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	hashes := map[int]string{}
+	for i := 0; i*pieceLength < length; i++ {
+		end := min((i+1)*pieceLength, length)
+		hashes[i], _ = hashBytesNew(data[i*pieceLength : end])
+	}
+	return data, hashes
+}
+
+func TestPieceDownloaderReusesConnection(t *testing.T) {
+	pieceLength := 2 * sixteenKilobytes
+	data, hashes := makeTestTorrentData(5*pieceLength+100, pieceLength)
+	infoHash := bytes.Repeat([]byte{0x01}, 20)
+	fp := newFakePeer(t, infoHash, data, pieceLength)
+
+	pd := &pieceDownloader{
+		peerConnectionString: fp.address(),
+		infoHashBytes:        infoHash,
+		fileLength:           int64(len(data)),
+		pieceLength:          pieceLength,
+		pieceHashesByIndex:   hashes,
+	}
+	defer pd.close()
+
+	for i := 0; i < len(hashes); i++ {
+		piece, err := pd.Download(i)
+		if err != nil {
+			t.Fatalf("unexpected error downloading piece %d: %s", i, err.Error())
+		}
+		end := min((i+1)*pieceLength, len(data))
+		if !bytes.Equal(piece, data[i*pieceLength:end]) {
+			t.Fatalf("unexpected contents for piece %d", i)
+		}
+	}
+
+	if fp.connectionCount() != 1 {
+		t.Fatalf("unexpected number of connections: %d instead of 1", fp.connectionCount())
+	}
+	for i := 0; i < len(hashes); i++ {
+		if !pd.session.hasPiece(i) {
+			t.Fatalf("bitfield of peer was not recorded for piece %d", i)
+		}
+	}
+}
+
+// startIdleWorker runs a worker for a peer that only has piece 0, while the
+// picker has nothing queued yet.
+func startIdleWorker(t *testing.T, keepAliveInterval time.Duration) (*fakePeer, *piecePicker, []byte, chan downloadedPiece) {
+	pieceLength := sixteenKilobytes
+	data, hashes := makeTestTorrentData(2*pieceLength, pieceLength)
+	infoHash := bytes.Repeat([]byte{0x09}, 20)
+	fp := newFakePeer(t, infoHash, data, pieceLength, func(fp *fakePeer) {
+		fp.pieces = []int{0}
+	})
+
+	picker := newPiecePicker(int64(len(data)), pieceLength)
+	pd := &pieceDownloader{
+		peerConnectionString: fp.address(),
+		infoHashBytes:        infoHash,
+		fileLength:           int64(len(data)),
+		pieceLength:          pieceLength,
+		pieceHashesByIndex:   hashes,
+		keepAliveInterval:    keepAliveInterval,
+		picker:               picker,
+	}
+	results := make(chan downloadedPiece, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer pd.close()
+		pd.run(results, make(chan int, 1))
+	}()
+	t.Cleanup(func() {
+		picker.close()
+		pd.interrupt()
+		<-done
+	})
+	return fp, picker, data, results
+}
+
+func TestPieceDownloaderKeepsIdleSessionAlive(t *testing.T) {
+	fp, picker, data, results := startIdleWorker(t, 20*time.Millisecond)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for fp.keepAliveCount() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected number of keep-alives: %d", fp.keepAliveCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	picker.push(pieceToDownload{pieceIndex: 0, attempt: 1})
+	select {
+	case dp := <-results:
+		if !bytes.Equal(dp.piece, data[:sixteenKilobytes]) {
+			t.Fatalf("unexpected contents for piece 0")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("piece was not downloaded")
+	}
+	if fp.connectionCount() != 1 {
+		t.Fatalf("unexpected number of connections: %d instead of 1", fp.connectionCount())
+	}
+}
+
+func TestPieceDownloaderWakesUpForQueuedPieces(t *testing.T) {
+	// the peer stays silent for longer than the test runs, so only the
+	// picker can wake the worker up
+	fp, picker, _, results := startIdleWorker(t, time.Minute)
+	deadline := time.Now().Add(5 * time.Second)
+	for fp.connectionCount() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("worker did not connect")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	picker.push(pieceToDownload{pieceIndex: 0, attempt: 1})
+	select {
+	case <-results:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("worker was not woken up by the picker")
+	}
+	if fp.keepAliveCount() != 0 {
+		t.Fatalf("unexpected keep-alives: %d", fp.keepAliveCount())
+	}
+}
+
+func TestPeerSessionTracksHave(t *testing.T) {
+	s := &peerSession{bitfield: make([]byte, 2), numPieces: 10}
+	s.handleMessage(&peerMessage{id: messageBitfield, payload: []byte{0b10000000, 0}})
+	s.handleMessage(newHaveMessage(9))
+
+	for i := 0; i < 10; i++ {
+		expected := i == 0 || i == 9
+		if s.hasPiece(i) != expected {
+			t.Fatalf("unexpected hasPiece(%d): %v", i, s.hasPiece(i))
+		}
+	}
+
+	s.handleMessage(&peerMessage{id: messageUnchoke})
+	if s.choked {
+		t.Fatalf("expected session to be unchoked")
+	}
+	s.handleMessage(&peerMessage{id: messageChoke})
+	if !s.choked {
+		t.Fatalf("expected session to be choked")
+	}
+}
+
+func TestPeerSessionPipelinesRequests(t *testing.T) {
+	pieceLength := 5 * sixteenKilobytes
+	data, hashes := makeTestTorrentData(2*pieceLength-100, pieceLength)
+	infoHash := bytes.Repeat([]byte{0x01}, 20)
+	fp := newFakePeer(t, infoHash, data, pieceLength, func(fp *fakePeer) {
+		fp.holdRequests = 4
+	})
+
+	pd := &pieceDownloader{
+		peerConnectionString: fp.address(),
+		infoHashBytes:        infoHash,
+		fileLength:           int64(len(data)),
+		pieceLength:          pieceLength,
+		pieceHashesByIndex:   hashes,
+		requestQueueDepth:    4,
+	}
+	defer pd.close()
+
+	for i := 0; i < len(hashes); i++ {
+		piece, err := pd.Download(i)
+		if err != nil {
+			t.Fatalf("unexpected error downloading piece %d: %s", i, err.Error())
+		}
+		end := min((i+1)*pieceLength, len(data))
+		if !bytes.Equal(piece, data[i*pieceLength:end]) {
+			t.Fatalf("unexpected contents for piece %d", i)
+		}
+	}
+}
+
+func TestPeerSessionRespectsReqq(t *testing.T) {
+	pieceLength := 4 * sixteenKilobytes
+	data, hashes := makeTestTorrentData(pieceLength, pieceLength)
+	infoHash := bytes.Repeat([]byte{0x01}, 20)
+	fp := newFakePeer(t, infoHash, data, pieceLength, func(fp *fakePeer) {
+		fp.reqq = 2
+		fp.holdRequests = 2
+	})
+
+	pd := &pieceDownloader{
+		peerConnectionString: fp.address(),
+		infoHashBytes:        infoHash,
+		fileLength:           int64(len(data)),
+		pieceLength:          pieceLength,
+		pieceHashesByIndex:   hashes,
+		requestQueueDepth:    16,
+	}
+	defer pd.close()
+
+	if _, err := pd.Download(0); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if pd.session.queueDepth() != 2 {
+		t.Fatalf("unexpected queue depth: %d instead of 2", pd.session.queueDepth())
+	}
+}
+
+func TestParseDownloadArgs(t *testing.T) {
+	tests := []struct {
+		name            string
+		args            []string
+		expectedQueue   int
+		expectedEndgame bool
+		expectedError   string
+	}{
+		{
+			name:            "defaults",
+			args:            []string{"-o", "/tmp/out", "sample.torrent"},
+			expectedQueue:   defaultRequestQueueDepth,
+			expectedEndgame: true,
+		},
+		{
+			name:            "queue depth after the torrent",
+			args:            []string{"-o", "/tmp/out", "sample.torrent", "--queue-depth", "32"},
+			expectedQueue:   32,
+			expectedEndgame: true,
+		},
+		{
+			name:            "queue depth before the output",
+			args:            []string{"--queue-depth=4", "-o", "/tmp/out", "sample.torrent"},
+			expectedQueue:   4,
+			expectedEndgame: true,
+		},
+		{
+			name:          "no endgame",
+			args:          []string{"-o", "/tmp/out", "--no-endgame", "sample.torrent"},
+			expectedQueue: defaultRequestQueueDepth,
+		},
+		{
+			name:          "zero queue depth",
+			args:          []string{"-o", "/tmp/out", "--queue-depth", "0", "sample.torrent"},
+			expectedError: "queue depth must be positive",
+		},
+		{
+			name:          "negative queue depth",
+			args:          []string{"-o", "/tmp/out", "--queue-depth", "-1", "sample.torrent"},
+			expectedError: "queue depth must be positive",
+		},
+		{
+			name:          "missing output",
+			args:          []string{"sample.torrent"},
+			expectedError: "usage",
+		},
+		{
+			name:          "two sources",
+			args:          []string{"-o", "/tmp/out", "a.torrent", "b.torrent"},
+			expectedError: "usage",
+		},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			target, source, options, err := parseDownloadArgs("download", ts.args)
+			if ts.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), ts.expectedError) {
+					t.Fatalf("unexpected error: %v, expected one containing %q", err, ts.expectedError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if target != "/tmp/out" || source != "sample.torrent" || options.queueDepth != ts.expectedQueue || options.endgame != ts.expectedEndgame {
+				t.Fatalf("unexpected arguments: %s %s %+v", target, source, options)
+			}
+		})
+	}
+}
+
+func TestPeerSessionReRequestsAfterChoke(t *testing.T) {
+	pieceLength := 8 * sixteenKilobytes
+	data, hashes := makeTestTorrentData(pieceLength, pieceLength)
+	infoHash := bytes.Repeat([]byte{0x01}, 20)
+	fp := newFakePeer(t, infoHash, data, pieceLength, func(fp *fakePeer) {
+		fp.chokeAfterBlocks = 3
+	})
+
+	pd := &pieceDownloader{
+		peerConnectionString: fp.address(),
+		infoHashBytes:        infoHash,
+		fileLength:           int64(len(data)),
+		pieceLength:          pieceLength,
+		pieceHashesByIndex:   hashes,
+		requestQueueDepth:    5,
+	}
+	defer pd.close()
+
+	piece, err := pd.Download(0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !bytes.Equal(piece, data) {
+		t.Fatalf("unexpected piece contents")
+	}
+}
+
+func TestPeerSessionIgnoresInterleavedMessages(t *testing.T) {
+	pieceLength := 4 * sixteenKilobytes
+	data, hashes := makeTestTorrentData(2*pieceLength, pieceLength)
+	infoHash := bytes.Repeat([]byte{0x01}, 20)
+	fp := newFakePeer(t, infoHash, data, pieceLength, func(fp *fakePeer) {
+		fp.noisy = true
+	})
+
+	pd := &pieceDownloader{
+		peerConnectionString: fp.address(),
+		infoHashBytes:        infoHash,
+		fileLength:           int64(len(data)),
+		pieceLength:          pieceLength,
+		pieceHashesByIndex:   hashes,
+	}
+	defer pd.close()
+
+	for i := 0; i < len(hashes); i++ {
+		piece, err := pd.Download(i)
+		if err != nil {
+			t.Fatalf("unexpected error downloading piece %d: %s", i, err.Error())
+		}
+		if !bytes.Equal(piece, data[i*pieceLength:(i+1)*pieceLength]) {
+			t.Fatalf("unexpected contents for piece %d", i)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// number of pieces picked at random before switching to rarest first, so that
+// we quickly have something to offer to other peers
+const randomFirstPieces = 4
+
+// partialPiece holds the blocks of a piece received so far. It outlives a
+// failed download so that another peer can finish the piece instead of
+// starting over, and in endgame mode it is shared by every peer downloading
+// the piece.
+type partialPiece struct {
+	mu       sync.Mutex
+	data     []byte
+	received map[int]bool
+	// sessions with a request in flight for a block, by begin offset
+	requested map[int][]*peerSession
+}
+
+func newPartialPiece(pieceLength int) *partialPiece {
+	return &partialPiece{
+		data:      make([]byte, pieceLength),
+		received:  make(map[int]bool),
+		requested: make(map[int][]*peerSession),
+	}
+}
+
+func (pp *partialPiece) has(begin int) bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.received[begin]
+}
+
+func (pp *partialPiece) receivedBlocks() int {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return len(pp.received)
+}
+
+// request records that the session asked its peer for the block.
+func (pp *partialPiece) request(s *peerSession, begin int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.requested[begin] = append(pp.requested[begin], s)
+}
+
+// receive stores a block that arrived from the peer of session s. It returns
+// the other sessions that still have a request for the block in flight, and
+// whether the block completed the piece. Blocks that were already received
+// are ignored.
+func (pp *partialPiece) receive(s *peerSession, begin int, block []byte, expectedBlocks int) ([]*peerSession, bool) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if pp.received[begin] {
+		return nil, false
+	}
+	copy(pp.data[begin:], block)
+	pp.received[begin] = true
+
+	others := []*peerSession{}
+	for _, other := range pp.requested[begin] {
+		if other != s {
+			others = append(others, other)
+		}
+	}
+	delete(pp.requested, begin)
+	return others, len(pp.received) == expectedBlocks
+}
+
+// forget drops all requests of the session, once it stopped downloading.
+func (pp *partialPiece) forget(s *peerSession) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	for begin, sessions := range pp.requested {
+		kept := []*peerSession{}
+		for _, other := range sessions {
+			if other != s {
+				kept = append(kept, other)
+			}
+		}
+		pp.requested[begin] = kept
+	}
+}
+
+// reset throws away all blocks, after the piece failed its hash check.
+func (pp *partialPiece) reset() {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	clear(pp.received)
+}
+
+// piecePicker decides which piece a worker downloads next. It tracks how many
+// connected peers have every piece and prefers the rarest ones, after picking
+// the first few pieces at random. Partially downloaded pieces are always
+// finished before new pieces are started.
+//
+// In endgame mode, once every remaining piece is being downloaded, idle
+// workers are handed pieces that are already in flight, so that a single slow
+// peer cannot hold up the end of the download.
+type piecePicker struct {
+	mu           sync.Mutex
+	fileLength   int64
+	pieceLength  int
+	availability []int
+	queued       map[int]pieceToDownload
+	downloading  map[int]pieceToDownload
+	downloaders  map[int]int
+	done         map[int]bool
+	completed    int
+	closed       bool
+	endgame      bool
+	rand         *rand.Rand
+	// changed is closed and replaced whenever workers that found nothing to
+	// pop may find something now
+	changed chan struct{}
+}
+
+func newPiecePicker(fileLength int64, pieceLength int) *piecePicker {
+	return &piecePicker{
+		fileLength:   fileLength,
+		pieceLength:  pieceLength,
+		availability: make([]int, (fileLength+int64(pieceLength)-1)/int64(pieceLength)),
+		queued:       make(map[int]pieceToDownload),
+		downloading:  make(map[int]pieceToDownload),
+		downloaders:  make(map[int]int),
+		done:         make(map[int]bool),
+		rand:         rand.New(rand.NewSource(rand.Int63())),
+		changed:      make(chan struct{}),
+	}
+}
+
+// updated returns a channel that is closed on the next change that may let
+// an idle worker pop a piece.
+func (pp *piecePicker) updated() <-chan struct{} {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.changed
+}
+
+// wake wakes up the idle workers. The caller holds pp.mu.
+func (pp *piecePicker) wake() {
+	close(pp.changed)
+	pp.changed = make(chan struct{})
+}
+
+func (pp *piecePicker) setEndgame(endgame bool) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.endgame = endgame
+}
+
+// push queues a piece for download, either for the first time or again after
+// a failed attempt.
+func (pp *piecePicker) push(p pieceToDownload) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.queued[p.pieceIndex] = p
+	pp.wake()
+}
+
+// pop removes and returns the next piece to download from a peer that has the
+// pieces for which hasPiece returns true. The second result is false when the
+// peer has none of the queued pieces or the picker was closed.
+func (pp *piecePicker) pop(hasPiece func(pieceIndex int) bool) (pieceToDownload, bool) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	if pp.closed {
+		return pieceToDownload{}, false
+	}
+
+	candidates := []int{}
+	partial := []int{}
+	for pieceIndex, p := range pp.queued {
+		if !hasPiece(pieceIndex) {
+			continue
+		}
+		candidates = append(candidates, pieceIndex)
+		if p.partial != nil {
+			partial = append(partial, pieceIndex)
+		}
+	}
+
+	if len(candidates) == 0 {
+		if pp.endgame && len(pp.queued) == 0 {
+			return pp.popInFlight(hasPiece)
+		}
+		return pieceToDownload{}, false
+	}
+
+	var picked int
+	switch {
+	case len(partial) > 0:
+		picked = pp.rarest(partial)
+	case pp.completed < randomFirstPieces:
+		picked = candidates[pp.rand.Intn(len(candidates))]
+	default:
+		picked = pp.rarest(candidates)
+	}
+
+	p := pp.queued[picked]
+	delete(pp.queued, picked)
+	if p.partial == nil {
+		p.partial = newPartialPiece(getPieceLengthForIndex(pp.fileLength, pp.pieceLength, picked))
+	}
+	pp.downloading[picked] = p
+	pp.downloaders[picked]++
+	return p, true
+}
+
+// popInFlight returns a piece that is already being downloaded from another
+// peer, preferring the pieces with the fewest peers on them.
+func (pp *piecePicker) popInFlight(hasPiece func(pieceIndex int) bool) (pieceToDownload, bool) {
+	picked := -1
+	for pieceIndex := range pp.downloading {
+		if !hasPiece(pieceIndex) {
+			continue
+		}
+		if picked == -1 || pp.downloaders[pieceIndex] < pp.downloaders[picked] {
+			picked = pieceIndex
+		}
+	}
+	if picked == -1 {
+		return pieceToDownload{}, false
+	}
+
+	pp.downloaders[picked]++
+	return pp.downloading[picked], true
+}
+
+// release gives back a piece a worker failed to download. It reports whether
+// the piece has to be queued again, which is not the case when it was
+// completed or is still being downloaded by another worker.
+func (pp *piecePicker) release(p pieceToDownload) bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if pp.done[p.pieceIndex] {
+		return false
+	}
+	pp.downloaders[p.pieceIndex]--
+	if pp.downloaders[p.pieceIndex] > 0 {
+		return false
+	}
+	delete(pp.downloading, p.pieceIndex)
+	delete(pp.downloaders, p.pieceIndex)
+	pp.wake()
+	return true
+}
+
+// rarest returns the piece with the lowest availability, breaking ties at
+// random.
+func (pp *piecePicker) rarest(pieces []int) int {
+	best := []int{}
+	bestAvailability := -1
+	for _, pieceIndex := range pieces {
+		availability := pp.availability[pieceIndex]
+		if bestAvailability == -1 || availability < bestAvailability {
+			best = []int{pieceIndex}
+			bestAvailability = availability
+		} else if availability == bestAvailability {
+			best = append(best, pieceIndex)
+		}
+	}
+	return best[pp.rand.Intn(len(best))]
+}
+
+// pieceCompleted marks the piece as downloaded. It reports false when the
+// piece had already been completed by another worker.
+func (pp *piecePicker) pieceCompleted(pieceIndex int) bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if pp.done[pieceIndex] {
+		return false
+	}
+	pp.done[pieceIndex] = true
+	pp.completed++
+	delete(pp.downloading, pieceIndex)
+	delete(pp.downloaders, pieceIndex)
+	return true
+}
+
+// peerHasPiece records that one more connected peer has the piece.
+func (pp *piecePicker) peerHasPiece(pieceIndex int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if pieceIndex >= 0 && pieceIndex < len(pp.availability) {
+		pp.availability[pieceIndex]++
+		pp.wake()
+	}
+}
+
+// peerLostPiece records that a peer with the piece disconnected.
+func (pp *piecePicker) peerLostPiece(pieceIndex int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if pieceIndex >= 0 && pieceIndex < len(pp.availability) && pp.availability[pieceIndex] > 0 {
+		pp.availability[pieceIndex]--
+	}
+}
+
+func (pp *piecePicker) close() {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.closed = true
+	pp.wake()
+}
+
+func (pp *piecePicker) isClosed() bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.closed
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPiecePickerPopsOnlyPiecesThePeerHas(t *testing.T) {
+	pp := newPiecePicker(4*sixteenKilobytes, sixteenKilobytes)
+	for i := 0; i < 4; i++ {
+		pp.push(pieceToDownload{pieceIndex: i, attempt: 1})
+	}
+
+	odd := func(pieceIndex int) bool { return pieceIndex%2 == 1 }
+	none := func(pieceIndex int) bool { return false }
+
+	popped := map[int]bool{}
+	for i := 0; i < 2; i++ {
+		p, ok := pp.pop(odd)
+		if !ok || !odd(p.pieceIndex) {
+			t.Fatalf("unexpected piece: %d, %v", p.pieceIndex, ok)
+		}
+		popped[p.pieceIndex] = true
+	}
+	if len(popped) != 2 {
+		t.Fatalf("unexpected pieces: %v", popped)
+	}
+	if _, ok := pp.pop(odd); ok {
+		t.Fatalf("expected no piece for a peer without the remaining pieces")
+	}
+	if _, ok := pp.pop(none); ok {
+		t.Fatalf("expected no piece for a peer without pieces")
+	}
+
+	pp.close()
+	if _, ok := pp.pop(func(int) bool { return true }); ok {
+		t.Fatalf("expected no piece from a closed picker")
+	}
+}
+
+// newPiecePickerWithAvailability returns a picker that is past its random
+// first pieces, with all pieces queued and the given availability.
+func newPiecePickerWithAvailability(availability []int) *piecePicker {
+	pp := newPiecePicker(int64(len(availability)*sixteenKilobytes), sixteenKilobytes)
+	for pieceIndex, count := range availability {
+		pp.push(pieceToDownload{pieceIndex: pieceIndex, attempt: 1})
+		for i := 0; i < count; i++ {
+			pp.peerHasPiece(pieceIndex)
+		}
+	}
+	pp.completed = randomFirstPieces
+	return pp
+}
+
+func TestPiecePickerPicksRarestFirst(t *testing.T) {
+	all := func(int) bool { return true }
+
+	tests := []struct {
+		name         string
+		availability []int
+		lost         []int
+		expected     []int
+	}{
+		{
+			name:         "rarest piece first",
+			availability: []int{3, 1, 2, 5},
+			expected:     []int{1, 2, 0, 3},
+		},
+		{
+			name:         "availability drops when a peer leaves",
+			availability: []int{3, 1, 2, 5},
+			lost:         []int{3, 3, 3, 3, 3},
+			expected:     []int{3, 1, 2, 0},
+		},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			pp := newPiecePickerWithAvailability(ts.availability)
+			for _, pieceIndex := range ts.lost {
+				pp.peerLostPiece(pieceIndex)
+			}
+			for _, expected := range ts.expected {
+				p, ok := pp.pop(all)
+				if !ok || p.pieceIndex != expected {
+					t.Fatalf("unexpected piece: %d instead of %d", p.pieceIndex, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestPiecePickerBreaksTiesAtRandom(t *testing.T) {
+	all := func(int) bool { return true }
+
+	firstPicks := map[int]bool{}
+	for i := 0; i < 50; i++ {
+		pp := newPiecePickerWithAvailability([]int{2, 1, 1, 1, 3})
+		p, ok := pp.pop(all)
+		if !ok || pp.availability[p.pieceIndex] != 1 {
+			t.Fatalf("unexpected piece: %d", p.pieceIndex)
+		}
+		firstPicks[p.pieceIndex] = true
+	}
+	if len(firstPicks) < 2 {
+		t.Fatalf("expected ties to be broken at random, always got %v", firstPicks)
+	}
+}
+
+func TestPiecePickerPicksFirstPiecesAtRandom(t *testing.T) {
+	all := func(int) bool { return true }
+
+	firstPicks := map[int]bool{}
+	for i := 0; i < 50; i++ {
+		pp := newPiecePicker(8*sixteenKilobytes, sixteenKilobytes)
+		for pieceIndex := 0; pieceIndex < 8; pieceIndex++ {
+			pp.push(pieceToDownload{pieceIndex: pieceIndex, attempt: 1})
+		}
+		// piece 0 is by far the rarest, it must not always be picked first
+		for pieceIndex := 1; pieceIndex < 8; pieceIndex++ {
+			pp.peerHasPiece(pieceIndex)
+		}
+		p, _ := pp.pop(all)
+		firstPicks[p.pieceIndex] = true
+	}
+	if len(firstPicks) < 2 {
+		t.Fatalf("expected the first pieces to be picked at random, always got %v", firstPicks)
+	}
+}
+
+func TestPiecePickerFinishesPartialPiecesFirst(t *testing.T) {
+	all := func(int) bool { return true }
+
+	pp := newPiecePickerWithAvailability([]int{1, 5, 1})
+	p, _ := pp.pop(all)
+	pp.push(pieceToDownload{pieceIndex: 1, attempt: 2, partial: newPartialPiece(sixteenKilobytes)})
+	pp.push(pieceToDownload{pieceIndex: p.pieceIndex, attempt: 1})
+
+	p, ok := pp.pop(all)
+	if !ok || p.pieceIndex != 1 || p.partial == nil {
+		t.Fatalf("unexpected piece: %d, partial %v", p.pieceIndex, p.partial != nil)
+	}
+
+	// a peer without the partial piece still gets a new one
+	pp.push(p)
+	p, ok = pp.pop(func(pieceIndex int) bool { return pieceIndex != 1 })
+	if !ok || p.pieceIndex == 1 {
+		t.Fatalf("unexpected piece: %d", p.pieceIndex)
+	}
+}
+
+func TestDownloadFileUsingWorkersWithPartialSeeds(t *testing.T) {
+	pieceLength := 2 * sixteenKilobytes
+	data, hashes := makeTestTorrentData(6*pieceLength+500, pieceLength)
+	infoHash := bytes.Repeat([]byte{0x02}, 20)
+
+	even := newFakePeer(t, infoHash, data, pieceLength, func(fp *fakePeer) {
+		fp.pieces = []int{0, 2, 4, 6}
+	})
+	odd := newFakePeer(t, infoHash, data, pieceLength, func(fp *fakePeer) {
+		fp.pieces = []int{1}
+		fp.announceLater = []int{3, 5}
+	})
+
+	dir := t.TempDir()
+	di := downloadInfo{
+		infoHashBytes:      infoHash,
+		name:               "file",
+		files:              []torrentFile{{path: []string{"file"}, length: int64(len(data))}},
+		fileLength:         int64(len(data)),
+		pieceLength:        pieceLength,
+		pieceHashesByIndex: hashes,
+	}
+	target := filepath.Join(dir, "file")
+	if err := downloadFileUsingWorkers(target, []string{even.address(), odd.address()}, di); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	actual, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !bytes.Equal(actual, data) {
+		t.Fatalf("downloaded file does not match")
+	}
+
+	if even.unexpectedRequestCount()+odd.unexpectedRequestCount() > 0 {
+		t.Fatalf("pieces were requested from peers that do not have them")
+	}
+}
+
+func TestPiecePickerHandsOutPiecesInFlightInEndgame(t *testing.T) {
+	all := func(int) bool { return true }
+
+	tests := []struct {
+		name           string
+		endgame        bool
+		expectInFlight bool
+	}{
+		{name: "endgame", endgame: true, expectInFlight: true},
+		{name: "no endgame", endgame: false, expectInFlight: false},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			pp := newPiecePicker(sixteenKilobytes, sixteenKilobytes)
+			pp.setEndgame(ts.endgame)
+			pp.push(pieceToDownload{pieceIndex: 0, attempt: 1})
+
+			first, _ := pp.pop(all)
+			second, ok := pp.pop(all)
+			if ok != ts.expectInFlight {
+				t.Fatalf("unexpected result popping a piece in flight: %v", ok)
+			}
+			if !ok {
+				return
+			}
+			if second.pieceIndex != 0 || second.partial != first.partial {
+				t.Fatalf("expected the piece in flight to be shared")
+			}
+
+			if pp.release(first) {
+				t.Fatalf("expected the piece to stay with the other worker")
+			}
+			if !pp.pieceCompleted(0) || pp.pieceCompleted(0) {
+				t.Fatalf("expected the piece to be completed exactly once")
+			}
+			if pp.release(second) {
+				t.Fatalf("expected a completed piece not to be queued again")
+			}
+		})
+	}
+}
+
+func TestDownloadFileUsingWorkersWithSlowPeer(t *testing.T) {
+	pieceLength := 2 * sixteenKilobytes
+	data, hashes := makeTestTorrentData(6*pieceLength+500, pieceLength)
+	infoHash := bytes.Repeat([]byte{0x03}, 20)
+	blockDelay := 500 * time.Millisecond
+
+	tests := []struct {
+		name    string
+		args    []string
+		endgame bool
+	}{
+		{name: "endgame", args: []string{}, endgame: true},
+		{name: "no endgame", args: []string{"--no-endgame"}, endgame: false},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			// the slow peer is the only one to have piece 0 at first, so it
+			// is guaranteed to be downloading a piece when the others are done
+			slow := newFakePeer(t, infoHash, data, pieceLength, func(fp *fakePeer) {
+				fp.blockDelay = blockDelay
+			})
+			fakePeers := []*fakePeer{slow}
+			peers := []string{slow.address()}
+			for i := 0; i < 3; i++ {
+				fast := newFakePeer(t, infoHash, data, pieceLength, func(fp *fakePeer) {
+					fp.pieces = []int{1, 2, 3, 4, 5, 6}
+					fp.announceLater = []int{0}
+				})
+				fakePeers = append(fakePeers, fast)
+				peers = append(peers, fast.address())
+			}
+
+			dir := t.TempDir()
+			target := filepath.Join(dir, "file")
+			_, _, options, err := parseDownloadArgs("download", append([]string{"-o", target, "test.torrent"}, ts.args...))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			di := downloadInfo{
+				infoHashBytes:      infoHash,
+				name:               "file",
+				files:              []torrentFile{{path: []string{"file"}, length: int64(len(data))}},
+				fileLength:         int64(len(data)),
+				pieceLength:        pieceLength,
+				pieceHashesByIndex: hashes,
+			}
+			options.apply(&di)
+			if di.endgame != ts.endgame {
+				t.Fatalf("unexpected endgame: %v", di.endgame)
+			}
+			start := time.Now()
+			if err := downloadFileUsingWorkers(target, peers, di); err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			elapsed := time.Since(start)
+
+			actual, err := os.ReadFile(target)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if !bytes.Equal(actual, data) {
+				t.Fatalf("downloaded file does not match")
+			}
+
+			if ts.endgame {
+				if elapsed >= blockDelay {
+					t.Fatalf("expected endgame to finish before the slow peer: took %s", elapsed)
+				}
+				// the cancel messages may still be on their way
+				for i := 0; i < 100 && slow.cancelCount() == 0; i++ {
+					time.Sleep(10 * time.Millisecond)
+				}
+				if slow.cancelCount() == 0 {
+					t.Fatalf("expected the slow peer to get cancel messages")
+				}
+			} else {
+				if elapsed < blockDelay {
+					t.Fatalf("expected to wait for the slow peer: took %s", elapsed)
+				}
+				requested := map[[2]int]int{}
+				for _, fp := range fakePeers {
+					if fp.cancelCount() > 0 {
+						t.Fatalf("unexpected cancel messages without endgame: %d", fp.cancelCount())
+					}
+					for block, n := range fp.requestCounts() {
+						requested[block] += n
+					}
+				}
+				for block, n := range requested {
+					if n != 1 {
+						t.Fatalf("block %v was requested %d times without endgame", block, n)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestGetPieceLengthForIndex(t *testing.T) {
+	tests := []struct {
+		name       string
+		fileLength int64
+		pieceIndex int
+		expected   int
+	}{
+		{name: "first piece", fileLength: 10, pieceIndex: 0, expected: 4},
+		{name: "last piece", fileLength: 10, pieceIndex: 2, expected: 2},
+		{name: "last full piece", fileLength: 12, pieceIndex: 2, expected: 4},
+		{name: "past the end", fileLength: 12, pieceIndex: 3, expected: 0},
+		{name: "negative index", fileLength: 12, pieceIndex: -1, expected: 0},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			actual := getPieceLengthForIndex(ts.fileLength, 4, ts.pieceIndex)
+			if actual != ts.expected {
+				t.Fatalf("unexpected length: %d instead of %d", actual, ts.expected)
+			}
+		})
+	}
+}
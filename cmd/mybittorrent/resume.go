@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// how often a running download writes its resume data. Pieces completed
+// since the last write are downloaded again when the process dies.
+const resumeSaveInterval = 30 * time.Second
+
+// resumeFilePath is where the fast-resume data of a download is kept, next to
+// the downloaded file or directory.
+func resumeFilePath(downloadTarget, name string, multiFile bool) string {
+	if !multiFile {
+		return downloadTarget + ".resume"
+	}
+	return filepath.Join(downloadTarget, name+".resume")
+}
+
+// saveResumeData records which pieces are on disk, together with the size and
+// modification time of every file, so that a restarted download can trust it
+// without hashing everything again. The file is replaced atomically.
+func saveResumeData(path string, infoHash []byte, have []bool, paths []string) error {
+	bitfield := make([]byte, (len(have)+7)/8)
+	for pieceIndex, ok := range have {
+		if ok {
+			bitfield[pieceIndex/8] |= 1 << (7 - uint(pieceIndex%8))
+		}
+	}
+
+	files, err := resumeFileStamps(paths)
+	if err != nil {
+		return err
+	}
+
+	encoded, err := encodeBencode(map[string]any{
+		"info hash": string(infoHash),
+		"pieces":    string(bitfield),
+		"files":     files,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode resume data: %s", err.Error())
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, encoded, 0644); err != nil {
+		return fmt.Errorf("failed to write resume data: %s", err.Error())
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write resume data: %s", err.Error())
+	}
+	return nil
+}
+
+// resumeSaver writes the resume data of a running download, at most once per
+// interval, as rewriting it and stating every file after each piece costs
+// more than the pieces it would save from being downloaded again.
+type resumeSaver struct {
+	path     string
+	infoHash []byte
+	paths    []string
+	interval time.Duration
+	now      func() time.Time
+
+	lastSave time.Time
+}
+
+func newResumeSaver(path string, infoHash []byte, paths []string) *resumeSaver {
+	s := &resumeSaver{
+		path:     path,
+		infoHash: infoHash,
+		paths:    paths,
+		interval: resumeSaveInterval,
+		now:      time.Now,
+	}
+	s.lastSave = s.now()
+	return s
+}
+
+// pieceWritten saves the resume data when the interval has passed since it
+// was last saved.
+func (s *resumeSaver) pieceWritten(have []bool) error {
+	if s.now().Sub(s.lastSave) < s.interval {
+		return nil
+	}
+	return s.save(have)
+}
+
+// save writes the resume data right away, for when the download stops.
+func (s *resumeSaver) save(have []bool) error {
+	s.lastSave = s.now()
+	return saveResumeData(s.path, s.infoHash, have, s.paths)
+}
+
+// loadResumeData reads the pieces recorded by saveResumeData. The second
+// result is false when there is no resume data, or when it belongs to another
+// torrent or the files changed since it was written.
+func loadResumeData(path string, infoHash []byte, numPieces int, paths []string) ([]bool, bool) {
+	contents, err := os.ReadFile(path)
+	if err != nil || len(contents) == 0 {
+		return nil, false
+	}
+
+	decoded, _, err := decodeBencode(contents)
+	if err != nil {
+		return nil, false
+	}
+	dict, ok := decoded.(map[string]any)
+	if !ok {
+		return nil, false
+	}
+
+	storedHash, _ := dict["info hash"].(string)
+	bitfield, _ := dict["pieces"].(string)
+	if storedHash != string(infoHash) || len(bitfield) != (numPieces+7)/8 {
+		return nil, false
+	}
+
+	files, err := resumeFileStamps(paths)
+	if err != nil {
+		return nil, false
+	}
+	storedFiles, _ := encodeBencode(dict["files"])
+	currentFiles, _ := encodeBencode(files)
+	if !bytes.Equal(storedFiles, currentFiles) {
+		return nil, false
+	}
+
+	have := make([]bool, numPieces)
+	for pieceIndex := range have {
+		have[pieceIndex] = bitfield[pieceIndex/8]>>(7-uint(pieceIndex%8))&1 != 0
+	}
+	return have, true
+}
+
+// resumeFileStamps returns the size and modification time of every file, as
+// a bencode list of [size, mtime] pairs.
+func resumeFileStamps(paths []string) ([]any, error) {
+	stamps := []any{}
+	for _, path := range paths {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat file %s: %s", path, err.Error())
+		}
+		stamps = append(stamps, []any{stat.Size(), stat.ModTime().UnixNano()})
+	}
+	return stamps, nil
+}
+
+// checkPieces hashes the pieces that are already on disk and reports which of
+// them match the torrent.
+func checkPieces(storage *pieceStorage, fileLength int64, pieceLength int, pieceHashesByIndex map[int]string) ([]bool, error) {
+	statuses, err := hashPieces(len(pieceHashesByIndex), pieceHashesByIndex, func(pieceIndex int) ([]byte, error) {
+		return storage.readPiece(pieceIndex, getPieceLengthForIndex(fileLength, pieceLength, pieceIndex))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	have := make([]bool, len(statuses))
+	for pieceIndex, status := range statuses {
+		have[pieceIndex] = status == pieceGood
+	}
+	return have, nil
+}
+
+// existingData reports whether any of the files already has data in it.
+func existingData(paths []string) bool {
+	for _, path := range paths {
+		if stat, err := os.Stat(path); err == nil && stat.Size() > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadFileUsingWorkersResumes(t *testing.T) {
+	pieceLength := sixteenKilobytes
+	data, hashes := makeTestTorrentData(6*pieceLength+100, pieceLength)
+	infoHash := bytes.Repeat([]byte{0x08}, 20)
+
+	tests := []struct {
+		name string
+		// prepare leaves the data of a previous, interrupted run in target
+		prepare func(t *testing.T, target string)
+		// pieces that must not be downloaded again
+		present []int
+		// pieces that must be downloaded although their data is on disk
+		downloaded []int
+	}{
+		{
+			name: "nothing downloaded yet",
+			prepare: func(t *testing.T, target string) {
+			},
+		},
+		{
+			name: "hash check of existing data",
+			prepare: func(t *testing.T, target string) {
+				partial := bytes.Repeat([]byte{0xff}, len(data))
+				copy(partial, data[:2*pieceLength])
+				copy(partial[4*pieceLength:], data[4*pieceLength:5*pieceLength])
+				if err := os.WriteFile(target, partial, 0644); err != nil {
+					t.Fatalf("unexpected error: %s", err.Error())
+				}
+			},
+			present: []int{0, 1, 4},
+		},
+		{
+			name: "fast resume data",
+			prepare: func(t *testing.T, target string) {
+				// the data of piece 3 is correct but was never recorded, it
+				// is only picked up when the resume data is not trusted
+				partial := make([]byte, len(data))
+				copy(partial, data[:4*pieceLength])
+				if err := os.WriteFile(target, partial, 0644); err != nil {
+					t.Fatalf("unexpected error: %s", err.Error())
+				}
+				have := []bool{true, true, true, false, false, false, false}
+				if err := saveResumeData(target+".resume", infoHash, have, []string{target}); err != nil {
+					t.Fatalf("unexpected error: %s", err.Error())
+				}
+			},
+			present:    []int{0, 1, 2},
+			downloaded: []int{3},
+		},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			peer := newFakePeer(t, infoHash, data, pieceLength)
+			target := filepath.Join(t.TempDir(), "file")
+			di := downloadInfo{
+				infoHashBytes:      infoHash,
+				name:               "file",
+				files:              []torrentFile{{path: []string{"file"}, length: int64(len(data))}},
+				fileLength:         int64(len(data)),
+				pieceLength:        pieceLength,
+				pieceHashesByIndex: hashes,
+			}
+			ts.prepare(t, target)
+
+			if err := downloadFileUsingWorkers(target, []string{peer.address()}, di); err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			actual, err := os.ReadFile(target)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if !bytes.Equal(actual, data) {
+				t.Fatalf("downloaded file does not match")
+			}
+			for _, pieceIndex := range ts.present {
+				if peer.wasRequested(pieceIndex) {
+					t.Fatalf("piece %d was downloaded again", pieceIndex)
+				}
+			}
+			for _, pieceIndex := range ts.downloaded {
+				if !peer.wasRequested(pieceIndex) {
+					t.Fatalf("piece %d was not downloaded", pieceIndex)
+				}
+			}
+			if _, err := os.Stat(target + ".resume"); !os.IsNotExist(err) {
+				t.Fatalf("expected resume data to be removed after the download")
+			}
+		})
+	}
+}
+
+func TestLoadResumeDataRejectsChangedFiles(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(target, []byte("some data"), 0644); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	infoHash := bytes.Repeat([]byte{0x09}, 20)
+	resumePath := target + ".resume"
+	if err := saveResumeData(resumePath, infoHash, []bool{true, false, true}, []string{target}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	have, ok := loadResumeData(resumePath, infoHash, 3, []string{target})
+	if !ok || !have[0] || have[1] || !have[2] {
+		t.Fatalf("unexpected resume data: %v, %v", have, ok)
+	}
+
+	if _, ok := loadResumeData(resumePath, bytes.Repeat([]byte{0x0a}, 20), 3, []string{target}); ok {
+		t.Fatalf("expected resume data of another torrent to be rejected")
+	}
+
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(target, later, later); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if _, ok := loadResumeData(resumePath, infoHash, 3, []string{target}); ok {
+		t.Fatalf("expected resume data to be rejected after the file changed")
+	}
+}
+
+func TestResumeSaverSavesPeriodically(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(target, []byte("some data"), 0644); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	infoHash := bytes.Repeat([]byte{0x0b}, 20)
+	resumePath := target + ".resume"
+
+	clock := &fakeClock{current: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	saver := newResumeSaver(resumePath, infoHash, []string{target})
+	saver.now = clock.now
+	saver.lastSave = clock.now()
+
+	if err := saver.pieceWritten([]bool{true, false, false}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if _, err := os.Stat(resumePath); !os.IsNotExist(err) {
+		t.Fatalf("expected no resume data before the interval passed")
+	}
+
+	clock.advance(saver.interval)
+	if err := saver.pieceWritten([]bool{true, true, false}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if err := saver.pieceWritten([]bool{true, true, true}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	have, ok := loadResumeData(resumePath, infoHash, 3, []string{target})
+	if !ok || !have[0] || !have[1] || have[2] {
+		t.Fatalf("unexpected resume data: %v, %v", have, ok)
+	}
+
+	if err := saver.save([]bool{true, true, true}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	have, ok = loadResumeData(resumePath, infoHash, 3, []string{target})
+	if !ok || !have[0] || !have[1] || !have[2] {
+		t.Fatalf("unexpected resume data after saving: %v, %v", have, ok)
+	}
+}
+
+func TestDownloadFileUsingWorkersSavesResumeDataOnExit(t *testing.T) {
+	pieceLength := sixteenKilobytes
+	data, hashes := makeTestTorrentData(6*pieceLength+100, pieceLength)
+	infoHash := bytes.Repeat([]byte{0x0c}, 20)
+	// the peer sends data that does not match the hashes of the last pieces,
+	// so the download gives up on them
+	corrupted := map[int]string{}
+	for pieceIndex, hash := range hashes {
+		corrupted[pieceIndex] = hash
+		if pieceIndex >= 3 {
+			corrupted[pieceIndex] = strings.Repeat("00", 20)
+		}
+	}
+	peer := newFakePeer(t, infoHash, data, pieceLength)
+	target := filepath.Join(t.TempDir(), "file")
+	di := downloadInfo{
+		infoHashBytes:      infoHash,
+		name:               "file",
+		files:              []torrentFile{{path: []string{"file"}, length: int64(len(data))}},
+		fileLength:         int64(len(data)),
+		pieceLength:        pieceLength,
+		pieceHashesByIndex: corrupted,
+	}
+
+	if err := downloadFileUsingWorkers(target, []string{peer.address()}, di); err == nil {
+		t.Fatalf("expected the download to stop with pieces missing")
+	}
+
+	have, ok := loadResumeData(target+".resume", infoHash, len(hashes), []string{target})
+	if !ok {
+		t.Fatalf("expected resume data after the download stopped")
+	}
+	for pieceIndex, expected := range []bool{true, true, true, false, false, false, false} {
+		if have[pieceIndex] != expected {
+			t.Fatalf("unexpected resume data: %v", have)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// port we announce to trackers and accept incoming peer connections on
+const listenPort = 6881
+
+// peers that send nothing, not even keep-alives, for this long are dropped
+const seedIdleTimeout = 3 * time.Minute
+
+// how long a write to a peer may block before the peer is given up on
+const peerWriteTimeout = 30 * time.Second
+
+// largest block a peer may request, anything bigger is considered abusive
+const maxRequestLength = 128 * 1024
+
+// how often we announce while seeding. The interval of the tracker is used
+// when it sends one, but never below the minimum, and failed announces are
+// retried after the retry interval.
+const (
+	defaultAnnounceInterval = 30 * time.Minute
+	minAnnounceInterval     = time.Minute
+	announceRetryInterval   = 5 * time.Minute
+)
+
+// seedTorrent is a torrent whose data we have on disk and serve to others.
+type seedTorrent struct {
+	infoHash    []byte
+	fileLength  int64
+	pieceLength int
+	numPieces   int
+	storage     *pieceStorage
+	// bitfield of the pieces we verified and are willing to serve
+	bitfield []byte
+	// choker decides which of the connected peers we upload to
+	choker *choker
+}
+
+func (t *seedTorrent) hasPiece(pieceIndex int) bool {
+	if pieceIndex < 0 || pieceIndex >= t.numPieces {
+		return false
+	}
+	return t.bitfield[pieceIndex/8]>>(7-uint(pieceIndex%8))&1 != 0
+}
+
+// openSeedTorrent opens the data of a torrent and hashes every piece, so that
+// we only ever offer pieces that match the torrent.
+func openSeedTorrent(dataPath string, infoHash []byte, name string, files []torrentFile, multiFile bool, fileLength int64, pieceLength int, pieceHashesByIndex map[int]string) (*seedTorrent, error) {
+	paths, err := filePaths(dataPath, name, files, multiFile)
+	if err != nil {
+		return nil, err
+	}
+	storage, err := openExistingPieceStorage(paths, files, pieceLength)
+	if err != nil {
+		return nil, err
+	}
+
+	numPieces := len(pieceHashesByIndex)
+	t := &seedTorrent{
+		infoHash:    infoHash,
+		fileLength:  fileLength,
+		pieceLength: pieceLength,
+		numPieces:   numPieces,
+		storage:     storage,
+		bitfield:    make([]byte, (numPieces+7)/8),
+	}
+
+	have, err := checkPieces(storage, fileLength, pieceLength, pieceHashesByIndex)
+	if err != nil {
+		storage.close()
+		return nil, err
+	}
+	for pieceIndex, ok := range have {
+		if ok {
+			t.bitfield[pieceIndex/8] |= 1 << (7 - uint(pieceIndex%8))
+		}
+	}
+
+	return t, nil
+}
+
+// seeder accepts incoming peer connections and serves the pieces of the
+// torrents it was given.
+type seeder struct {
+	listener net.Listener
+	peerID   []byte
+
+	mu       sync.Mutex
+	torrents map[string]*seedTorrent
+	conns    map[net.Conn]bool
+	closed   bool
+}
+
+func newSeeder(address string) (*seeder, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %s", address, err.Error())
+	}
+	return &seeder{
+		listener: listener,
+		peerID:   createRandomID(),
+		torrents: make(map[string]*seedTorrent),
+		conns:    make(map[net.Conn]bool),
+	}, nil
+}
+
+func (s *seeder) address() string {
+	return s.listener.Addr().String()
+}
+
+// addTorrent starts serving the torrent. Once we have all of its pieces
+// peers are ranked by how fast we upload to them.
+func (s *seeder) addTorrent(t *seedTorrent) {
+	complete := true
+	for pieceIndex := 0; pieceIndex < t.numPieces; pieceIndex++ {
+		complete = complete && t.hasPiece(pieceIndex)
+	}
+	t.choker = newChoker()
+	t.choker.setSeedMode(complete)
+	t.choker.start()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.torrents[string(t.infoHash)] = t
+}
+
+func (s *seeder) torrent(infoHash []byte) *seedTorrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.torrents[string(infoHash)]
+}
+
+// serve accepts connections until the seeder is closed.
+func (s *seeder) serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return fmt.Errorf("failed to accept connection: %s", err.Error())
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = true
+		s.mu.Unlock()
+
+		go func() {
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				conn.Close()
+			}()
+			if err := s.handle(conn); err != nil {
+				fmt.Printf("closing connection to %s: %s\n", conn.RemoteAddr(), err.Error())
+			}
+		}()
+	}
+}
+
+// handle runs the peer wire protocol for one incoming connection. Whether
+// the peer is choked is up to the choker of the torrent.
+func (s *seeder) handle(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(peerReadTimeout))
+	message, err := readExactLength(conn, 68)
+	if err != nil {
+		return fmt.Errorf("failed to read handshake: %s", err.Error())
+	}
+
+	hs := &handshake{}
+	if err := hs.parseMessage(message); err != nil {
+		return fmt.Errorf("failed to parse handshake: %s", err.Error())
+	}
+	if !bytes.Equal(message[0:20], []byte("\x13BitTorrent protocol")) {
+		return fmt.Errorf("unexpected protocol in handshake")
+	}
+
+	t := s.torrent(hs.infoHash)
+	if t == nil {
+		return fmt.Errorf("unknown info hash %x", hs.infoHash)
+	}
+
+	response := handshake{infoHash: t.infoHash, peerID: s.peerID}
+	if _, err := conn.Write(response.makeMessage()); err != nil {
+		return fmt.Errorf("failed to write handshake: %s", err.Error())
+	}
+	bitfield := &peerMessage{id: messageBitfield, payload: t.bitfield}
+	if _, err := conn.Write(bitfield.serialize()); err != nil {
+		return fmt.Errorf("failed to write bitfield: %s", err.Error())
+	}
+	conn.SetDeadline(time.Time{})
+
+	// shared with our download session to the same peer, if there is one
+	stats := acquireTransferStats(t.infoHash, hs.peerID)
+	defer releaseTransferStats(t.infoHash, hs.peerID)
+	peer := newChokedPeer(stats, func(message *peerMessage) error {
+		conn.SetWriteDeadline(time.Now().Add(peerWriteTimeout))
+		_, err := conn.Write(message.serialize())
+		return err
+	})
+	t.choker.addPeer(peer)
+	defer t.choker.removePeer(peer)
+
+	reader := newMessageReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(seedIdleTimeout))
+		message, err := reader.readMessage()
+		if err != nil {
+			return err
+		}
+
+		switch message.id {
+		case messageInterested:
+			t.choker.setInterested(peer, true)
+		case messageNotInterested:
+			t.choker.setInterested(peer, false)
+		case messageRequest:
+			index, begin, length, err := message.request()
+			if err != nil {
+				return err
+			}
+			// requests sent while choked are dropped, as per the protocol
+			if t.choker.isChoked(peer) {
+				continue
+			}
+			if err := s.serveBlock(conn, t, index, begin, length); err != nil {
+				return err
+			}
+			stats.addUploaded(length)
+		}
+	}
+}
+
+func (s *seeder) serveBlock(conn net.Conn, t *seedTorrent, index, begin, length int) error {
+	if !t.hasPiece(index) {
+		return fmt.Errorf("requested piece %d which we do not have", index)
+	}
+	pieceLength := getPieceLengthForIndex(t.fileLength, t.pieceLength, index)
+	if begin < 0 || length <= 0 || length > maxRequestLength || begin+length > pieceLength {
+		return fmt.Errorf("invalid request for piece %d: %d+%d", index, begin, length)
+	}
+
+	block, err := t.storage.readBlock(index, begin, length)
+	if err != nil {
+		return fmt.Errorf("failed to read block: %s", err.Error())
+	}
+	conn.SetWriteDeadline(time.Now().Add(peerWriteTimeout))
+	if _, err := conn.Write(newPieceMessage(index, begin, block).serialize()); err != nil {
+		return fmt.Errorf("failed to write piece: %s", err.Error())
+	}
+	return nil
+}
+
+// close stops accepting connections and drops the connected peers.
+func (s *seeder) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for _, t := range s.torrents {
+		t.choker.close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return s.listener.Close()
+}
+
+// seedAnnouncer keeps telling the trackers that we are seeding a torrent, so
+// that they keep handing us out to peers.
+type seedAnnouncer struct {
+	tiers    *announceTiers
+	infoHash []byte
+	left     int64
+
+	defaultInterval time.Duration
+	minInterval     time.Duration
+	retryInterval   time.Duration
+}
+
+func newSeedAnnouncer(tiers *announceTiers, infoHash []byte, left int64) *seedAnnouncer {
+	return &seedAnnouncer{
+		tiers:           tiers,
+		infoHash:        infoHash,
+		left:            left,
+		defaultInterval: defaultAnnounceInterval,
+		minInterval:     minAnnounceInterval,
+		retryInterval:   announceRetryInterval,
+	}
+}
+
+// run announces until the context is done. Failing to reach the trackers
+// is only logged, peers that already know about us can still connect.
+func (a *seedAnnouncer) run(ctx context.Context) {
+	for {
+		interval := a.defaultInterval
+		if _, trackerInterval, err := announceToTiers(a.tiers, a.infoHash, a.left); err != nil {
+			fmt.Printf("failed to announce to trackers: %s\n", err.Error())
+			interval = a.retryInterval
+		} else if trackerInterval > 0 {
+			interval = max(trackerInterval, a.minInterval)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func seed(file, dataPath string) error {
+	m, err := loadMetainfo(file, false)
+	if err != nil {
+		return err
+	}
+	fileLength := m.Info.TotalLength()
+	pieceLength := m.Info.PieceLength
+
+	t, err := openSeedTorrent(dataPath, m.InfoHash[:], m.Info.Name, m.Info.Files, m.Info.MultiFile, fileLength, pieceLength, m.Info.pieceHashesByIndex())
+	if err != nil {
+		return fmt.Errorf("failed to open torrent data: %s", err.Error())
+	}
+	defer t.storage.close()
+
+	available := 0
+	left := int64(0)
+	for pieceIndex := 0; pieceIndex < t.numPieces; pieceIndex++ {
+		if t.hasPiece(pieceIndex) {
+			available++
+		} else {
+			left += int64(getPieceLengthForIndex(fileLength, pieceLength, pieceIndex))
+		}
+	}
+	fmt.Printf("verified %d of %d pieces\n", available, t.numPieces)
+
+	s, err := newSeeder(":" + strconv.Itoa(listenPort))
+	if err != nil {
+		return err
+	}
+	s.addTorrent(t)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		s.close()
+	}()
+
+	// let the trackers know we are here while we already accept connections,
+	// peers will come to us
+	go newSeedAnnouncer(m.trackerTiers(), m.InfoHash[:], left).run(ctx)
+
+	fmt.Println("seeding on", s.address())
+	return s.serve()
+}
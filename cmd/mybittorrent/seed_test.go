@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func startTestSeeder(t *testing.T, infoHash, data []byte, pieceLength int, hashes map[int]string) (*seeder, *seedTorrent) {
+	dataPath := filepath.Join(t.TempDir(), "seed")
+	if err := os.WriteFile(dataPath, data, 0644); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	files := []torrentFile{{path: []string{"seed"}, length: int64(len(data))}}
+	torrent, err := openSeedTorrent(dataPath, infoHash, "seed", files, false, int64(len(data)), pieceLength, hashes)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	t.Cleanup(func() { torrent.storage.close() })
+
+	s, err := newSeeder("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	s.addTorrent(torrent)
+	go s.serve()
+	t.Cleanup(func() { s.close() })
+	return s, torrent
+}
+
+func TestSeederServesPieces(t *testing.T) {
+	pieceLength := 2 * sixteenKilobytes
+	data, hashes := makeTestTorrentData(3*pieceLength+100, pieceLength)
+	infoHash := bytes.Repeat([]byte{0x04}, 20)
+	s, _ := startTestSeeder(t, infoHash, data, pieceLength, hashes)
+
+	target := filepath.Join(t.TempDir(), "file")
+	di := downloadInfo{
+		infoHashBytes:      infoHash,
+		name:               "file",
+		files:              []torrentFile{{path: []string{"file"}, length: int64(len(data))}},
+		fileLength:         int64(len(data)),
+		pieceLength:        pieceLength,
+		pieceHashesByIndex: hashes,
+	}
+	if err := downloadFileUsingWorkers(target, []string{s.address()}, di); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	actual, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !bytes.Equal(actual, data) {
+		t.Fatalf("downloaded file does not match")
+	}
+}
+
+func TestSeederOnlyOffersVerifiedPieces(t *testing.T) {
+	pieceLength := sixteenKilobytes
+	data, hashes := makeTestTorrentData(4*pieceLength, pieceLength)
+	hashes[2] = strings.Repeat("0", 40)
+	infoHash := bytes.Repeat([]byte{0x05}, 20)
+	_, torrent := startTestSeeder(t, infoHash, data, pieceLength, hashes)
+
+	for pieceIndex, expected := range []bool{true, true, false, true} {
+		if torrent.hasPiece(pieceIndex) != expected {
+			t.Fatalf("unexpected availability of piece %d: %v", pieceIndex, !expected)
+		}
+	}
+}
+
+func TestSeederRejectsUnknownInfoHash(t *testing.T) {
+	data, hashes := makeTestTorrentData(sixteenKilobytes, sixteenKilobytes)
+	s, _ := startTestSeeder(t, bytes.Repeat([]byte{0x06}, 20), data, sixteenKilobytes, hashes)
+
+	hs := handshake{infoHash: bytes.Repeat([]byte{0x07}, 20), peerID: createRandomID()}
+	if _, err := doHandshakeWithPeer(s.address(), &hs); err == nil {
+		t.Fatalf("expected the handshake for an unknown torrent to fail")
+	}
+}
+
+func TestSeedAnnouncerKeepsAnnouncing(t *testing.T) {
+	// the first announce fails, which must not stop the later ones
+	var mu sync.Mutex
+	announces := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		announces++
+		if announces == 1 {
+			w.Write([]byte("d14:failure reason4:nopee"))
+			return
+		}
+		w.Write([]byte("d5:peers0:e"))
+	}))
+	t.Cleanup(server.Close)
+
+	announcer := newSeedAnnouncer(newAnnounceTiers([][]string{{server.URL}}), bytes.Repeat([]byte{0x05}, 20), 0)
+	announcer.defaultInterval = 10 * time.Millisecond
+	announcer.retryInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		announcer.run(ctx)
+		close(done)
+	}()
+
+	// the retry and then a regular announce
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := announces
+		mu.Unlock()
+		if n >= 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected number of announces: %d", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("announcer did not stop")
+	}
+}
+
+// connectTestLeecher connects to the seeder as the peer with the given ID and
+// returns the connection along with the number of blocks received on it.
+func connectTestLeecher(t *testing.T, address string, infoHash, peerID []byte) (net.Conn, chan struct{}) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	t.Cleanup(func() { conn.Close() })
+	if _, err := doHandshakeOnConnection(conn, &handshake{infoHash: infoHash, peerID: peerID}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	blocks := make(chan struct{}, 100)
+	go func() {
+		reader := newMessageReader(conn)
+		for {
+			message, err := reader.readMessage()
+			if err != nil {
+				return
+			}
+			if message.id == messagePiece {
+				blocks <- struct{}{}
+			}
+		}
+	}()
+	return conn, blocks
+}
+
+// waitForChoker waits until the choker of the torrent has numPeers peers for
+// which ready holds.
+func waitForChoker(t *testing.T, c *choker, numPeers int, ready func(p *chokedPeer) bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		n := 0
+		for _, p := range c.peers {
+			if ready(p) {
+				n++
+			}
+		}
+		c.mu.Unlock()
+		if n == numPeers {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected number of peers: %d instead of %d", n, numPeers)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSeederUnchokesPeersByTransferRates(t *testing.T) {
+	pieceLength := sixteenKilobytes
+	numPeers := 6
+
+	tests := []struct {
+		name     string
+		seedMode bool
+		// transfer exchanges data with the peer, download from it while
+		// leeching and upload to it while seeding
+		transfer func(t *testing.T, infoHash, data []byte, hashes map[int]string, peerID []byte, conn net.Conn, blocks chan struct{})
+	}{
+		{
+			name: "leech mode ranks by what we download from the peer",
+			transfer: func(t *testing.T, infoHash, data []byte, hashes map[int]string, peerID []byte, conn net.Conn, blocks chan struct{}) {
+				fp := newFakePeer(t, infoHash, data, pieceLength, func(fp *fakePeer) { fp.peerID = peerID })
+				di := downloadInfo{
+					infoHashBytes:      infoHash,
+					name:               "file",
+					files:              []torrentFile{{path: []string{"file"}, length: int64(len(data))}},
+					fileLength:         int64(len(data)),
+					pieceLength:        pieceLength,
+					pieceHashesByIndex: hashes,
+				}
+				if err := downloadFileUsingWorkers(filepath.Join(t.TempDir(), "file"), []string{fp.address()}, di); err != nil {
+					t.Fatalf("unexpected error: %s", err.Error())
+				}
+			},
+		},
+		{
+			name:     "seed mode ranks by what we upload to the peer",
+			seedMode: true,
+			transfer: func(t *testing.T, infoHash, data []byte, hashes map[int]string, peerID []byte, conn net.Conn, blocks chan struct{}) {
+				for begin := 0; begin < pieceLength; begin += pieceLength / 2 {
+					conn.Write(newRequestMessage(messageRequest, 0, begin, pieceLength/2).serialize())
+				}
+				for i := 0; i < 2; i++ {
+					select {
+					case <-blocks:
+					case <-time.After(5 * time.Second):
+						t.Fatalf("seeder did not send the block")
+					}
+				}
+			},
+		},
+	}
+
+	for i, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			infoHash := bytes.Repeat([]byte{byte(0x10 + i)}, 20)
+			data, hashes := makeTestTorrentData(4*pieceLength, pieceLength)
+			seedHashes := map[int]string{}
+			for pieceIndex, hash := range hashes {
+				seedHashes[pieceIndex] = hash
+			}
+			if !ts.seedMode {
+				// a piece we still need, so that the seeder is leeching
+				seedHashes[3] = strings.Repeat("0", 40)
+			}
+			s, torrent := startTestSeeder(t, infoHash, data, pieceLength, seedHashes)
+			c := torrent.choker
+			clock := &fakeClock{current: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+			c.mu.Lock()
+			c.now = clock.now
+			c.mu.Unlock()
+
+			// connected in order, so that the peers of the choker are in
+			// the order of the leechers
+			peerIDs := [][]byte{}
+			conns := []net.Conn{}
+			blocks := []chan struct{}{}
+			for i := 0; i < numPeers; i++ {
+				peerID := createRandomID()
+				conn, received := connectTestLeecher(t, s.address(), infoHash, peerID)
+				waitForChoker(t, c, i+1, func(p *chokedPeer) bool { return true })
+				peerIDs = append(peerIDs, peerID)
+				conns = append(conns, conn)
+				blocks = append(blocks, received)
+			}
+
+			// nobody is interested yet, so everyone is unchoked
+			c.rechoke()
+
+			// the last two peers rank first once the data was exchanged,
+			// whereas with equal rates the first peers would keep their
+			// slots and only one of the last could be unchoked optimistically
+			for _, i := range []int{numPeers - 2, numPeers - 1} {
+				ts.transfer(t, infoHash, data, hashes, peerIDs[i], conns[i], blocks[i])
+			}
+			for _, conn := range conns {
+				conn.Write(makePeerMessage(messageInterested, nil))
+			}
+			waitForChoker(t, c, numPeers, func(p *chokedPeer) bool { return p.interested })
+
+			clock.advance(optimisticUnchokeInterval)
+			c.rechoke()
+
+			c.mu.Lock()
+			peers := slices.Clone(c.peers)
+			c.mu.Unlock()
+			unchoked := unchokedPeers(c, peers)
+			for _, i := range []int{0, numPeers - 2, numPeers - 1} {
+				if !unchoked[i] {
+					t.Fatalf("expected peer %d to be unchoked: %v", i, unchoked)
+				}
+			}
+			if len(unchoked) != regularUnchokeSlots+1 {
+				t.Fatalf("expected the top peers and one optimistic unchoke: %v", unchoked)
+			}
+		})
+	}
+}
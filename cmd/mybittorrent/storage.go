@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// pieceStorage maps the piece stream of a torrent onto the files on disk so
+// that verified pieces can be written as soon as they arrive.
+type pieceStorage struct {
+	files       []*os.File
+	lengths     []int64
+	pieceLength int64
+	totalLength int64
+}
+
+// openPieceStorage creates (or opens) every file of the torrent, including
+// any missing directories, and sizes it to its final length. Existing data is
+// left in place.
+func openPieceStorage(paths []string, files []torrentFile, pieceLength int) (*pieceStorage, error) {
+	s := &pieceStorage{
+		pieceLength: int64(pieceLength),
+	}
+
+	for i, file := range files {
+		if err := os.MkdirAll(filepath.Dir(paths[i]), 0755); err != nil {
+			s.close()
+			return nil, fmt.Errorf("failed to create directory for %s: %s", paths[i], err.Error())
+		}
+
+		f, err := os.OpenFile(paths[i], os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("failed to open file %s: %s", paths[i], err.Error())
+		}
+		s.files = append(s.files, f)
+
+		stat, err := f.Stat()
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("failed to stat file %s: %s", paths[i], err.Error())
+		}
+
+		if stat.Size() != file.length {
+			if err := f.Truncate(file.length); err != nil {
+				s.close()
+				return nil, fmt.Errorf("failed to preallocate file %s: %s", paths[i], err.Error())
+			}
+		}
+
+		s.lengths = append(s.lengths, file.length)
+		s.totalLength += file.length
+	}
+
+	return s, nil
+}
+
+// openExistingPieceStorage opens the files of a torrent that are already on
+// disk for reading, without creating or resizing anything.
+func openExistingPieceStorage(paths []string, files []torrentFile, pieceLength int) (*pieceStorage, error) {
+	s := &pieceStorage{
+		pieceLength: int64(pieceLength),
+	}
+
+	for i, file := range files {
+		f, err := os.Open(paths[i])
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("failed to open file %s: %s", paths[i], err.Error())
+		}
+		s.files = append(s.files, f)
+
+		stat, err := f.Stat()
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("failed to stat file %s: %s", paths[i], err.Error())
+		}
+		if stat.Size() != file.length {
+			s.close()
+			return nil, fmt.Errorf("file %s has %d bytes instead of %d", paths[i], stat.Size(), file.length)
+		}
+
+		s.lengths = append(s.lengths, file.length)
+		s.totalLength += file.length
+	}
+
+	return s, nil
+}
+
+func (s *pieceStorage) writePiece(pieceIndex int, piece []byte) error {
+	return s.writeAt(piece, int64(pieceIndex)*s.pieceLength)
+}
+
+func (s *pieceStorage) readPiece(pieceIndex, length int) ([]byte, error) {
+	return s.readBlock(pieceIndex, 0, length)
+}
+
+func (s *pieceStorage) readBlock(pieceIndex, begin, length int) ([]byte, error) {
+	block := make([]byte, length)
+	if err := s.readAt(block, int64(pieceIndex)*s.pieceLength+int64(begin)); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+func (s *pieceStorage) writeAt(data []byte, offset int64) error {
+	return s.span(data, offset, func(f *os.File, part []byte, fileOffset int64) error {
+		_, err := f.WriteAt(part, fileOffset)
+		return err
+	})
+}
+
+func (s *pieceStorage) readAt(data []byte, offset int64) error {
+	return s.span(data, offset, func(f *os.File, part []byte, fileOffset int64) error {
+		_, err := f.ReadAt(part, fileOffset)
+		return err
+	})
+}
+
+// span calls fn for every file the byte range [offset, offset+len(data))
+// overlaps, with the matching part of data and the offset within that file.
+func (s *pieceStorage) span(data []byte, offset int64, fn func(f *os.File, part []byte, fileOffset int64) error) error {
+	if offset < 0 || offset+int64(len(data)) > s.totalLength {
+		return fmt.Errorf("range %d+%d is outside of the torrent data", offset, len(data))
+	}
+
+	fileStart := int64(0)
+	for i, f := range s.files {
+		fileEnd := fileStart + s.lengths[i]
+		if len(data) == 0 {
+			break
+		}
+		if offset < fileEnd {
+			n := min(int64(len(data)), fileEnd-offset)
+			if err := fn(f, data[:n], offset-fileStart); err != nil {
+				return fmt.Errorf("failed to access %s: %s", f.Name(), err.Error())
+			}
+			data = data[n:]
+			offset += n
+		}
+		fileStart = fileEnd
+	}
+	return nil
+}
+
+func (s *pieceStorage) close() error {
+	var firstErr error
+	for _, f := range s.files {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
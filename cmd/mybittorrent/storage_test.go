@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPieceStorageSpansFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := []torrentFile{
+		{path: []string{"a.txt"}, length: 3},
+		{path: []string{"sub", "b.txt"}, length: 4},
+		{path: []string{"c.txt"}, length: 2},
+	}
+
+	paths, err := filePaths(dir, "root", files, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	storage, err := openPieceStorage(paths, files, 4)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	// write out of order, as pieces arrive from workers
+	for _, p := range []struct {
+		index int
+		data  string
+	}{{2, "i"}, {0, "abcd"}, {1, "efgh"}} {
+		if err := storage.writePiece(p.index, []byte(p.data)); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+
+	block, err := storage.readBlock(0, 2, 4)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if string(block) != "cdef" {
+		t.Fatalf("unexpected block: %s", block)
+	}
+
+	if err := storage.close(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	expected := map[string]string{
+		filepath.Join(dir, "root", "a.txt"):        "abc",
+		filepath.Join(dir, "root", "sub", "b.txt"): "defg",
+		filepath.Join(dir, "root", "c.txt"):        "hi",
+	}
+	for path, contents := range expected {
+		actual, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if string(actual) != contents {
+			t.Fatalf("unexpected contents of %s: %s instead of %s", path, actual, contents)
+		}
+	}
+}
+
+func TestPieceStoragePreallocatesAndKeepsData(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	if err := os.WriteFile(path, []byte("abcdefghijkl"), 0666); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	files := []torrentFile{{path: []string{"file"}, length: 8}}
+	storage, err := openPieceStorage([]string{path}, files, 4)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer storage.close()
+
+	piece, err := storage.readPiece(1, 4)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !bytes.Equal(piece, []byte("efgh")) {
+		t.Fatalf("unexpected piece: %s", piece)
+	}
+
+	if err := storage.writePiece(2, []byte("x")); err == nil {
+		t.Fatalf("expected an error when writing past the end of the torrent")
+	}
+}
+
+func TestCollectPiecesStopsOnWriteError(t *testing.T) {
+	results := make(chan downloadedPiece, 2)
+	outrightFailures := make(chan int)
+	// the workers keep running, like they do while waiting for pieces that
+	// will never come
+	workersDone := make(chan struct{})
+	results <- downloadedPiece{pieceIndex: 0, piece: []byte("a")}
+	results <- downloadedPiece{pieceIndex: 1, piece: []byte("b")}
+
+	diskFull := errors.New("no space left on device")
+	writes := 0
+	done := make(chan error)
+	go func() {
+		_, err := collectPieces(results, outrightFailures, workersDone, 3, map[int]bool{}, func(dp downloadedPiece) error {
+			writes++
+			if dp.pieceIndex == 1 {
+				return diskFull
+			}
+			return nil
+		})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != diskFull {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("collecting pieces did not stop after the write error")
+	}
+	if writes != 2 {
+		t.Fatalf("unexpected number of writes: %d", writes)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// limits for decoding HTTP tracker responses, which are small dictionaries
+const (
+	maxTrackerResponseDepth  = 8
+	maxTrackerResponseString = 1024 * 1024
+	maxTrackerResponseLength = 2 * 1024 * 1024
+)
+
+// how long announceToTiers waits for the tiers, long enough for a dead UDP
+// tracker to time out and the next tracker of its tier to answer
+const announceTimeout = 2 * time.Minute
+
+// trackerResponse is the response of an HTTP tracker to an announce. Peers
+// is either a compact string or a list of dictionaries.
+type trackerResponse struct {
+	FailureReason string `bencode:"failure reason,omitempty"`
+	Interval      int    `bencode:"interval,omitempty"`
+	Peers         any    `bencode:"peers,omitempty"`
+}
+
+// requestPeers announces to the tracker and returns the peers it knows about,
+// speaking HTTP or UDP depending on the scheme of the announce URL.
+func requestPeers(trackerURL string, infoHash []byte, left int64) ([]string, error) {
+	peers, _, err := announceToTracker(trackerURL, infoHash, left)
+	return peers, err
+}
+
+// announceToTracker is requestPeers that also returns how long the tracker
+// wants us to wait before announcing again, zero when it did not say.
+func announceToTracker(trackerURL string, infoHash []byte, left int64) ([]string, time.Duration, error) {
+	u, err := url.Parse(trackerURL)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error parsing tracker url: %s", err.Error())
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		resp, err := sendRequest(trackerURL, infoHash, left)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if resp.FailureReason != "" {
+			return nil, 0, fmt.Errorf("tracker returned a failure: %s", resp.FailureReason)
+		}
+
+		peers, err := getPeers(resp)
+		if err != nil {
+			return nil, 0, err
+		}
+		return peers, time.Duration(resp.Interval) * time.Second, nil
+	case "udp":
+		response, err := getUDPTracker(u.Host).announce(infoHash, []byte(createUniqueId()), left)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error announcing to udp tracker: %s", err.Error())
+		}
+		return response.peers, time.Duration(response.interval) * time.Second, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported tracker scheme: %s", u.Scheme)
+	}
+}
+
+// parseAnnounceTiers returns the tracker tiers of a torrent. The announce-list
+// (https://www.bittorrent.org/beps/bep_0012.html) takes precedence over the
+// single announce URL when present.
+func parseAnnounceTiers(dict map[string]any) [][]string {
+	tiers := [][]string{}
+	if rawTiers, ok := dict["announce-list"].([]any); ok {
+		for _, rawTier := range rawTiers {
+			trackers, ok := rawTier.([]any)
+			if !ok {
+				continue
+			}
+
+			tier := []string{}
+			for _, rawTracker := range trackers {
+				if tracker, ok := rawTracker.(string); ok && tracker != "" {
+					tier = append(tier, tracker)
+				}
+			}
+			if len(tier) > 0 {
+				tiers = append(tiers, tier)
+			}
+		}
+	}
+
+	if len(tiers) == 0 {
+		if announce, ok := dict["announce"].(string); ok && announce != "" {
+			tiers = append(tiers, []string{announce})
+		}
+	}
+	return tiers
+}
+
+// shuffleTiers randomises the order of the trackers within each tier, as
+// BEP 12 asks clients to do when the torrent is loaded.
+func shuffleTiers(tiers [][]string) {
+	for _, tier := range tiers {
+		rand.Shuffle(len(tier), func(i, j int) {
+			tier[i], tier[j] = tier[j], tier[i]
+		})
+	}
+}
+
+// announceTiers are the tracker tiers of a torrent as announces see them.
+// Trackers that respond are moved to the front of their tier, so that every
+// later announce asks them first.
+type announceTiers struct {
+	timeout time.Duration
+
+	mu    sync.Mutex
+	tiers [][]string
+}
+
+func newAnnounceTiers(tiers [][]string) *announceTiers {
+	copied := [][]string{}
+	for _, tier := range tiers {
+		copied = append(copied, append([]string{}, tier...))
+	}
+	return &announceTiers{timeout: announceTimeout, tiers: copied}
+}
+
+func (a *announceTiers) len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.tiers)
+}
+
+// tier returns a copy of the trackers of the tier in their current order.
+func (a *announceTiers) tier(i int) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string{}, a.tiers[i]...)
+}
+
+// promote moves the tracker to the front of its tier.
+func (a *announceTiers) promote(i int, tracker string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	tier := a.tiers[i]
+	for j, t := range tier {
+		if t == tracker {
+			copy(tier[1:j+1], tier[:j])
+			tier[0] = tracker
+			return
+		}
+	}
+}
+
+// requestPeersFromTiers asks the trackers of each tier in turn until one of
+// them responds, with all tiers asked at the same time. The responding tracker
+// is moved to the front of its tier. Peers from every responding tracker are
+// merged with duplicates removed.
+func requestPeersFromTiers(tiers *announceTiers, infoHash []byte, left int64) ([]string, error) {
+	peers, _, err := announceToTiers(tiers, infoHash, left)
+	return peers, err
+}
+
+// announceToTiers is requestPeersFromTiers that also returns the shortest
+// interval the responding trackers asked for, zero when none of them did.
+// Tiers that have not responded when the timeout of tiers passes are left
+// out of the result.
+func announceToTiers(tiers *announceTiers, infoHash []byte, left int64) ([]string, time.Duration, error) {
+	type tierResult struct {
+		index    int
+		peers    []string
+		interval time.Duration
+		errs     []string
+	}
+
+	numTiers := tiers.len()
+	// buffered, so that tiers responding after the timeout do not block
+	results := make(chan tierResult, numTiers)
+	for i := 0; i < numTiers; i++ {
+		go func(i int) {
+			result := tierResult{index: i}
+			for _, tracker := range tiers.tier(i) {
+				trackerPeers, trackerInterval, err := announceToTracker(tracker, infoHash, left)
+				if err != nil {
+					result.errs = append(result.errs, fmt.Sprintf("%s: %s", tracker, err.Error()))
+					continue
+				}
+				tiers.promote(i, tracker)
+				result.peers, result.interval = trackerPeers, trackerInterval
+				break
+			}
+			results <- result
+		}(i)
+	}
+
+	byTier := make([]*tierResult, numTiers)
+	timeout := time.After(tiers.timeout)
+	for received := 0; received < numTiers; received++ {
+		select {
+		case result := <-results:
+			byTier[result.index] = &result
+		case <-timeout:
+			received = numTiers
+		}
+	}
+
+	// merge in tier order, so that the peers of earlier tiers come first
+	peers := []string{}
+	seen := map[string]bool{}
+	errs := []string{}
+	interval := time.Duration(0)
+	for i, result := range byTier {
+		if result == nil {
+			errs = append(errs, fmt.Sprintf("tier %d: no response within %s", i, tiers.timeout))
+			continue
+		}
+		errs = append(errs, result.errs...)
+
+		if result.interval > 0 && (interval == 0 || result.interval < interval) {
+			interval = result.interval
+		}
+		for _, peer := range result.peers {
+			if !seen[peer] {
+				seen[peer] = true
+				peers = append(peers, peer)
+			}
+		}
+	}
+
+	if len(peers) == 0 && len(errs) > 0 {
+		return nil, 0, fmt.Errorf("no tracker responded: %v", errs)
+	}
+	return peers, interval, nil
+}
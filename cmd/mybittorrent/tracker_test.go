@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newFakeHTTPTracker(t *testing.T, body string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func compactPeers(peers ...[]byte) string {
+	return string(bytes.Join(peers, nil))
+}
+
+func TestParseAnnounceTiers(t *testing.T) {
+	tests := []struct {
+		name     string
+		dict     map[string]any
+		expected [][]string
+	}{
+		{
+			name:     "announce only",
+			dict:     map[string]any{"announce": "http://a"},
+			expected: [][]string{{"http://a"}},
+		},
+		{
+			name: "announce list takes precedence",
+			dict: map[string]any{
+				"announce":      "http://a",
+				"announce-list": []any{[]any{"http://b", "http://c"}, []any{"udp://d"}},
+			},
+			expected: [][]string{{"http://b", "http://c"}, {"udp://d"}},
+		},
+		{
+			name: "empty tiers are skipped",
+			dict: map[string]any{
+				"announce":      "http://a",
+				"announce-list": []any{[]any{}, []any{"udp://d"}},
+			},
+			expected: [][]string{{"udp://d"}},
+		},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			actual := parseAnnounceTiers(ts.dict)
+			if !reflect.DeepEqual(actual, ts.expected) {
+				t.Fatalf("unexpected tiers: %v instead of %v", actual, ts.expected)
+			}
+		})
+	}
+}
+
+func TestRequestPeersFromTiersPromotesAndMerges(t *testing.T) {
+	peerA := []byte{10, 0, 0, 1, 0x1A, 0xE1}
+	peerB := []byte{10, 0, 0, 2, 0x1A, 0xE1}
+	peerC := []byte{10, 0, 0, 3, 0x1A, 0xE1}
+
+	failing := newFakeHTTPTracker(t, "d14:failure reason4:nopee")
+	first := newFakeHTTPTracker(t, "d5:peers12:"+compactPeers(peerA, peerB)+"e")
+	second := newFakeHTTPTracker(t, "d5:peers12:"+compactPeers(peerB, peerC)+"e")
+	unused := newFakeHTTPTracker(t, "d5:peers6:"+compactPeers(peerC)+"e")
+
+	tiers := newAnnounceTiers([][]string{
+		{failing.URL, first.URL, unused.URL},
+		{second.URL},
+	})
+
+	peers, err := requestPeersFromTiers(tiers, bytes.Repeat([]byte{0xAB}, 20), 100)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	expectedPeers := []string{"10.0.0.1:6881", "10.0.0.2:6881", "10.0.0.3:6881"}
+	if !reflect.DeepEqual(peers, expectedPeers) {
+		t.Fatalf("unexpected peers: %v instead of %v", peers, expectedPeers)
+	}
+
+	expectedTier := []string{first.URL, failing.URL, unused.URL}
+	if !reflect.DeepEqual(tiers.tier(0), expectedTier) {
+		t.Fatalf("responding tracker was not promoted: %v instead of %v", tiers.tier(0), expectedTier)
+	}
+}
+
+func TestMetainfoKeepsPromotedTrackers(t *testing.T) {
+	mu := sync.Mutex{}
+	failingAnnounces := 0
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		failingAnnounces++
+		mu.Unlock()
+		w.Write([]byte("d14:failure reason4:nopee"))
+	}))
+	t.Cleanup(failing.Close)
+	alive := newFakeHTTPTracker(t, "d5:peers6:"+compactPeers([]byte{10, 0, 0, 1, 0x1A, 0xE1})+"e")
+
+	encoded, err := encodeBencode(map[string]any{
+		"announce":      failing.URL,
+		"announce-list": []any{[]any{failing.URL, alive.URL}},
+		"info":          map[string]any{"name": "a.txt", "length": 10, "piece length": 16, "pieces": strings.Repeat("a", 20)},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	m, err := parseMetainfo(encoded)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := requestPeersFromTiers(m.trackerTiers(), m.InfoHash[:], 10); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+	if tier := m.trackerTiers().tier(0); tier[0] != alive.URL {
+		t.Fatalf("responding tracker was not kept in front: %v", tier)
+	}
+	// the failing tracker is asked at most once, before the other one was
+	// promoted
+	mu.Lock()
+	defer mu.Unlock()
+	if failingAnnounces > 1 {
+		t.Fatalf("unexpected announces to the failing tracker: %d", failingAnnounces)
+	}
+}
+
+func TestRequestPeersFromTiersDoesNotWaitForHangingTier(t *testing.T) {
+	release := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(hanging.Close)
+	// runs before the server is closed, which waits for the handler
+	t.Cleanup(func() { close(release) })
+	alive := newFakeHTTPTracker(t, "d5:peers6:"+compactPeers([]byte{10, 0, 0, 1, 0x1A, 0xE1})+"e")
+
+	tiers := newAnnounceTiers([][]string{{hanging.URL}, {alive.URL}})
+	tiers.timeout = 100 * time.Millisecond
+
+	start := time.Now()
+	peers, err := requestPeersFromTiers(tiers, bytes.Repeat([]byte{0xAB}, 20), 100)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !reflect.DeepEqual(peers, []string{"10.0.0.1:6881"}) {
+		t.Fatalf("unexpected peers: %v", peers)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("unexpected time waiting for the hanging tracker: %s", elapsed)
+	}
+
+	// with nothing else to go on, the hanging tier is reported
+	tiers = newAnnounceTiers([][]string{{hanging.URL}})
+	tiers.timeout = 50 * time.Millisecond
+	_, err = requestPeersFromTiers(tiers, bytes.Repeat([]byte{0xAB}, 20), 100)
+	if err == nil || !strings.Contains(err.Error(), "tier 0: no response within 50ms") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRequestPeersFromTiersAllFailing(t *testing.T) {
+	failing := newFakeHTTPTracker(t, "d14:failure reason4:nopee")
+
+	_, err := requestPeersFromTiers(newAnnounceTiers([][]string{{failing.URL}}), bytes.Repeat([]byte{0xAB}, 20), 100)
+	if err == nil {
+		t.Fatalf("expected an error when no tracker responds")
+	}
+}
+
+func TestParseMagnetLinkKeepsAllTrackers(t *testing.T) {
+	link := "magnet:?xt=urn:btih:ad42ce8109f54c99613ce38f9b4d87e70f24a165&dn=magnet1.gif&tr=http%3A%2F%2Fa%2Fannounce&tr=udp%3A%2F%2Fb%3A6969"
+	data, err := parseMagnetLink(link)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	expected := []string{"http://a/announce", "udp://b:6969"}
+	if !reflect.DeepEqual(data.trackerURLs, expected) {
+		t.Fatalf("unexpected trackers: %v instead of %v", data.trackerURLs, expected)
+	}
+	if data.trackerURL != expected[0] {
+		t.Fatalf("unexpected tracker url: %s", data.trackerURL)
+	}
+	if data.trackerTiers().len() != 2 {
+		t.Fatalf("unexpected number of tiers: %d", data.trackerTiers().len())
+	}
+}
+
+func TestRequestPeersFromTiersFailsOverFromDeadUDPTracker(t *testing.T) {
+	dead := newFakeUDPTracker(t)
+	dead.mu.Lock()
+	dead.dropNext = 100
+	dead.mu.Unlock()
+	udpTrackersMutex.Lock()
+	tracker := newUDPTracker(dead.address())
+	tracker.timeoutBase = 10 * time.Millisecond
+	udpTrackers[dead.address()] = tracker
+	udpTrackersMutex.Unlock()
+
+	alive := newFakeHTTPTracker(t, "d5:peers6:"+compactPeers([]byte{10, 0, 0, 1, 0x1A, 0xE1})+"e")
+	tiers := newAnnounceTiers([][]string{{"udp://" + dead.address() + "/announce"}, {alive.URL}})
+
+	start := time.Now()
+	peers, err := requestPeersFromTiers(tiers, bytes.Repeat([]byte{0xAB}, 20), 100)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !reflect.DeepEqual(peers, []string{"10.0.0.1:6881"}) {
+		t.Fatalf("unexpected peers: %v", peers)
+	}
+	// 10ms + 20ms + 40ms for the dead tracker with the default retries
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("unexpected time to fail over: %s", elapsed)
+	}
+}
+
+func TestRequestPeersParsesBothPeerForms(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		expected      []string
+		expectedError bool
+	}{
+		{
+			name:     "compact",
+			body:     "d5:peers6:" + compactPeers([]byte{10, 0, 0, 1, 0x1A, 0xE1}) + "e",
+			expected: []string{"10.0.0.1:6881"},
+		},
+		{
+			name:     "dictionaries",
+			body:     "d5:peersld2:ip8:10.0.0.17:peer id20:aaaaaaaaaaaaaaaaaaaa4:porti6881eed2:ip3:::14:porti51413eeee",
+			expected: []string{"10.0.0.1:6881", "[::1]:51413"},
+		},
+		{
+			name:     "no peers",
+			body:     "d8:intervali1800ee",
+			expected: []string{},
+		},
+		{
+			name:          "dictionary without a port",
+			body:          "d5:peersld2:ip8:10.0.0.1eee",
+			expectedError: true,
+		},
+		{
+			name:          "peers of the wrong type",
+			body:          "d5:peersi1ee",
+			expectedError: true,
+		},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			tracker := newFakeHTTPTracker(t, ts.body)
+			peers, err := requestPeers(tracker.URL, bytes.Repeat([]byte{0xAB}, 20), 100)
+			if ts.expectedError {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if !reflect.DeepEqual(peers, ts.expected) {
+				t.Fatalf("unexpected peers: %v instead of %v", peers, ts.expected)
+			}
+		})
+	}
+}
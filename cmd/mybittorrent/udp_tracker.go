@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// UDP tracker protocol, see https://www.bittorrent.org/beps/bep_0015.html
+
+const udpTrackerProtocolID = 0x41727101980
+
+const (
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+)
+
+// connection IDs may be reused for one minute after they were received
+const udpConnectionIDLifetime = time.Minute
+
+// per BEP 15 a request is retransmitted after 15 * 2 ^ n seconds. BEP 15 goes
+// up to n = 8, which is almost two hours for a dead tracker, long enough to
+// stall the tiers behind it, so we give up after n = 2, i.e. 105 seconds. The
+// connect and the announce or scrape it is for count against the same n.
+const udpTrackerTimeoutBase = 15 * time.Second
+const udpTrackerMaxRetries = 2
+
+var errUDPTrackerTimeout = errors.New("udp tracker did not respond in time")
+
+type udpTracker struct {
+	address     string
+	timeoutBase time.Duration
+	maxRetries  int
+	now         func() time.Time
+
+	mu                 sync.Mutex
+	connectionID       uint64
+	connectionIDExpiry time.Time
+}
+
+type udpAnnounceResponse struct {
+	interval int
+	leechers int
+	seeders  int
+	peers    []string
+}
+
+type udpScrapeResponse struct {
+	seeders   int
+	completed int
+	leechers  int
+}
+
+var udpTrackersMutex sync.Mutex
+var udpTrackers = map[string]*udpTracker{}
+
+// getUDPTracker returns the client for the tracker at the given host:port so
+// that connection IDs are shared between announces to the same tracker.
+func getUDPTracker(address string) *udpTracker {
+	udpTrackersMutex.Lock()
+	defer udpTrackersMutex.Unlock()
+
+	t, ok := udpTrackers[address]
+	if !ok {
+		t = newUDPTracker(address)
+		udpTrackers[address] = t
+	}
+	return t
+}
+
+func newUDPTracker(address string) *udpTracker {
+	return &udpTracker{
+		address:     address,
+		timeoutBase: udpTrackerTimeoutBase,
+		maxRetries:  udpTrackerMaxRetries,
+		now:         time.Now,
+	}
+}
+
+func (t *udpTracker) announce(infoHash, peerID []byte, left int64) (*udpAnnounceResponse, error) {
+	conn, err := net.Dial("udp", t.address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial udp tracker: %s", err.Error())
+	}
+	defer conn.Close()
+
+	response, err := t.request(conn, udpActionAnnounce, func(connectionID uint64, transactionID uint32) []byte {
+		request := []byte{}
+		request = binary.BigEndian.AppendUint64(request, connectionID)
+		request = binary.BigEndian.AppendUint32(request, udpActionAnnounce)
+		request = binary.BigEndian.AppendUint32(request, transactionID)
+		request = append(request, infoHash...)
+		request = append(request, peerID...)
+		request = binary.BigEndian.AppendUint64(request, 0)             // downloaded
+		request = binary.BigEndian.AppendUint64(request, uint64(left))  // left
+		request = binary.BigEndian.AppendUint64(request, 0)             // uploaded
+		request = binary.BigEndian.AppendUint32(request, 0)             // event: none
+		request = binary.BigEndian.AppendUint32(request, 0)             // ip: default
+		request = binary.BigEndian.AppendUint32(request, rand.Uint32()) // key
+		request = binary.BigEndian.AppendUint32(request, 0xFFFFFFFF)    // num_want: default
+		request = binary.BigEndian.AppendUint16(request, listenPort)
+		return request
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(response) < 20 {
+		return nil, fmt.Errorf("udp announce response was too small: %d bytes", len(response))
+	}
+
+	return &udpAnnounceResponse{
+		interval: int(binary.BigEndian.Uint32(response[8:12])),
+		leechers: int(binary.BigEndian.Uint32(response[12:16])),
+		seeders:  int(binary.BigEndian.Uint32(response[16:20])),
+		peers:    parseCompactPeers(response[20:]),
+	}, nil
+}
+
+func (t *udpTracker) scrape(infoHashes ...[]byte) ([]udpScrapeResponse, error) {
+	conn, err := net.Dial("udp", t.address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial udp tracker: %s", err.Error())
+	}
+	defer conn.Close()
+
+	response, err := t.request(conn, udpActionScrape, func(connectionID uint64, transactionID uint32) []byte {
+		request := []byte{}
+		request = binary.BigEndian.AppendUint64(request, connectionID)
+		request = binary.BigEndian.AppendUint32(request, udpActionScrape)
+		request = binary.BigEndian.AppendUint32(request, transactionID)
+		for _, infoHash := range infoHashes {
+			request = append(request, infoHash...)
+		}
+		return request
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(response) < 8+12*len(infoHashes) {
+		return nil, fmt.Errorf("udp scrape response was too small: %d bytes", len(response))
+	}
+
+	result := []udpScrapeResponse{}
+	for i := range infoHashes {
+		entry := response[8+12*i:]
+		result = append(result, udpScrapeResponse{
+			seeders:   int(binary.BigEndian.Uint32(entry[0:4])),
+			completed: int(binary.BigEndian.Uint32(entry[4:8])),
+			leechers:  int(binary.BigEndian.Uint32(entry[8:12])),
+		})
+	}
+	return result, nil
+}
+
+// request performs a transaction that needs a connection ID, connecting
+// first when there is no valid one. build returns the request for the given
+// connection and transaction IDs. A timeout of either transaction uses up
+// one retransmission, so both together wait at most as long as one would.
+func (t *udpTracker) request(conn net.Conn, action uint32, build func(connectionID uint64, transactionID uint32) []byte) ([]byte, error) {
+	for n := 0; n <= t.maxRetries; n++ {
+		connectionID, err := t.getConnectionID(conn, n)
+		if errors.Is(err, errUDPTrackerTimeout) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		transactionID := rand.Uint32()
+		response, err := t.transact(conn, build(connectionID, transactionID), transactionID, action, n)
+		if errors.Is(err, errUDPTrackerTimeout) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return response, nil
+	}
+	return nil, errUDPTrackerTimeout
+}
+
+// getConnectionID returns the cached connection ID, or performs the connect
+// transaction when there is none or it has expired. n is the retransmission
+// count of the request the connection ID is for.
+func (t *udpTracker) getConnectionID(conn net.Conn, n int) (uint64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.now().Before(t.connectionIDExpiry) {
+		return t.connectionID, nil
+	}
+
+	transactionID := rand.Uint32()
+	request := []byte{}
+	request = binary.BigEndian.AppendUint64(request, udpTrackerProtocolID)
+	request = binary.BigEndian.AppendUint32(request, udpActionConnect)
+	request = binary.BigEndian.AppendUint32(request, transactionID)
+
+	response, err := t.transact(conn, request, transactionID, udpActionConnect, n)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(response) < 16 {
+		return 0, fmt.Errorf("udp connect response was too small: %d bytes", len(response))
+	}
+
+	t.connectionID = binary.BigEndian.Uint64(response[8:16])
+	t.connectionIDExpiry = t.now().Add(udpConnectionIDLifetime)
+	return t.connectionID, nil
+}
+
+// transact sends a request and waits for the response carrying the same
+// transaction ID. n is the retransmission count used to calculate the timeout.
+func (t *udpTracker) transact(conn net.Conn, request []byte, transactionID, action uint32, n int) ([]byte, error) {
+	if _, err := conn.Write(request); err != nil {
+		return nil, fmt.Errorf("failed to write to udp tracker: %s", err.Error())
+	}
+
+	deadline := time.Now().Add(t.timeoutBase * (1 << n))
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return nil, fmt.Errorf("failed to set udp read deadline: %s", err.Error())
+	}
+
+	buffer := make([]byte, 65536)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, errUDPTrackerTimeout
+			}
+			return nil, fmt.Errorf("failed to read from udp tracker: %s", err.Error())
+		}
+
+		if n < 8 || binary.BigEndian.Uint32(buffer[4:8]) != transactionID {
+			// stale or unrelated packet, keep waiting
+			continue
+		}
+
+		responseAction := binary.BigEndian.Uint32(buffer[0:4])
+		if responseAction == udpActionError {
+			return nil, fmt.Errorf("udp tracker returned an error: %s", string(buffer[8:n]))
+		}
+		if responseAction != action {
+			return nil, fmt.Errorf("unexpected udp tracker action: %d instead of %d", responseAction, action)
+		}
+
+		response := make([]byte, n)
+		copy(response, buffer[:n])
+		return response, nil
+	}
+}
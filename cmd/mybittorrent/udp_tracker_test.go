@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUDPTracker is an in-process stand-in for a BEP 15 tracker.
+type fakeUDPTracker struct {
+	conn         net.PacketConn
+	connectionID uint64
+	peers        []byte
+
+	mu        sync.Mutex
+	connects  int
+	announces int
+	dropNext  int
+	// dropAnnounces makes the tracker answer connects but not announces
+	dropAnnounces bool
+	dropped       int
+	lastInfoHash  []byte
+}
+
+func newFakeUDPTracker(t *testing.T) *fakeUDPTracker {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err.Error())
+	}
+	ft := &fakeUDPTracker{
+		conn:         conn,
+		connectionID: 0xCAFEBABE,
+		peers:        []byte{127, 0, 0, 1, 0x1A, 0xE1, 10, 0, 0, 2, 0x1A, 0xE2},
+	}
+	t.Cleanup(func() { conn.Close() })
+	go ft.serve()
+	return ft
+}
+
+func (ft *fakeUDPTracker) address() string {
+	return ft.conn.LocalAddr().String()
+}
+
+func (ft *fakeUDPTracker) connectCount() int {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.connects
+}
+
+func (ft *fakeUDPTracker) serve() {
+	buffer := make([]byte, 2048)
+	for {
+		n, addr, err := ft.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		request := buffer[:n]
+
+		action := binary.BigEndian.Uint32(request[8:12])
+		ft.mu.Lock()
+		if ft.dropNext > 0 || (ft.dropAnnounces && action == udpActionAnnounce) {
+			if ft.dropNext > 0 {
+				ft.dropNext--
+			}
+			ft.dropped++
+			ft.mu.Unlock()
+			continue
+		}
+
+		transactionID := request[12:16]
+		response := []byte{}
+		switch action {
+		case udpActionConnect:
+			ft.connects++
+			response = binary.BigEndian.AppendUint32(response, udpActionConnect)
+			response = append(response, transactionID...)
+			response = binary.BigEndian.AppendUint64(response, ft.connectionID)
+		case udpActionAnnounce:
+			if binary.BigEndian.Uint64(request[0:8]) != ft.connectionID {
+				response = binary.BigEndian.AppendUint32(response, udpActionError)
+				response = append(response, transactionID...)
+				response = append(response, []byte("bad connection id")...)
+				break
+			}
+			ft.announces++
+			ft.lastInfoHash = append([]byte{}, request[16:36]...)
+			response = binary.BigEndian.AppendUint32(response, udpActionAnnounce)
+			response = append(response, transactionID...)
+			response = binary.BigEndian.AppendUint32(response, 1800)
+			response = binary.BigEndian.AppendUint32(response, 3)
+			response = binary.BigEndian.AppendUint32(response, 7)
+			response = append(response, ft.peers...)
+		case udpActionScrape:
+			response = binary.BigEndian.AppendUint32(response, udpActionScrape)
+			response = append(response, transactionID...)
+			for i := 16; i+20 <= len(request); i += 20 {
+				response = binary.BigEndian.AppendUint32(response, 7)
+				response = binary.BigEndian.AppendUint32(response, 42)
+				response = binary.BigEndian.AppendUint32(response, 3)
+			}
+		}
+		ft.mu.Unlock()
+
+		ft.conn.WriteTo(response, addr)
+	}
+}
+
+func TestUDPTrackerAnnounce(t *testing.T) {
+	ft := newFakeUDPTracker(t)
+	tracker := newUDPTracker(ft.address())
+	tracker.timeoutBase = 50 * time.Millisecond
+	tracker.maxRetries = 2
+
+	infoHash := bytes.Repeat([]byte{0xAB}, 20)
+	response, err := tracker.announce(infoHash, []byte(createUniqueId()), 100)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	if len(response.peers) != 2 || response.peers[0] != "127.0.0.1:6881" || response.peers[1] != "10.0.0.2:6882" {
+		t.Fatalf("unexpected peers: %v", response.peers)
+	}
+	if response.interval != 1800 || response.leechers != 3 || response.seeders != 7 {
+		t.Fatalf("unexpected announce response: %+v", response)
+	}
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	if !bytes.Equal(ft.lastInfoHash, infoHash) {
+		t.Fatalf("unexpected info hash sent: %x", ft.lastInfoHash)
+	}
+}
+
+func TestUDPTrackerCachesConnectionID(t *testing.T) {
+	ft := newFakeUDPTracker(t)
+	tracker := newUDPTracker(ft.address())
+	tracker.timeoutBase = 50 * time.Millisecond
+	tracker.maxRetries = 2
+
+	now := time.Now()
+	tracker.now = func() time.Time { return now }
+
+	infoHash := bytes.Repeat([]byte{0xAB}, 20)
+	for i := 0; i < 3; i++ {
+		if _, err := tracker.announce(infoHash, []byte(createUniqueId()), 100); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+	if ft.connectCount() != 1 {
+		t.Fatalf("unexpected number of connects: %d instead of 1", ft.connectCount())
+	}
+
+	now = now.Add(udpConnectionIDLifetime + time.Second)
+	if _, err := tracker.announce(infoHash, []byte(createUniqueId()), 100); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if ft.connectCount() != 2 {
+		t.Fatalf("unexpected number of connects after expiry: %d instead of 2", ft.connectCount())
+	}
+}
+
+func TestUDPTrackerRetransmits(t *testing.T) {
+	ft := newFakeUDPTracker(t)
+	ft.mu.Lock()
+	ft.dropNext = 2
+	ft.mu.Unlock()
+	tracker := newUDPTracker(ft.address())
+	tracker.timeoutBase = 20 * time.Millisecond
+	tracker.maxRetries = 3
+
+	if _, err := tracker.announce(bytes.Repeat([]byte{0xAB}, 20), []byte(createUniqueId()), 100); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+}
+
+func TestUDPTrackerTimesOut(t *testing.T) {
+	tests := []struct {
+		name          string
+		dropNext      int
+		dropAnnounces bool
+	}{
+		{name: "connect silent", dropNext: 100},
+		{name: "announce silent", dropAnnounces: true},
+		{name: "connect retransmitted, announce silent", dropNext: 1, dropAnnounces: true},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			ft := newFakeUDPTracker(t)
+			ft.mu.Lock()
+			ft.dropNext = ts.dropNext
+			ft.dropAnnounces = ts.dropAnnounces
+			ft.mu.Unlock()
+			tracker := newUDPTracker(ft.address())
+			tracker.timeoutBase = 5 * time.Millisecond
+			tracker.maxRetries = 1
+
+			_, err := tracker.announce(bytes.Repeat([]byte{0xAB}, 20), []byte(createUniqueId()), 100)
+			if err != errUDPTrackerTimeout {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// connect and announce share the retransmissions, so the
+			// tracker is waited for once per retransmission and no more
+			ft.mu.Lock()
+			defer ft.mu.Unlock()
+			if ft.dropped != tracker.maxRetries+1 {
+				t.Fatalf("unexpected number of requests timing out: %d", ft.dropped)
+			}
+		})
+	}
+}
+
+func TestUDPTrackerScrape(t *testing.T) {
+	ft := newFakeUDPTracker(t)
+	tracker := newUDPTracker(ft.address())
+	tracker.timeoutBase = 50 * time.Millisecond
+	tracker.maxRetries = 2
+
+	responses, err := tracker.scrape(bytes.Repeat([]byte{0x01}, 20), bytes.Repeat([]byte{0x02}, 20))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(responses) != 2 {
+		t.Fatalf("unexpected number of scrape responses: %d", len(responses))
+	}
+	if responses[1].seeders != 7 || responses[1].completed != 42 || responses[1].leechers != 3 {
+		t.Fatalf("unexpected scrape response: %+v", responses[1])
+	}
+}
+
+func TestRequestPeersUsesUDPForUDPScheme(t *testing.T) {
+	ft := newFakeUDPTracker(t)
+	udpTrackersMutex.Lock()
+	tracker := newUDPTracker(ft.address())
+	tracker.timeoutBase = 50 * time.Millisecond
+	udpTrackers[ft.address()] = tracker
+	udpTrackersMutex.Unlock()
+
+	peers, err := requestPeers("udp://"+ft.address()+"/announce", bytes.Repeat([]byte{0xAB}, 20), 100)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(peers) != 2 {
+		t.Fatalf("unexpected peers: %v", peers)
+	}
+}
+
+func TestUDPTrackerDefaultRetriesAreBounded(t *testing.T) {
+	tracker := newUDPTracker("127.0.0.1:1")
+	wait := time.Duration(0)
+	for n := 0; n <= tracker.maxRetries; n++ {
+		wait += tracker.timeoutBase * (1 << n)
+	}
+	if wait > 2*time.Minute {
+		t.Fatalf("unexpected time to give up on a dead tracker: %s", wait)
+	}
+}
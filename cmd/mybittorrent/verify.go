@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+type pieceStatus int
+
+const (
+	pieceGood pieceStatus = iota
+	pieceBad
+	pieceMissing
+)
+
+func (s pieceStatus) String() string {
+	switch s {
+	case pieceGood:
+		return "good"
+	case pieceBad:
+		return "bad"
+	default:
+		return "missing"
+	}
+}
+
+// hashPieces reads every piece with read and compares its hash to the
+// torrent. read returns nil for pieces that are not on disk.
+func hashPieces(numPieces int, pieceHashesByIndex map[int]string, read func(pieceIndex int) ([]byte, error)) ([]pieceStatus, error) {
+	statuses := make([]pieceStatus, numPieces)
+	err := forEachPiece(numPieces, func(pieceIndex int) error {
+		status, err := hashPiece(pieceIndex, pieceHashesByIndex[pieceIndex], read)
+		statuses[pieceIndex] = status
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// forEachPiece calls fn for every piece index, spreading the calls over all
+// CPU cores. It returns the first error fn returned.
+func forEachPiece(numPieces int, fn func(pieceIndex int) error) error {
+	pieceIndexes := make(chan int)
+
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pieceIndex := range pieceIndexes {
+				if err := fn(pieceIndex); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for pieceIndex := 0; pieceIndex < numPieces; pieceIndex++ {
+		pieceIndexes <- pieceIndex
+	}
+	close(pieceIndexes)
+	wg.Wait()
+
+	return firstErr
+}
+
+func hashPiece(pieceIndex int, expectedHash string, read func(pieceIndex int) ([]byte, error)) (pieceStatus, error) {
+	piece, err := read(pieceIndex)
+	if err != nil {
+		return pieceMissing, fmt.Errorf("failed to read piece %d: %s", pieceIndex, err.Error())
+	}
+	if piece == nil {
+		return pieceMissing, nil
+	}
+	hash, err := hashBytesNew(piece)
+	if err != nil {
+		return pieceMissing, fmt.Errorf("failed to hash piece %d: %s", pieceIndex, err.Error())
+	}
+	if hash != expectedHash {
+		return pieceBad, nil
+	}
+	return pieceGood, nil
+}
+
+// verifyFile is a file of the torrent as found on disk, which may be missing
+// or shorter than it should be.
+type verifyFile struct {
+	path   string
+	offset int64
+	length int64
+	// nil when the file does not exist
+	f    *os.File
+	size int64
+}
+
+// readPieceFromFiles reads a piece from the files, returning nil when any
+// part of it is not on disk.
+func readPieceFromFiles(files []verifyFile, offset int64, length int) ([]byte, error) {
+	piece := make([]byte, length)
+	end := offset + int64(length)
+	for _, file := range files {
+		start := max(offset, file.offset)
+		stop := min(end, file.offset+file.length)
+		if start >= stop {
+			continue
+		}
+		if file.f == nil || stop-file.offset > file.size {
+			return nil, nil
+		}
+		if _, err := file.f.ReadAt(piece[start-offset:stop-offset], start-file.offset); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %s", file.path, err.Error())
+		}
+	}
+	return piece, nil
+}
+
+type verifyFileReport struct {
+	Path    string `json:"path"`
+	Length  int64  `json:"length"`
+	Good    []int  `json:"good"`
+	Bad     []int  `json:"bad"`
+	Missing []int  `json:"missing"`
+}
+
+type verifyReport struct {
+	Files   []verifyFileReport `json:"files"`
+	Good    int                `json:"good"`
+	Bad     int                `json:"bad"`
+	Missing int                `json:"missing"`
+	OK      bool               `json:"ok"`
+}
+
+// verify hashes the data at path against the torrent and reports the good,
+// bad and missing pieces of every file. The second result is false when any
+// piece is not good.
+func verify(file, path string, jsonOutput bool) ([]string, bool, error) {
+	m, err := loadMetainfo(file, false)
+	if err != nil {
+		return nil, false, err
+	}
+	files := m.Info.Files
+	fileLength := m.Info.TotalLength()
+	pieceLength := m.Info.PieceLength
+	hashByIndex := m.Info.pieceHashesByIndex()
+
+	paths, err := filePaths(path, m.Info.Name, files, m.Info.MultiFile)
+	if err != nil {
+		return nil, false, err
+	}
+	verifyFiles := []verifyFile{}
+	offset := int64(0)
+	for i, tf := range files {
+		vf := verifyFile{path: paths[i], offset: offset, length: tf.length}
+		if f, err := os.Open(paths[i]); err == nil {
+			defer f.Close()
+			if stat, err := f.Stat(); err == nil {
+				vf.f = f
+				vf.size = stat.Size()
+			}
+		}
+		verifyFiles = append(verifyFiles, vf)
+		offset += tf.length
+	}
+
+	statuses, err := hashPieces(len(hashByIndex), hashByIndex, func(pieceIndex int) ([]byte, error) {
+		length := getPieceLengthForIndex(fileLength, pieceLength, pieceIndex)
+		return readPieceFromFiles(verifyFiles, int64(pieceIndex)*int64(pieceLength), length)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	report := verifyReport{}
+	for _, status := range statuses {
+		switch status {
+		case pieceGood:
+			report.Good++
+		case pieceBad:
+			report.Bad++
+		default:
+			report.Missing++
+		}
+	}
+	report.OK = report.Bad == 0 && report.Missing == 0
+
+	for i, vf := range verifyFiles {
+		fileReport := verifyFileReport{
+			Path:    strings.Join(files[i].path, "/"),
+			Length:  files[i].length,
+			Good:    []int{},
+			Bad:     []int{},
+			Missing: []int{},
+		}
+		if vf.length > 0 {
+			first := int(vf.offset / int64(pieceLength))
+			last := int((vf.offset + vf.length - 1) / int64(pieceLength))
+			for pieceIndex := first; pieceIndex <= last; pieceIndex++ {
+				switch statuses[pieceIndex] {
+				case pieceGood:
+					fileReport.Good = append(fileReport.Good, pieceIndex)
+				case pieceBad:
+					fileReport.Bad = append(fileReport.Bad, pieceIndex)
+				default:
+					fileReport.Missing = append(fileReport.Missing, pieceIndex)
+				}
+			}
+		}
+		report.Files = append(report.Files, fileReport)
+	}
+
+	if jsonOutput {
+		encoded, err := json.Marshal(report)
+		if err != nil {
+			return nil, false, err
+		}
+		return []string{string(encoded)}, report.OK, nil
+	}
+
+	lines := []string{}
+	for _, fileReport := range report.Files {
+		lines = append(lines, fmt.Sprintf("%s: %d good, %d bad, %d missing", fileReport.Path, len(fileReport.Good), len(fileReport.Bad), len(fileReport.Missing)))
+		if len(fileReport.Bad) > 0 {
+			lines = append(lines, fmt.Sprintf("  bad pieces: %s", joinInts(fileReport.Bad)))
+		}
+		if len(fileReport.Missing) > 0 {
+			lines = append(lines, fmt.Sprintf("  missing pieces: %s", joinInts(fileReport.Missing)))
+		}
+	}
+	lines = append(lines, fmt.Sprintf("Total: %d good, %d bad, %d missing", report.Good, report.Bad, report.Missing))
+	return lines, report.OK, nil
+}
+
+func joinInts(values []int) string {
+	parts := []string{}
+	for _, v := range values {
+		parts = append(parts, fmt.Sprint(v))
+	}
+	return strings.Join(parts, " ")
+}
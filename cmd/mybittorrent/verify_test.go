@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeTestTorrent writes a multi-file torrent named dir and returns the
+// path of the .torrent file and the data of all files as one stream.
+func writeTestTorrent(t *testing.T, dir string, pieceLength int, files []torrentFile) (string, []byte) {
+	total := 0
+	for _, f := range files {
+		total += int(f.length)
+	}
+	data, _ := makeTestTorrentData(total, pieceLength)
+
+	// make every piece different so that a piece cannot pass for another
+	pieces := ""
+	for i := 0; i*pieceLength < total; i++ {
+		data[i*pieceLength] = byte(i + 1)
+		hash, _ := hashBytesNew(data[i*pieceLength : min((i+1)*pieceLength, total)])
+		hashBytes, _ := hex.DecodeString(hash)
+		pieces += string(hashBytes)
+	}
+
+	fileList := []any{}
+	for _, f := range files {
+		path := []any{}
+		for _, part := range f.path {
+			path = append(path, part)
+		}
+		fileList = append(fileList, map[string]any{"length": f.length, "path": path})
+	}
+	torrent, err := encodeBencode(map[string]any{
+		"announce": "http://127.0.0.1/announce",
+		"info": map[string]any{
+			"name":         "dir",
+			"piece length": pieceLength,
+			"pieces":       pieces,
+			"files":        fileList,
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	torrentPath := filepath.Join(dir, "test.torrent")
+	if err := os.WriteFile(torrentPath, torrent, 0644); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	return torrentPath, data
+}
+
+func TestVerify(t *testing.T) {
+	files := []torrentFile{
+		{path: []string{"a.txt"}, length: 20000},
+		{path: []string{"b.txt"}, length: 30000},
+		{path: []string{"c.txt"}, length: 10000},
+	}
+
+	tests := []struct {
+		name string
+		// damage changes the data of the files before they are written,
+		// files mapped to nil are not written at all
+		damage   func(contents map[string][]byte)
+		expected verifyReport
+	}{
+		{
+			name:   "all good",
+			damage: func(contents map[string][]byte) {},
+			expected: verifyReport{
+				Files: []verifyFileReport{
+					{Path: "a.txt", Length: 20000, Good: []int{0, 1}, Bad: []int{}, Missing: []int{}},
+					{Path: "b.txt", Length: 30000, Good: []int{1, 2, 3}, Bad: []int{}, Missing: []int{}},
+					{Path: "c.txt", Length: 10000, Good: []int{3}, Bad: []int{}, Missing: []int{}},
+				},
+				Good: 4,
+				OK:   true,
+			},
+		},
+		{
+			name: "bad and missing pieces",
+			damage: func(contents map[string][]byte) {
+				contents["b.txt"][20000] ^= 0xff
+				contents["c.txt"] = nil
+			},
+			expected: verifyReport{
+				Files: []verifyFileReport{
+					{Path: "a.txt", Length: 20000, Good: []int{0, 1}, Bad: []int{}, Missing: []int{}},
+					{Path: "b.txt", Length: 30000, Good: []int{1}, Bad: []int{2}, Missing: []int{3}},
+					{Path: "c.txt", Length: 10000, Good: []int{}, Bad: []int{}, Missing: []int{3}},
+				},
+				Good:    2,
+				Bad:     1,
+				Missing: 1,
+			},
+		},
+		{
+			name: "short file",
+			damage: func(contents map[string][]byte) {
+				contents["a.txt"] = contents["a.txt"][:17000]
+			},
+			expected: verifyReport{
+				Files: []verifyFileReport{
+					{Path: "a.txt", Length: 20000, Good: []int{0}, Bad: []int{}, Missing: []int{1}},
+					{Path: "b.txt", Length: 30000, Good: []int{2, 3}, Bad: []int{}, Missing: []int{1}},
+					{Path: "c.txt", Length: 10000, Good: []int{3}, Bad: []int{}, Missing: []int{}},
+				},
+				Good:    3,
+				Missing: 1,
+			},
+		},
+	}
+
+	for _, ts := range tests {
+		t.Run(ts.name, func(t *testing.T) {
+			dir := t.TempDir()
+			torrentPath, data := writeTestTorrent(t, dir, sixteenKilobytes, files)
+
+			contents := map[string][]byte{}
+			offset := int64(0)
+			for _, f := range files {
+				contents[f.path[0]] = append([]byte{}, data[offset:offset+f.length]...)
+				offset += f.length
+			}
+			ts.damage(contents)
+
+			target := filepath.Join(dir, "data")
+			if err := os.MkdirAll(filepath.Join(target, "dir"), 0755); err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			for name, content := range contents {
+				if content == nil {
+					continue
+				}
+				if err := os.WriteFile(filepath.Join(target, "dir", name), content, 0644); err != nil {
+					t.Fatalf("unexpected error: %s", err.Error())
+				}
+			}
+
+			lines, ok, err := verify(torrentPath, target, true)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if ok != ts.expected.OK {
+				t.Fatalf("unexpected result: %v", ok)
+			}
+
+			var report verifyReport
+			if err := json.Unmarshal([]byte(lines[0]), &report); err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if !reflect.DeepEqual(report, ts.expected) {
+				t.Fatalf("unexpected report: %+v", report)
+			}
+
+			lines, _, err = verify(torrentPath, target, false)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if len(lines) < len(files)+1 {
+				t.Fatalf("unexpected output: %v", lines)
+			}
+		})
+	}
+}